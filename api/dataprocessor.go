@@ -301,6 +301,14 @@ LOOP:
 
 }
 
+// alignStart aligns the fixed points of the request for runtime consolidation, if enabled. see consolidation.AlignStart
+func alignStart(fixed []schema.Point, req models.Req) []schema.Point {
+	if !alignConsolidation {
+		return fixed
+	}
+	return consolidation.AlignStart(fixed, req.ArchInterval, req.AggNum)
+}
+
 func (s *Server) getTarget(ctx context.Context, req models.Req) (points []schema.Point, interval uint32, err error) {
 	defer doRecover(&err)
 	readRollup := req.Archive != 0 // do we need to read from a downsampled series?
@@ -322,7 +330,7 @@ func (s *Server) getTarget(ctx context.Context, req models.Req) (points []schema
 		if err != nil {
 			return nil, req.OutInterval, err
 		}
-		return consolidation.ConsolidateContext(ctx, fixed, req.AggNum, req.Consolidator), req.OutInterval, nil
+		return consolidation.ConsolidateContext(ctx, alignStart(fixed, req), req.AggNum, req.Consolidator), req.OutInterval, nil
 	} else if readRollup && !normalize {
 		if req.Consolidator == consolidation.Avg {
 			sumFixed, err := s.getSeriesFixed(ctx, req, consolidation.Sum)
@@ -355,21 +363,21 @@ func (s *Server) getTarget(ctx context.Context, req models.Req) (points []schema
 			}
 			return divideContext(
 				ctx,
-				consolidation.Consolidate(sumFixed, req.AggNum, consolidation.Sum),
-				consolidation.Consolidate(cntFixed, req.AggNum, consolidation.Sum),
+				consolidation.Consolidate(alignStart(sumFixed, req), req.AggNum, consolidation.Sum),
+				consolidation.Consolidate(alignStart(cntFixed, req), req.AggNum, consolidation.Sum),
 			), req.OutInterval, nil
 		} else {
 			fixed, err := s.getSeriesFixed(ctx, req, req.Consolidator)
 			if err != nil {
 				return nil, req.OutInterval, err
 			}
-			return consolidation.ConsolidateContext(ctx, fixed, req.AggNum, req.Consolidator), req.OutInterval, nil
+			return consolidation.ConsolidateContext(ctx, alignStart(fixed, req), req.AggNum, req.Consolidator), req.OutInterval, nil
 		}
 	}
 }
 
 func logLoad(typ string, key schema.AMKey, from, to uint32) {
-	log.Debugf("DP load from %-6s %20s %d - %d (%s - %s) span:%ds", typ, key, from, to, util.TS(from), util.TS(to), to-from-1)
+	log.Debugf("DP load from %-6s %20s %d - %d (%s - %s) span:%ds", typ, key, from, to, util.TS(from), util.TS(to), to-from)
 }
 
 // getSeriesFixed gets the series and makes sure the output is quantized
@@ -21,6 +21,7 @@ import (
 
 func init() {
 	cluster.Init("default", "test", time.Now(), "http", 6060)
+	mdata.Aggregations = conf.NewAggregations()
 }
 
 func TestDivide(t *testing.T) {
@@ -92,6 +93,47 @@ type fixc struct {
 	out      []schema.Point
 }
 
+// when runtime consolidating avg rollups, getTarget consolidates the sum and cnt rollups
+// separately and only then divides them, which weighs every rollup point by the amount of raw points behind it.
+// this test shows that this matches averaging the raw data, whereas averaging the averages does not.
+func TestAvgRollupWeightedByCount(t *testing.T) {
+	nan := math.NaN()
+	raw := []schema.Point{
+		{Val: 1, Ts: 10},
+		{Val: nan, Ts: 20},
+		{Val: 3, Ts: 30},
+		{Val: 5, Ts: 40},
+		{Val: nan, Ts: 50},
+		{Val: nan, Ts: 60},
+		{Val: 7, Ts: 70},
+		{Val: 9, Ts: 80},
+	}
+	copyPoints := func(in []schema.Point) []schema.Point {
+		return append([]schema.Point(nil), in...)
+	}
+	// the rollups with a span of 2 raw points, like the aggregators would create them
+	sum := consolidation.Consolidate(copyPoints(raw), 2, consolidation.Sum)
+	cnt := consolidation.Consolidate(copyPoints(raw), 2, consolidation.Cnt)
+
+	// what we want: the average of the raw data over 4 points
+	exp := consolidation.Consolidate(copyPoints(raw), 4, consolidation.Avg)
+
+	// what getTarget does to normalize avg rollups with an aggNum of 2
+	weighted := divide(
+		consolidation.Consolidate(copyPoints(sum), 2, consolidation.Sum),
+		consolidation.Consolidate(copyPoints(cnt), 2, consolidation.Sum),
+	)
+	// the naive approach: averaging the averages
+	naive := consolidation.Consolidate(divide(copyPoints(sum), copyPoints(cnt)), 2, consolidation.Avg)
+
+	if !reflect.DeepEqual(weighted, exp) {
+		t.Fatalf("expected weighted average %v to match the raw average %v", weighted, exp)
+	}
+	// the first group has 3 raw points: avg(1,3,5) = 3, but avg(avg(1), avg(3,5)) = 2.5
+	if naive[0].Val != 2.5 || exp[0].Val != 3 {
+		t.Fatalf("expected the naive average of the first group to be 2.5 and the raw one 3, got %v and %v", naive[0].Val, exp[0].Val)
+	}
+}
 func nullPoints(from, to, interval uint32) []schema.Point {
 	out := make([]schema.Point, 0)
 	for i := from; i < to; i += interval {
@@ -7,22 +7,35 @@ import (
 
 	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/errors"
 	"github.com/grafana/metrictank/util"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
 )
 
+// Alignment describes how the time range of a request is snapped to its output interval when it is planned
+type Alignment uint8
+
+const (
+	AlignNone     Alignment = iota // the time range is used as requested
+	AlignForward                   // From and To are both moved forward, to the next multiple of the output interval
+	AlignBackward                  // From and To are both moved backward, to the previous multiple of the output interval
+)
+
 // Req is a request for data by MKey and parameters such as consolidator, max points, etc
 type Req struct {
 	// these fields can be set straight away:
-	MKey         schema.MKey                `json:"key"`     // metric key aka metric definition id (orgid.<hash>), often same as target for graphite-metrictank requests
-	Target       string                     `json:"target"`  // the target we should return either to graphite or as if we're graphite.  simply the graphite metric key from the index
-	Pattern      string                     `json:"pattern"` // the original query pattern specified by user (not wrapped by any functions). e.g. `foo.b*`. To be able to tie the result data back to the data need as requested
-	From         uint32                     `json:"from"`
-	To           uint32                     `json:"to"`
-	MaxPoints    uint32                     `json:"maxPoints"`
-	RawInterval  uint32                     `json:"rawInterval"`  // the interval of the raw metric before any consolidation
-	Consolidator consolidation.Consolidator `json:"consolidator"` // consolidation method for rollup archive and normalization. (not runtime consolidation)
+	MKey           schema.MKey                `json:"key"`     // metric key aka metric definition id (orgid.<hash>), often same as target for graphite-metrictank requests
+	Target         string                     `json:"target"`  // the target we should return either to graphite or as if we're graphite.  simply the graphite metric key from the index
+	Pattern        string                     `json:"pattern"` // the original query pattern specified by user (not wrapped by any functions). e.g. `foo.b*`. To be able to tie the result data back to the data need as requested
+	From           uint32                     `json:"from"`    // inclusive
+	To             uint32                     `json:"to"`      // exclusive
+	MaxPoints      uint32                     `json:"maxPoints"`
+	TargetInterval uint32                     `json:"targetInterval"` // if set, the exact interval the output must have. MaxPoints is ignored in that case (see NewReqStep)
+	RawOnly        bool                       `json:"rawOnly"`        // if set, only read the raw data, never rollups (see NewReqRaw)
+	Align          Alignment                  `json:"align"`          // how to snap From and To to the output interval when planning (see AlignRange)
+	RawInterval    uint32                     `json:"rawInterval"`    // the interval of the raw metric before any consolidation
+	Consolidator   consolidation.Consolidator `json:"consolidator"`   // consolidation method for rollup archive and normalization. (not runtime consolidation)
 	// requested consolidation method: either same as Consolidator, or 0 (meaning use configured default)
 	// we need to make this differentiation to tie back to the original request (and we can't just fill in the concrete consolidation in the request,
 	// because one request may result in multiple series with different consolidators)
@@ -37,6 +50,7 @@ type Req struct {
 	TTL          uint32 `json:"ttl"`          // the ttl of the archive we'll fetch
 	OutInterval  uint32 `json:"outInterval"`  // the interval of the output data, after any runtime consolidation
 	AggNum       uint32 `json:"aggNum"`       // how many points to consolidate together at runtime, after fetching from the archive
+	Fallback     string `json:"fallback"`     // if set, why we had to fall back to raw data rather than considering rollups (for debugging)
 }
 
 func NewReq(key schema.MKey, target, patt string, from, to, maxPoints, rawInterval uint32, cons, consReq consolidation.Consolidator, node cluster.Node, schemaId, aggId uint16) Req {
@@ -47,6 +61,9 @@ func NewReq(key schema.MKey, target, patt string, from, to, maxPoints, rawInterv
 		from,
 		to,
 		maxPoints,
+		0,
+		false,
+		AlignNone,
 		rawInterval,
 		cons,
 		consReq,
@@ -58,16 +75,139 @@ func NewReq(key schema.MKey, target, patt string, from, to, maxPoints, rawInterv
 		0,  // this is supposed to be updated still
 		0,  // this is supposed to be updated still
 		0,  // this is supposed to be updated still
+		"",
+	}
+}
+
+// NewReqStep creates a request whose output interval is pinned to the given step (in seconds),
+// rather than derived from a max amount of points.
+func NewReqStep(key schema.MKey, target, patt string, from, to, step, rawInterval uint32, cons, consReq consolidation.Consolidator, node cluster.Node, schemaId, aggId uint16) Req {
+	req := NewReq(key, target, patt, from, to, 0, rawInterval, cons, consReq, node, schemaId, aggId)
+	req.TargetInterval = step
+	return req
+}
+
+// NewReqRaw creates a request that is always served from the raw data, regardless of the time range
+// or the max-points-per-req-soft setting. It is meant for debugging data integrity.
+// Runtime consolidation still applies to honor maxPoints, but beware: for wide time ranges
+// this can mean fetching and processing huge amounts of points. (max-points-per-req-hard still applies)
+func NewReqRaw(key schema.MKey, target, patt string, from, to, maxPoints, rawInterval uint32, cons, consReq consolidation.Consolidator, node cluster.Node, schemaId, aggId uint16) Req {
+	req := NewReq(key, target, patt, from, to, maxPoints, rawInterval, cons, consReq, node, schemaId, aggId)
+	req.RawOnly = true
+	return req
+}
+
+// Clone returns a copy of the request.
+// Req only holds values, so this is the same as assigning it, but it makes explicit that the copy
+// is meant to be modified, typically using the With methods.
+func (r Req) Clone() Req {
+	return r
+}
+
+// WithArchive returns a copy of the request, planned to fetch the given archive, which has the
+// given interval and ttl, and to runtime consolidate it to outInterval.
+// outInterval must be a multiple of archInterval.
+func (r Req) WithArchive(archive int, archInterval, ttl, outInterval uint32) Req {
+	r.Archive = archive
+	r.ArchInterval = archInterval
+	r.TTL = ttl
+	r.OutInterval = outInterval
+	r.AggNum = outInterval / archInterval
+	return r
+}
+
+// WithConsolidator returns a copy of the request with the given consolidator.
+// ConsReq is left as is, so that the result can still be tied back to the original request.
+func (r Req) WithConsolidator(cons consolidation.Consolidator) Req {
+	r.Consolidator = cons
+	return r
+}
+
+// WithRange returns a copy of the request for the given time range (from inclusive, to exclusive)
+func (r Req) WithRange(from, to uint32) Req {
+	r.From = from
+	r.To = to
+	return r
+}
+
+// WithAlign returns a copy of the request that snaps its time range to the output interval in the given way, once planned
+func (r Req) WithAlign(align Alignment) Req {
+	r.Align = align
+	return r
+}
+
+// AlignRange returns a copy of the request with From and To snapped to multiples of OutInterval, as set by Align.
+// AlignForward moves both forward: a partial first bucket is left out, and a partial last bucket is completed.
+// AlignBackward moves both backward: a partial first bucket is completed, and a partial last bucket is left out.
+// If that leaves an empty range, To is set to one OutInterval after From, so there is still a bucket to return.
+// With AlignNone, or if the request is not planned yet (OutInterval is 0), the request is returned as is.
+func (r Req) AlignRange() Req {
+	if r.OutInterval == 0 {
+		return r
 	}
+	switch r.Align {
+	case AlignForward:
+		r.From = (r.From + r.OutInterval - 1) / r.OutInterval * r.OutInterval
+		r.To = (r.To + r.OutInterval - 1) / r.OutInterval * r.OutInterval
+	case AlignBackward:
+		r.From = r.From / r.OutInterval * r.OutInterval
+		r.To = r.To / r.OutInterval * r.OutInterval
+	default:
+		return r
+	}
+	if r.To <= r.From {
+		r.To = r.From + r.OutInterval
+	}
+	return r
+}
+
+// Validate checks that the request describes a valid time range and metric.
+// Note that a MaxPoints of 0 is valid: it means the amount of points is not limited.
+func (r Req) Validate() error {
+	if r.From >= r.To {
+		return errors.NewBadRequest(fmt.Sprintf("invalid request for %s: from (%d) must be lower than to (%d)", r.MKey, r.From, r.To))
+	}
+	if r.RawInterval == 0 {
+		return errors.NewBadRequest(fmt.Sprintf("invalid request for %s: raw interval must be > 0", r.MKey))
+	}
+	return nil
+}
+
+// Span returns the number of seconds covered by the request.
+// From is inclusive and To is exclusive, so this is To-From, which lines up with
+// the tsRange / interval math used for archive selection.
+// It returns 0 for an invalid range (see Validate)
+func (r Req) Span() uint32 {
+	if r.To <= r.From {
+		return 0
+	}
+	return r.To - r.From
 }
 
 func (r Req) String() string {
-	return fmt.Sprintf("%s %d - %d (%s - %s) span:%ds. points <= %d. %s.", r.MKey.String(), r.From, r.To, util.TS(r.From), util.TS(r.To), r.To-r.From-1, r.MaxPoints, r.Consolidator)
+	return fmt.Sprintf("%s %d - %d (%s - %s) span:%ds. points <= %d. %s.", r.MKey.String(), r.From, r.To, util.TS(r.From), util.TS(r.To), r.Span(), r.MaxPoints, r.Consolidator)
 }
 
 func (r Req) DebugString() string {
-	return fmt.Sprintf("Req key=%q target=%q pattern=%q %d - %d (%s - %s) (span %d) maxPoints=%d rawInt=%d cons=%s consReq=%d schemaId=%d aggId=%d archive=%d archInt=%d ttl=%d outInt=%d aggNum=%d",
-		r.MKey, r.Target, r.Pattern, r.From, r.To, util.TS(r.From), util.TS(r.To), r.To-r.From-1, r.MaxPoints, r.RawInterval, r.Consolidator, r.ConsReq, r.SchemaId, r.AggId, r.Archive, r.ArchInterval, r.TTL, r.OutInterval, r.AggNum)
+	return fmt.Sprintf("Req key=%q target=%q pattern=%q %d - %d (%s - %s) (span %d) maxPoints=%d targetInt=%d rawOnly=%t align=%d rawInt=%d cons=%s consReq=%d schemaId=%d aggId=%d archive=%d archInt=%d ttl=%d outInt=%d aggNum=%d fallback=%q",
+		r.MKey, r.Target, r.Pattern, r.From, r.To, util.TS(r.From), util.TS(r.To), r.Span(), r.MaxPoints, r.TargetInterval, r.RawOnly, r.Align, r.RawInterval, r.Consolidator, r.ConsReq, r.SchemaId, r.AggId, r.Archive, r.ArchInterval, r.TTL, r.OutInterval, r.AggNum, r.Fallback)
+}
+
+// CacheKey returns an identifier for the data the request returns, for caching results:
+// requests with the same CacheKey return the same points.
+// When the request is planned to read a rollup archive, From and To are rounded up to a multiple of ArchInterval:
+// rollups only have points at multiples of their interval, and the request fetches those in [From, To),
+// so this rounding doesn't change which points are fetched, and requests whose time ranges only differ
+// within the same interval share a key.
+// Raw data may have points at an offset from the interval, so for raw reads (and unplanned requests)
+// From and To are used as is.
+func (r Req) CacheKey() string {
+	from, to := r.From, r.To
+	if r.Archive > 0 && r.ArchInterval > 0 {
+		from = (from + r.ArchInterval - 1) / r.ArchInterval * r.ArchInterval
+		to = (to + r.ArchInterval - 1) / r.ArchInterval * r.ArchInterval
+	}
+	return fmt.Sprintf("%s;%q;%d;%d;%d;%d;%t;%s;%d;%d;%d;%d", r.MKey, r.Target, from, to, r.MaxPoints, r.TargetInterval, r.RawOnly, r.Consolidator, r.Archive, r.ArchInterval, r.OutInterval, r.AggNum)
 }
 
 // Trace puts all request properties as tags in a span
@@ -78,8 +218,11 @@ func (r Req) Trace(span opentracing.Span) {
 	span.SetTag("pattern", r.Pattern)
 	span.SetTag("from", r.From)
 	span.SetTag("to", r.To)
-	span.SetTag("span", r.To-r.From-1)
+	span.SetTag("span", r.Span())
 	span.SetTag("mdp", r.MaxPoints)
+	span.SetTag("targetInterval", r.TargetInterval)
+	span.SetTag("rawOnly", r.RawOnly)
+	span.SetTag("align", r.Align)
 	span.SetTag("rawInterval", r.RawInterval)
 	span.SetTag("cons", r.Consolidator)
 	span.SetTag("consReq", r.ConsReq)
@@ -90,6 +233,7 @@ func (r Req) Trace(span opentracing.Span) {
 	span.SetTag("TTL", r.TTL)
 	span.SetTag("outInterval", r.OutInterval)
 	span.SetTag("aggNum", r.AggNum)
+	span.SetTag("fallback", r.Fallback)
 }
 
 // TraceLog puts all request properties in a span log entry
@@ -103,8 +247,11 @@ func (r Req) TraceLog(span opentracing.Span) {
 		log.String("pattern", r.Pattern),
 		log.Int("from", int(r.From)),
 		log.Int("to", int(r.To)),
-		log.Int("span", int(r.To-r.From-1)),
+		log.Int("span", int(r.Span())),
 		log.Int("mdp", int(r.MaxPoints)),
+		log.Int("targetInterval", int(r.TargetInterval)),
+		log.Bool("rawOnly", r.RawOnly),
+		log.Int("align", int(r.Align)),
 		log.Int("rawInterval", int(r.RawInterval)),
 		log.String("cons", r.Consolidator.String()),
 		log.String("consReq", r.ConsReq.String()),
@@ -115,6 +262,7 @@ func (r Req) TraceLog(span opentracing.Span) {
 		log.Int("TTL", int(r.TTL)),
 		log.Int("outInterval", int(r.OutInterval)),
 		log.Int("aggNum", int(r.AggNum)),
+		log.String("fallback", r.Fallback),
 	)
 }
 
@@ -145,6 +293,15 @@ func (a Req) Equals(b Req) bool {
 	if a.MaxPoints != b.MaxPoints {
 		return false
 	}
+	if a.TargetInterval != b.TargetInterval {
+		return false
+	}
+	if a.RawOnly != b.RawOnly {
+		return false
+	}
+	if a.Align != b.Align {
+		return false
+	}
 	if a.RawInterval != b.RawInterval {
 		return false
 	}
@@ -175,5 +332,8 @@ func (a Req) Equals(b Req) bool {
 	if a.AggNum != b.AggNum {
 		return false
 	}
+	if a.Fallback != b.Fallback {
+		return false
+	}
 	return true
 }
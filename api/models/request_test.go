@@ -0,0 +1,134 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/test"
+)
+
+func TestReqValidate(t *testing.T) {
+	cases := []struct {
+		from        uint32
+		to          uint32
+		maxPoints   uint32
+		rawInterval uint32
+		valid       bool
+	}{
+		{0, 1, 800, 10, true},
+		{10, 100, 0, 10, true}, // maxPoints 0 means unlimited
+		{100, 100, 800, 10, false},
+		{101, 100, 800, 10, false},
+		{0, 0, 800, 10, false},
+		{10, 100, 800, 0, false},
+	}
+	for i, c := range cases {
+		req := NewReq(test.GetMKey(1), "a", "a", c.from, c.to, c.maxPoints, c.rawInterval, consolidation.Avg, consolidation.None, nil, 0, 0)
+		err := req.Validate()
+		if c.valid && err != nil {
+			t.Errorf("case %d: expected request %s to be valid, got error %q", i, req.DebugString(), err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("case %d: expected request %s to be invalid", i, req.DebugString())
+		}
+	}
+}
+
+func TestReqSpan(t *testing.T) {
+	cases := []struct {
+		from uint32
+		to   uint32
+		span uint32
+	}{
+		{0, 60, 60},
+		{60, 61, 1},
+		{60, 60, 0},
+		{61, 60, 0},
+	}
+	for i, c := range cases {
+		req := NewReq(test.GetMKey(1), "a", "a", c.from, c.to, 800, 10, consolidation.Avg, consolidation.None, nil, 0, 0)
+		if span := req.Span(); span != c.span {
+			t.Errorf("case %d: expected span %d for %d - %d, got %d", i, c.span, c.from, c.to, span)
+		}
+	}
+}
+
+func TestReqCacheKey(t *testing.T) {
+	planned := func(from, to uint32, archive int, archInterval uint32) Req {
+		req := NewReq(test.GetMKey(1), "a", "a", from, to, 800, 10, consolidation.Avg, consolidation.None, nil, 0, 0)
+		req.Archive = archive
+		req.ArchInterval = archInterval
+		req.OutInterval = archInterval
+		req.AggNum = 1
+		return req
+	}
+	cases := []struct {
+		a, b  Req
+		equal bool
+	}{
+		// rollup reads fetch the same points for time ranges within the same interval
+		{planned(601, 3600, 1, 600), planned(1200, 3599, 1, 600), true},
+		{planned(600, 3600, 1, 600), planned(601, 3600, 1, 600), false},
+		{planned(601, 3601, 1, 600), planned(601, 3600, 1, 600), false},
+		// raw data may be at an offset, so raw reads are not quantized
+		{planned(601, 3600, 0, 10), planned(602, 3600, 0, 10), false},
+		{planned(601, 3600, 0, 10), planned(601, 3600, 0, 10), true},
+		// the planning is part of the key
+		{planned(600, 3600, 1, 600), planned(600, 3600, 2, 600), false},
+	}
+	for i, c := range cases {
+		if equal := c.a.CacheKey() == c.b.CacheKey(); equal != c.equal {
+			t.Errorf("case %d: expected keys %q and %q to be equal: %t", i, c.a.CacheKey(), c.b.CacheKey(), c.equal)
+		}
+	}
+}
+
+func TestReqWith(t *testing.T) {
+	req := NewReq(test.GetMKey(1), "a", "a", 0, 3600, 800, 10, consolidation.Avg, consolidation.None, nil, 0, 0)
+	orig := req.Clone()
+
+	planned := req.WithArchive(1, 60, 86400, 120).WithConsolidator(consolidation.Max).WithRange(60, 1800)
+	if planned.Archive != 1 || planned.ArchInterval != 60 || planned.TTL != 86400 || planned.OutInterval != 120 || planned.AggNum != 2 {
+		t.Errorf("expected archive 1 with interval 60, ttl 86400, outInterval 120 and aggNum 2, got %s", planned.DebugString())
+	}
+	if planned.Consolidator != consolidation.Max || planned.ConsReq != consolidation.None {
+		t.Errorf("expected consolidator max and consReq none, got %s and %s", planned.Consolidator, planned.ConsReq)
+	}
+	if planned.From != 60 || planned.To != 1800 {
+		t.Errorf("expected range 60 - 1800, got %d - %d", planned.From, planned.To)
+	}
+	if req != orig {
+		t.Errorf("expected original request to be unchanged, got %s", req.DebugString())
+	}
+}
+
+func TestReqAlignRange(t *testing.T) {
+	cases := []struct {
+		align   Alignment
+		from    uint32
+		to      uint32
+		expFrom uint32
+		expTo   uint32
+	}{
+		{AlignNone, 1010, 1970, 1010, 1970},
+		{AlignForward, 1010, 1970, 1020, 1980},
+		{AlignBackward, 1010, 1970, 1000, 1960},
+		// already aligned ranges are left as is
+		{AlignForward, 1020, 1980, 1020, 1980},
+		{AlignBackward, 1020, 1980, 1020, 1980},
+		// ranges within a single bucket still return one bucket
+		{AlignForward, 1001, 1019, 1020, 1040},
+		{AlignBackward, 1001, 1019, 1000, 1020},
+	}
+	for i, c := range cases {
+		req := NewReq(test.GetMKey(1), "a", "a", c.from, c.to, 800, 10, consolidation.Avg, consolidation.None, nil, 0, 0).WithAlign(c.align)
+		// not planned yet, so there's no interval to align to
+		if got := req.AlignRange(); got.From != c.from || got.To != c.to {
+			t.Errorf("case %d: expected unplanned request to keep range %d - %d, got %d - %d", i, c.from, c.to, got.From, got.To)
+		}
+		got := req.WithArchive(0, 10, 3600, 20).AlignRange()
+		if got.From != c.expFrom || got.To != c.expTo {
+			t.Errorf("case %d: expected range %d - %d, got %d - %d", i, c.expFrom, c.expTo, got.From, got.To)
+		}
+	}
+}
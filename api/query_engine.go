@@ -1,14 +1,19 @@
 package api
 
 import (
+	"fmt"
 	"math"
+	"time"
 
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/stats"
 	"github.com/grafana/metrictank/util"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -19,14 +24,20 @@ var (
 	reqRenderPointsFetched = stats.NewMeter32("api.request.render.points_fetched", false)
 	// metric api.request.render.points_returned is the number of points the request will return.
 	reqRenderPointsReturned = stats.NewMeter32("api.request.render.points_returned", false)
+	// metric api.request.render.archive_misaligned is the number of requests for which a rollup archive was skipped when planning, because its interval is not a multiple of the raw interval of the metric
+	reqRenderArchiveMisaligned = stats.NewCounter32("api.request.render.archive_misaligned")
 
-	errUnSatisfiable   = response.NewError(404, "request cannot be satisfied due to lack of available retentions")
-	errMaxPointsPerReq = response.NewError(413, "request exceeds max-points-per-req-hard limit. Reduce the time range or number of targets or ask your admin to increase the limit.")
+	errUnSatisfiable     = response.NewError(404, "request cannot be satisfied due to lack of available retentions")
+	errMaxPointsPerReq   = response.NewError(413, "request exceeds max-points-per-req-hard limit. Reduce the time range or number of targets or ask your admin to increase the limit.")
+	errStepUnSatisfiable = response.NewError(400, "requested step cannot be satisfied: no available archive has an interval that the step is a multiple of")
 )
 
 // alignRequests updates the requests with all details for fetching, making sure all metrics are in the same, optimal interval
+// once their output interval is known, their time range is snapped to it as requested by their Align setting (see Req.AlignRange)
 // note: it is assumed that all requests have the same maxDataPoints, from & to.
 // also takes a "now" value which we compare the TTL against
+// besides the requests, it returns the amount of points to fetch and the amount of points we will return.
+// the latter takes consolidation to maxDataPoints into account, so it never exceeds maxDataPoints per series.
 func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint32, uint32, error) {
 	tsRange := to - from
 
@@ -36,6 +47,9 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 
 	for i := range reqs {
 		req := &reqs[i]
+		if err := req.Validate(); err != nil {
+			return nil, 0, 0, err
+		}
 		req.Archive = -1
 		targets[req.Target] = struct{}{}
 	}
@@ -52,6 +66,13 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 		minIntervalHard = uint32(math.Ceil(float64(tsRange) / (float64(maxPointsPerReqHard) / float64(numTargets))))
 	}
 
+	if reqs[0].TargetInterval > 0 {
+		if reqs[0].TargetInterval < minIntervalHard {
+			return nil, 0, 0, errMaxPointsPerReq
+		}
+		return alignRequestsStep(from, minTTL, tsRange, reqs)
+	}
+
 	// set preliminary settings. may be adjusted further down
 	// but for now:
 	// for each req, find the highest res archive
@@ -60,25 +81,32 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 	// fallback to lowest res option (which *should* have the longest TTL)
 	for i := range reqs {
 		req := &reqs[i]
-		retentions := mdata.Schemas.Get(req.SchemaId).Retentions
+		retentions := getRetentions(req)
+		var misaligned bool
 		for i, ret := range retentions {
 			// skip non-ready option.
 			if ret.Ready > from {
 				continue
 			}
-			req.Archive = i
-			req.TTL = uint32(ret.MaxRetention())
+			archInterval := uint32(ret.SecondsPerPoint)
 			if i == 0 {
 				// The first retention is raw data, so use its native interval
-				req.ArchInterval = req.RawInterval
-			} else {
-				req.ArchInterval = uint32(ret.SecondsPerPoint)
+				archInterval = req.RawInterval
+			} else if rollupMisaligned(req, i, archInterval) {
+				misaligned = true
+				continue
 			}
+			req.Archive = i
+			req.TTL = uint32(ret.MaxRetention())
+			req.ArchInterval = archInterval
 
 			if req.TTL >= minTTL && req.ArchInterval >= minIntervalSoft {
 				break
 			}
 		}
+		if misaligned {
+			reqRenderArchiveMisaligned.Inc()
+		}
 		if req.Archive == -1 {
 			return nil, 0, 0, errUnSatisfiable
 		}
@@ -94,7 +122,7 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 	interval := util.Lcm(listIntervals)
 
 	if interval < minIntervalHard {
-		return nil, 0, 0, errMaxPointsPerReq
+		return nil, 0, 0, maxPointsPerReqErr(reqs, tsRange)
 	}
 
 	// now, for all our requests, set all their properties.  we may have to apply runtime consolidation to get the
@@ -116,16 +144,12 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 			// we have to deliver an interval higher than what we originally came up with
 
 			// let's see first if we can deliver it via lower-res rollup archives, if we have any
-			retentions := mdata.Schemas.Get(req.SchemaId).Retentions
+			retentions := getRetentions(req)
 			for i, ret := range retentions[req.Archive+1:] {
 				archInterval := uint32(ret.SecondsPerPoint)
-				if interval == archInterval && ret.Ready <= from {
+				if interval == archInterval && ret.Ready <= from && !rollupMisaligned(req, req.Archive+1+i, archInterval) {
 					// we're in luck. this will be more efficient than runtime consolidation
-					req.Archive = req.Archive + 1 + i
-					req.ArchInterval = archInterval
-					req.TTL = uint32(ret.MaxRetention())
-					req.OutInterval = archInterval
-					req.AggNum = 1
+					*req = req.WithArchive(req.Archive+1+i, archInterval, uint32(ret.MaxRetention()), archInterval)
 					break
 				}
 
@@ -140,19 +164,291 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 				req.AggNum = interval / req.ArchInterval
 			}
 		}
+		*req = req.AlignRange()
 		pointsFetch += tsRange / req.ArchInterval
 		reqRenderChosenArchive.Value(req.Archive)
 	}
 
-	pointsPerSerie := tsRange / interval
-	if reqs[0].MaxPoints > 0 && pointsPerSerie > reqs[0].MaxPoints {
-		aggNum := consolidation.AggEvery(pointsPerSerie, reqs[0].MaxPoints)
-		pointsPerSerie = pointsPerSerie / aggNum
+	// the series will be consolidated down to MaxPoints after processing, if needed. see expr.Plan.Run
+	pointsPerSerie := consolidation.OutPoints(numPoints(tsRange, interval), reqs[0].MaxPoints)
+	pointsReturn := uint32(len(reqs)) * pointsPerSerie
+	reqRenderPointsFetched.ValueUint32(pointsFetch)
+	reqRenderPointsReturned.ValueUint32(pointsReturn)
+
+	return reqs, pointsFetch, pointsReturn, nil
+}
+
+// PlanRequests plans the given requests the way a render does, without fetching any data:
+// it fills in the archive, archive interval, output interval and aggNum of each request
+// (updating them in place) and returns the amount of points they will fetch and return.
+// This allows estimating the cost of a query before running it.
+func PlanRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint32, uint32, error) {
+	return alignRequests(now, from, to, reqs)
+}
+
+// SplitRequest splits a planned request (see PlanRequests) into sub-requests at the retention boundaries
+// of its archives, so that recent data can be read from finer archives than older data,
+// which only the coarser archives still retain.
+// The sub-requests are returned in chronological order, and together cover [req.From, req.To).
+// All sub-requests keep the OutInterval of req: each one reads an archive whose interval the OutInterval
+// is a multiple of, and sets its AggNum to runtime consolidate that archive to the OutInterval.
+// Hence the fetched data can simply be concatenated.
+// To assure no consolidation bucket is spread over two sub-requests, the boundaries between them are
+// aligned to the OutInterval (the last point of each bucket is a multiple of OutInterval, see Consolidate).
+// If the oldest data is not retained by any archive, the coarsest one reads it anyway, like alignRequests does.
+// A request that is not planned yet is returned as is.
+func SplitRequest(now uint32, req models.Req) []models.Req {
+	if req.OutInterval == 0 {
+		return []models.Req{req}
+	}
+	var subs []models.Req
+	to := req.To
+	retentions := getRetentions(&req)
+	for i, ret := range retentions {
+		archInterval := uint32(ret.SecondsPerPoint)
+		if i == 0 {
+			archInterval = req.RawInterval
+		}
+		if archInterval > req.OutInterval || req.OutInterval%archInterval != 0 || rollupMisaligned(&req, i, archInterval) {
+			continue
+		}
+		// the oldest timestamp this archive can serve
+		start := ret.Ready
+		if ttl := uint32(ret.MaxRetention()); now > ttl && now-ttl > start {
+			start = now - ttl
+		}
+		sub := req.WithArchive(i, archInterval, uint32(ret.MaxRetention()), req.OutInterval)
+		if start <= req.From {
+			subs = append(subs, sub.WithRange(req.From, to))
+			to = req.From
+			break
+		}
+		// round up, to the first timestamp that starts a bucket
+		boundary := (start-1+req.OutInterval-1)/req.OutInterval*req.OutInterval + 1
+		if boundary >= to {
+			continue
+		}
+		subs = append(subs, sub.WithRange(boundary, to))
+		to = boundary
 	}
+	if len(subs) == 0 {
+		return []models.Req{req}
+	}
+	if to > req.From {
+		subs[len(subs)-1].From = req.From
+	}
+	for i, j := 0, len(subs)-1; i < j; i, j = i+1, j-1 {
+		subs[i], subs[j] = subs[j], subs[i]
+	}
+	return subs
+}
 
-	pointsReturn := uint32(len(reqs)) * pointsPerSerie
+// alignRequestsStep updates the requests with all details for fetching, such that their output interval
+// is exactly their TargetInterval. It is assumed that all requests have the same TargetInterval, from & to.
+// MaxPoints is ignored.
+// for each req, we pick the lowest res archive that is ready and whose interval the target interval is a multiple of
+// (preferring those that retain all the data we need), and runtime consolidate it to the target interval.
+// We never upsample: if no archive qualifies, the request can't be satisfied.
+func alignRequestsStep(from, minTTL, tsRange uint32, reqs []models.Req) ([]models.Req, uint32, uint32, error) {
+	interval := reqs[0].TargetInterval
+
+	var pointsFetch uint32
+	for i := range reqs {
+		req := &reqs[i]
+		retentions := getRetentions(req)
+		var misaligned bool
+		for i, ret := range retentions {
+			// skip non-ready option.
+			if ret.Ready > from {
+				continue
+			}
+			archInterval := uint32(ret.SecondsPerPoint)
+			if i == 0 {
+				// The first retention is raw data, so use its native interval
+				archInterval = req.RawInterval
+			}
+			if interval%archInterval != 0 {
+				continue
+			}
+			if rollupMisaligned(req, i, archInterval) {
+				misaligned = true
+				continue
+			}
+			ttl := uint32(ret.MaxRetention())
+			// don't trade an option that retains all the data for one that doesn't
+			if req.Archive != -1 && req.TTL >= minTTL && ttl < minTTL {
+				continue
+			}
+			req.Archive = i
+			req.ArchInterval = archInterval
+			req.TTL = ttl
+		}
+		if misaligned {
+			reqRenderArchiveMisaligned.Inc()
+		}
+		if req.Archive == -1 {
+			return nil, 0, 0, errStepUnSatisfiable
+		}
+		req.OutInterval = interval
+		req.AggNum = interval / req.ArchInterval
+		*req = req.AlignRange()
+
+		pointsFetch += tsRange / req.ArchInterval
+		reqRenderChosenArchive.Value(req.Archive)
+	}
+
+	pointsReturn := uint32(len(reqs)) * numPoints(tsRange, interval)
 	reqRenderPointsFetched.ValueUint32(pointsFetch)
 	reqRenderPointsReturned.ValueUint32(pointsReturn)
 
 	return reqs, pointsFetch, pointsReturn, nil
 }
+
+// maxPointsPerReqErr returns the error for requests that exceed the max-points-per-req-hard limit.
+// if that is because a request is restricted to raw data, as it asks for raw data only or for a consolidator
+// that can't be computed from rollups (see getRetentions), coarser rollups can't help, so we explain that instead.
+func maxPointsPerReqErr(reqs []models.Req, tsRange uint32) error {
+	for _, req := range reqs {
+		if !req.RawOnly && req.Fallback == "" {
+			continue
+		}
+		reason := "raw data was requested"
+		if req.Fallback != "" {
+			reason = req.Fallback
+		}
+		return response.NewError(413, fmt.Sprintf("cannot satisfy max-points-per-req-hard limit for consolidator %s over range %s with raw-only data (%s). Reduce the time range or number of targets, or use a consolidator that can be computed from rollups.", req.Consolidator, time.Duration(tsRange)*time.Second, reason))
+	}
+	return errMaxPointsPerReq
+}
+
+// numPoints returns the maximum amount of points at the given interval that fit in a timerange of tsRange seconds
+func numPoints(tsRange, interval uint32) uint32 {
+	return (tsRange + interval - 1) / interval
+}
+
+// rollupMisaligned returns whether the given archive of the request is a rollup archive whose interval is
+// not a multiple of the raw interval of the metric. Such rollups aggregate a varying number of raw points
+// per bucket, so their data is subtly wrong, and we'd rather use another archive.
+// It is called for every archive considered while planning, so it only logs at debug level.
+// Misaligned storage-schemas are reported at startup by CheckRollupIntervals instead.
+func rollupMisaligned(req *models.Req, archive int, archInterval uint32) bool {
+	if archive == 0 || archInterval%req.RawInterval == 0 {
+		return false
+	}
+	log.Debugf("api: not using archive %d of %s: its interval %d is not a multiple of the raw interval %d", archive, req.MKey, archInterval, req.RawInterval)
+	return true
+}
+
+// CheckRollupIntervals warns once about every storage-schema that has rollups whose interval is not a multiple
+// of its raw interval. Queries never use such rollups for metrics sent at the raw interval (see rollupMisaligned).
+// Metrics sent at another interval than their schema's may still hit misaligned rollups, which is only
+// visible in the api.request.render.archive_misaligned metric.
+// It returns the misaligned rollup intervals by schema name.
+func CheckRollupIntervals() map[string][]uint32 {
+	schemas, defaultSchema := mdata.Schemas.List()
+	misaligned := make(map[string][]uint32)
+	for _, schema := range append(schemas, defaultSchema) {
+		rawInterval := uint32(schema.Retentions[0].SecondsPerPoint)
+		for _, ret := range schema.Retentions[1:] {
+			if interval := uint32(ret.SecondsPerPoint); interval%rawInterval != 0 {
+				misaligned[schema.Name] = append(misaligned[schema.Name], interval)
+			}
+		}
+		if len(misaligned[schema.Name]) > 0 {
+			log.Warnf("storage-schema %q: rollup intervals %v are not a multiple of the raw interval %d. these rollups will not be used", schema.Name, misaligned[schema.Name], rawInterval)
+		}
+	}
+	return misaligned
+}
+
+// getRetentions returns the retentions of the request's schema that can serve the request.
+// if the rollups don't store what is needed for the request's consolidator, we must fall back
+// to raw data, so only the raw retention is returned, and the reason is recorded in the request.
+// requests that ask for raw data only (see models.NewReqRaw) also only get the raw retention.
+func getRetentions(req *models.Req) conf.Retentions {
+	retentions := mdata.Schemas.Get(req.SchemaId).Retentions
+	if req.RawOnly {
+		return retentions[:1]
+	}
+	if len(retentions) == 1 || rollupsStore(req.AggId, req.Consolidator) {
+		return retentions
+	}
+	if req.Consolidator.IsPercentile() {
+		req.Fallback = "percentiles can't be computed from rollups"
+	} else if !req.Consolidator.CanUseRollups() {
+		req.Fallback = fmt.Sprintf("%s can't be computed from rollups", req.Consolidator)
+	} else {
+		req.Fallback = fmt.Sprintf("rollups don't store %s", req.Consolidator)
+	}
+	return retentions[:1]
+}
+
+// consolidateByConsolidators are the consolidators that queries can request via consolidateBy
+// and that rollups can serve, if they store the right aggregates.
+var consolidateByConsolidators = []consolidation.Consolidator{
+	consolidation.Avg, consolidation.Sum, consolidation.Cnt, consolidation.Lst, consolidation.Max, consolidation.Min,
+}
+
+// CheckAggregations warns about every storage-aggregation rule whose rollups don't store what is needed
+// to serve all consolidators that queries may request. Such requests fall back to raw data (see getRetentions),
+// which is slow and may not be retained long enough, so we rather surface this at startup.
+// The built-in default aggregation (avg only) is only logged at info level, as the operator didn't choose it.
+// It returns the unserved consolidators by rule name. If no storage-schema has rollups, there is nothing to check.
+func CheckAggregations() map[string][]consolidation.Consolidator {
+	schemas, defaultSchema := mdata.Schemas.List()
+	hasRollups := len(defaultSchema.Retentions) > 1
+	for _, schema := range schemas {
+		hasRollups = hasRollups || len(schema.Retentions) > 1
+	}
+	if !hasRollups {
+		return nil
+	}
+
+	missing := make(map[string][]consolidation.Consolidator)
+	for aggId := 0; aggId <= len(mdata.Aggregations.Data); aggId++ {
+		name := mdata.Aggregations.Get(uint16(aggId)).Name
+		for _, cons := range consolidateByConsolidators {
+			if !rollupsStore(uint16(aggId), cons) {
+				missing[name] = append(missing[name], cons)
+			}
+		}
+		if len(missing[name]) == 0 {
+			continue
+		}
+		if aggId == len(mdata.Aggregations.Data) {
+			log.Infof("default storage-aggregation: rollups can't serve consolidateBy %v. such requests will be served from raw data, unless a storage-aggregation rule matches", missing[name])
+		} else {
+			log.Warnf("storage-aggregation rule %q: rollups can't serve consolidateBy %v. such requests will be served from raw data", name, missing[name])
+		}
+	}
+	return missing
+}
+
+// rollupsStore returns whether the rollup archives for the given aggregation
+// store what is needed to serve the given consolidator. see mdata.NewAggregator
+func rollupsStore(aggId uint16, cons consolidation.Consolidator) bool {
+	if !cons.CanUseRollups() {
+		return false
+	}
+	stored := make(map[schema.Method]bool)
+	for _, method := range mdata.Aggregations.Get(aggId).AggregationMethod {
+		switch method {
+		case conf.Avg:
+			stored[schema.Sum], stored[schema.Cnt] = true, true
+		case conf.Sum:
+			stored[schema.Sum] = true
+		case conf.Lst:
+			stored[schema.Lst] = true
+		case conf.Max:
+			stored[schema.Max] = true
+		case conf.Min:
+			stored[schema.Min] = true
+		}
+	}
+	for _, method := range cons.RollupMethods() {
+		if !stored[method] {
+			return false
+		}
+	}
+	return true
+}
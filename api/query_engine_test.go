@@ -2,14 +2,19 @@ package api
 
 import (
 	"math"
+	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
 )
 
 // testAlign verifies the aligment of the given requests, given the retentions (one or more patterns, one or more retentions each)
@@ -414,6 +419,31 @@ func TestAlignRequestsHuh(t *testing.T) {
 	)
 }
 
+// 1 series with raw interval 10 requested. req 0-30. now 1200. the rollup of 25 would retain all data,
+// but 25 is not a multiple of 10, so we must use raw instead
+func TestAlignRequestsMisalignedRollup(t *testing.T) {
+	misaligned := reqRenderArchiveMisaligned.Peek()
+	testAlign([]models.Req{
+		reqRaw(test.GetMKey(1), 0, 30, 800, 10, consolidation.Avg, 0, 0),
+	},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(10, 800, 0, 0, 0),
+				conf.NewRetentionMT(25, 1200, 0, 0, 0),
+			},
+		},
+		[]models.Req{
+			reqOut(test.GetMKey(1), 0, 30, 800, 10, consolidation.Avg, 0, 0, 0, 10, 800, 10, 1),
+		},
+		nil,
+		1200,
+		t,
+	)
+	if reqRenderArchiveMisaligned.Peek() != misaligned+1 {
+		t.Errorf("expected the misaligned rollup to be counted")
+	}
+}
+
 func TestAlignRequestsDifferentReadyStates(t *testing.T) {
 	testAlign([]models.Req{
 		reqRaw(test.GetMKey(1), 100, 300, 800, 1, consolidation.Avg, 0, 0),
@@ -460,6 +490,152 @@ func testMaxPointsPerReq(maxPointsSoft, maxPointsHard int, reqs []models.Req, t
 	return out, err
 }
 
+func TestPlanRequests(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{{
+		Pattern: regexp.MustCompile(".*"),
+		Retentions: conf.Retentions([]conf.Retention{
+			conf.NewRetentionMT(10, 2*day, 600, 2, 0),
+			conf.NewRetentionMT(600, 30*day, 600, 2, 0),
+		}),
+	}})
+
+	reqs := []models.Req{
+		reqRaw(test.GetMKey(1), 30*day-day, 30*day, 800, 10, consolidation.Avg, 0, 0),
+	}
+	reqs, pointsFetch, pointsReturn, err := PlanRequests(30*day, 30*day-day, 30*day, reqs)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// a day of raw data is 8640 points, which is consolidated by 11 to fit in maxPoints
+	if reqs[0].Archive != 0 || reqs[0].ArchInterval != 10 || reqs[0].OutInterval != 10 || reqs[0].AggNum != 1 {
+		t.Fatalf("expected to read raw data at 10s, got %s", reqs[0].DebugString())
+	}
+	if pointsFetch != 8640 || pointsReturn != 786 {
+		t.Fatalf("expected 8640 points fetched and 786 returned, got %d and %d", pointsFetch, pointsReturn)
+	}
+}
+
+func TestSplitRequest(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{{
+		Pattern: regexp.MustCompile(".*"),
+		Retentions: conf.Retentions([]conf.Retention{
+			conf.NewRetentionMT(10, 2*day, 600, 2, 0),
+			conf.NewRetentionMT(600, 30*day, 600, 2, 0),
+		}),
+	}})
+	planned := func(from, to uint32) models.Req {
+		return reqOut(test.GetMKey(1), from, to, 800, 10, consolidation.Avg, 0, 0, 1, 600, 30*day, 600, 1)
+	}
+	type split struct {
+		from, to     uint32
+		archive      int
+		archInterval uint32
+		aggNum       uint32
+	}
+	cases := []struct {
+		name string
+		req  models.Req
+		exp  []split
+	}{
+		{
+			"unplanned",
+			reqRaw(test.GetMKey(1), 20*day, 30*day, 800, 10, consolidation.Avg, 0, 0),
+			[]split{{20 * day, 30 * day, -1, 0, 0}},
+		},
+		{
+			"within raw retention",
+			planned(29*day, 30*day),
+			[]split{{29 * day, 30 * day, 0, 10, 60}},
+		},
+		{
+			"spanning the raw retention boundary",
+			planned(20*day, 30*day),
+			[]split{{20 * day, 28*day + 1, 1, 600, 1}, {28*day + 1, 30 * day, 0, 10, 60}},
+		},
+		{
+			"older than the raw retention",
+			planned(20*day, 25*day),
+			[]split{{20 * day, 25 * day, 1, 600, 1}},
+		},
+	}
+	for _, c := range cases {
+		subs := SplitRequest(30*day, c.req)
+		if len(subs) != len(c.exp) {
+			t.Fatalf("case %q: expected %d sub-requests, got %d: %v", c.name, len(c.exp), len(subs), subs)
+		}
+		for i, sub := range subs {
+			got := split{sub.From, sub.To, sub.Archive, sub.ArchInterval, sub.AggNum}
+			if got != c.exp[i] || sub.OutInterval != c.req.OutInterval {
+				t.Fatalf("case %q: sub-request %d: expected %v, got %s", c.name, i, c.exp[i], sub.DebugString())
+			}
+		}
+	}
+}
+
+func TestCheckAggregations(t *testing.T) {
+	mdata.Aggregations = conf.Aggregations{
+		Data: []conf.Aggregation{
+			{Name: "all", Pattern: regexp.MustCompile("^all"), AggregationMethod: []conf.Method{conf.Avg, conf.Lst, conf.Max, conf.Min}},
+			{Name: "sum", Pattern: regexp.MustCompile("^sum"), AggregationMethod: []conf.Method{conf.Sum}},
+		},
+		DefaultAggregation: conf.NewAggregations().DefaultAggregation,
+	}
+	defer func() { mdata.Aggregations = conf.NewAggregations() }()
+
+	// without rollups, all requests are served from raw data anyway
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{{
+		Pattern:    regexp.MustCompile(".*"),
+		Retentions: conf.Retentions([]conf.Retention{conf.NewRetentionMT(10, 2*day, 600, 2, 0)}),
+	}})
+	if missing := CheckAggregations(); len(missing) != 0 {
+		t.Fatalf("expected nothing to be missing without rollups, got %v", missing)
+	}
+
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{{
+		Pattern: regexp.MustCompile(".*"),
+		Retentions: conf.Retentions([]conf.Retention{
+			conf.NewRetentionMT(10, 2*day, 600, 2, 0),
+			conf.NewRetentionMT(600, 30*day, 600, 2, 0),
+		}),
+	}})
+	exp := map[string][]consolidation.Consolidator{
+		"sum":     {consolidation.Avg, consolidation.Cnt, consolidation.Lst, consolidation.Max, consolidation.Min},
+		"default": {consolidation.Lst, consolidation.Max, consolidation.Min},
+	}
+	if missing := CheckAggregations(); !reflect.DeepEqual(missing, exp) {
+		t.Fatalf("expected missing consolidators %v, got %v", exp, missing)
+	}
+}
+
+func TestCheckRollupIntervals(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:    "aligned",
+			Pattern: regexp.MustCompile("^aligned"),
+			Retentions: conf.Retentions([]conf.Retention{
+				conf.NewRetentionMT(10, 2*day, 600, 2, 0),
+				conf.NewRetentionMT(600, 30*day, 600, 2, 0),
+			}),
+		},
+		{
+			Name:    "misaligned",
+			Pattern: regexp.MustCompile(".*"),
+			Retentions: conf.Retentions([]conf.Retention{
+				conf.NewRetentionMT(10, 2*day, 600, 2, 0),
+				conf.NewRetentionMT(25, 7*day, 600, 2, 0),
+				conf.NewRetentionMT(600, 30*day, 600, 2, 0),
+				conf.NewRetentionMT(3605, 365*day, 600, 2, 0),
+			}),
+		},
+	})
+	exp := map[string][]uint32{
+		"misaligned": {25, 3605},
+	}
+	if misaligned := CheckRollupIntervals(); !reflect.DeepEqual(misaligned, exp) {
+		t.Fatalf("expected misaligned rollup intervals %v, got %v", exp, misaligned)
+	}
+}
+
 func TestGettingOneNextBiggerAgg(t *testing.T) {
 	reqs := []models.Req{
 		reqOut(test.GetMKey(1), 29*day, 30*day, 30*day, 1, consolidation.Avg, 0, 0, 0, 1, hour, 1, 1),
@@ -492,6 +668,26 @@ func TestGettingTwoNextBiggerAgg(t *testing.T) {
 	}
 }
 
+// a raw only request must stay on the raw archive, even if the other request is bumped to the
+// lowest resolution rollup. It is runtime consolidated to the common interval instead.
+func TestAlignRequestsRawOnly(t *testing.T) {
+	reqs := []models.Req{
+		models.NewReqRaw(test.GetMKey(1), "", "", 29*day, 30*day, 800, 1, consolidation.Avg, 0, cluster.Manager.ThisNode(), 0, 0),
+		reqRaw(test.GetMKey(2), 29*day, 30*day, 800, 1, consolidation.Avg, 0, 0),
+	}
+
+	out, err := testMaxPointsPerReq(48, 0, reqs, t)
+	if err != nil {
+		t.Fatalf("expected to get no error, got %v", err)
+	}
+	if out[0].Archive != 0 || out[0].ArchInterval != 1 || out[0].OutInterval != hour || out[0].AggNum != hour {
+		t.Errorf("expected raw only request to read archive 0 and consolidate to 1h, got %s", out[0].DebugString())
+	}
+	if out[1].Archive != 2 || out[1].ArchInterval != hour || out[1].AggNum != 1 {
+		t.Errorf("expected regular request to read archive 2, got %s", out[1].DebugString())
+	}
+}
+
 func TestMaxPointsPerReqHardLimit(t *testing.T) {
 	reqs := []models.Req{
 		reqOut(test.GetMKey(1), 29*day, 30*day, 30*day, 1, consolidation.Avg, 0, 0, 0, 1, hour, 1, 1),
@@ -504,6 +700,66 @@ func TestMaxPointsPerReqHardLimit(t *testing.T) {
 	}
 }
 
+// a percentile must be computed from raw data, so the rollups that would satisfy the limit can't be used,
+// and the error must say so
+func TestMaxPointsPerReqHardLimitRawOnly(t *testing.T) {
+	reqs := []models.Req{
+		reqRaw(test.GetMKey(1), 29*day, 30*day, 800, 1, consolidation.P99, 0, 0),
+	}
+	_, err := testMaxPointsPerReq(22, 23, reqs, t)
+	if err == nil || err == errMaxPointsPerReq {
+		t.Fatalf("expected an error specific to raw-only data, got %v", err)
+	}
+	exp := "cannot satisfy max-points-per-req-hard limit for consolidator Percentile99Consolidator over range 24h0m0s with raw-only data (percentiles can't be computed from rollups)"
+	if !strings.HasPrefix(err.Error(), exp) {
+		t.Fatalf("expected error starting with %q, got %q", exp, err.Error())
+	}
+	if code := err.(response.Error).Code(); code != 413 {
+		t.Fatalf("expected code 413, got %d", code)
+	}
+}
+
+// the amount of points returned per series must never exceed maxPoints, even for awkward time ranges
+// and it must be an upper bound for what we actually end up returning after consolidation
+func TestAlignRequestsPointsReturnHonorsMaxPoints(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{{
+		Pattern: regexp.MustCompile(".*"),
+		Retentions: conf.Retentions([]conf.Retention{
+			conf.NewRetentionMT(10, 30*day, 600, 2, 0),
+		}),
+	}})
+	for _, from := range []uint32{10, 17, 23} {
+		for _, span := range []uint32{1, 9, 10, 11, 95, 1000, 3607, 86399} {
+			to := from + span
+			for _, maxPoints := range []uint32{0, 1, 2, 3, 7, 10, 99, 800} {
+				reqs := []models.Req{
+					reqRaw(test.GetMKey(1), from, to, maxPoints, 10, consolidation.Avg, 0, 0),
+					reqRaw(test.GetMKey(2), from, to, maxPoints, 10, consolidation.Avg, 0, 0),
+				}
+				_, _, pointsReturn, err := alignRequests(30*day, from, to, reqs)
+				if err != nil {
+					t.Fatalf("from %d to %d maxPoints %d: unexpected error %v", from, to, maxPoints, err)
+				}
+				pointsPerSerie := pointsReturn / uint32(len(reqs))
+				if maxPoints > 0 && pointsPerSerie > maxPoints {
+					t.Fatalf("from %d to %d maxPoints %d: expected at most %d points per series, got %d", from, to, maxPoints, maxPoints, pointsPerSerie)
+				}
+
+				var points []schema.Point
+				for ts := (from + 9) / 10 * 10; ts < to; ts += 10 {
+					points = append(points, schema.Point{Val: 1, Ts: ts})
+				}
+				if maxPoints > 0 && len(points) > int(maxPoints) {
+					points, _ = consolidation.ConsolidateStable(points, 10, maxPoints, consolidation.Avg)
+				}
+				if uint32(len(points)) > pointsPerSerie {
+					t.Fatalf("from %d to %d maxPoints %d: estimated %d points per series, but got %d", from, to, maxPoints, pointsPerSerie, len(points))
+				}
+			}
+		}
+	}
+}
+
 var result []models.Req
 
 func BenchmarkAlignRequests(b *testing.B) {
@@ -551,3 +807,189 @@ func BenchmarkAlignRequests(b *testing.B) {
 	}
 	result = res
 }
+
+func reqOutFallback(req models.Req, fallback string) models.Req {
+	req.Fallback = fallback
+	return req
+}
+
+// like TestAlignRequestsGoodRollup, but the rollups only store max, and we request min.
+// for the 2nd series we request max, which the rollup can provide
+func TestAlignRequestsConsolidatorNotStored(t *testing.T) {
+	defer func(aggs conf.Aggregations) { mdata.Aggregations = aggs }(mdata.Aggregations)
+	mdata.Aggregations = conf.Aggregations{
+		Data: []conf.Aggregation{
+			{
+				Name:              "maxonly",
+				Pattern:           regexp.MustCompile(".*"),
+				XFilesFactor:      0.5,
+				AggregationMethod: []conf.Method{conf.Max},
+			},
+		},
+		DefaultAggregation: conf.NewAggregations().DefaultAggregation,
+	}
+
+	testAlign([]models.Req{
+		reqRaw(test.GetMKey(1), 0, 30, 800, 60, consolidation.Min, 0, 0),
+		reqRaw(test.GetMKey(2), 0, 30, 800, 60, consolidation.Max, 0, 0),
+	},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(60, 1199, 0, 0, 0), // just not long enough
+				conf.NewRetentionMT(120, 1200, 600, 2, 0),
+			},
+		},
+		[]models.Req{
+			reqOutFallback(reqOut(test.GetMKey(1), 0, 30, 800, 60, consolidation.Min, 0, 0, 0, 60, 1199, 120, 2), "rollups don't store MinimumConsolidator"),
+			reqOut(test.GetMKey(2), 0, 30, 800, 60, consolidation.Max, 0, 0, 1, 120, 1200, 120, 1),
+		},
+		nil,
+		1200,
+		t,
+	)
+}
+
+// like TestAlignRequestsGoodRollup, but with a percentile consolidator we can't use the rollups
+// and must fall back to raw data, even though it doesn't cover the full range
+func TestAlignRequestsPercentileNoRollup(t *testing.T) {
+	testAlign([]models.Req{
+		reqRaw(test.GetMKey(1), 0, 30, 800, 10, consolidation.P99, 0, 0),
+		reqRaw(test.GetMKey(2), 0, 30, 800, 60, consolidation.P99, 2, 0),
+	},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(10, 1199, 0, 0, 0), // just not long enough
+				conf.NewRetentionMT(120, 1200, 600, 2, 0),
+			},
+			{
+				conf.NewRetentionMT(60, 1199, 0, 0, 0), // just not long enough
+				conf.NewRetentionMT(120, 1200, 600, 2, 0),
+			},
+		},
+		[]models.Req{
+			reqOutFallback(reqOut(test.GetMKey(1), 0, 30, 800, 10, consolidation.P99, 0, 0, 0, 10, 1199, 60, 6), "percentiles can't be computed from rollups"),
+			reqOutFallback(reqOut(test.GetMKey(2), 0, 30, 800, 60, consolidation.P99, 2, 0, 0, 60, 1199, 60, 1), "percentiles can't be computed from rollups"),
+		},
+		nil,
+		1200,
+		t,
+	)
+}
+
+// like TestAlignRequestsPercentileNoRollup, but for consolidators that can't be computed from rollups
+// for other reasons: the median doesn't compose across rollup buckets, and rollups don't store the first point
+func TestAlignRequestsNotComposableNoRollup(t *testing.T) {
+	testAlign([]models.Req{
+		reqRaw(test.GetMKey(1), 0, 30, 800, 60, consolidation.Med, 0, 0),
+		reqRaw(test.GetMKey(2), 0, 30, 800, 60, consolidation.Fst, 0, 0),
+	},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(60, 1199, 0, 0, 0), // just not long enough
+				conf.NewRetentionMT(120, 1200, 600, 2, 0),
+			},
+		},
+		[]models.Req{
+			reqOutFallback(reqOut(test.GetMKey(1), 0, 30, 800, 60, consolidation.Med, 0, 0, 0, 60, 1199, 60, 1), "MedianConsolidator can't be computed from rollups"),
+			reqOutFallback(reqOut(test.GetMKey(2), 0, 30, 800, 60, consolidation.Fst, 0, 0, 0, 60, 1199, 60, 1), "FirstConsolidator can't be computed from rollups"),
+		},
+		nil,
+		1200,
+		t,
+	)
+}
+
+func reqStep(key schema.MKey, from, to, step, rawInterval uint32, consolidator consolidation.Consolidator, schemaId, aggId uint16) models.Req {
+	return models.NewReqStep(key, "", "", from, to, step, rawInterval, consolidator, 0, cluster.Manager.ThisNode(), schemaId, aggId)
+}
+func reqStepOut(key schema.MKey, from, to, step, rawInterval uint32, consolidator consolidation.Consolidator, schemaId, aggId uint16, archive int, archInterval, ttl, aggNum uint32) models.Req {
+	req := reqStep(key, from, to, step, rawInterval, consolidator, schemaId, aggId)
+	req.Archive = archive
+	req.ArchInterval = archInterval
+	req.TTL = ttl
+	req.OutInterval = step
+	req.AggNum = aggNum
+	return req
+}
+
+// step of 120 requested. the 300s rollup can't provide it, so we runtime consolidate the 60s rollup
+func TestAlignRequestsStep(t *testing.T) {
+	testAlign([]models.Req{
+		reqStep(test.GetMKey(1), 0, 3600, 120, 10, consolidation.Avg, 0, 0),
+	},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(10, 3600, 0, 0, 0),
+				conf.NewRetentionMT(60, 7200, 600, 2, 0),
+				conf.NewRetentionMT(300, 7200, 600, 2, 0),
+			},
+		},
+		[]models.Req{
+			reqStepOut(test.GetMKey(1), 0, 3600, 120, 10, consolidation.Avg, 0, 0, 1, 60, 7200, 2),
+		},
+		nil,
+		3600,
+		t,
+	)
+}
+
+// once the output interval is known, the time range of each request is snapped to it as requested
+func TestAlignRequestsAlignRange(t *testing.T) {
+	testAlign([]models.Req{
+		reqStep(test.GetMKey(1), 50, 3590, 120, 10, consolidation.Avg, 0, 0),
+		reqStep(test.GetMKey(2), 50, 3590, 120, 10, consolidation.Avg, 0, 0).WithAlign(models.AlignForward),
+		reqStep(test.GetMKey(3), 50, 3590, 120, 10, consolidation.Avg, 0, 0).WithAlign(models.AlignBackward),
+	},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(10, 3600, 0, 0, 0),
+				conf.NewRetentionMT(60, 7200, 600, 2, 0),
+			},
+		},
+		[]models.Req{
+			reqStepOut(test.GetMKey(1), 50, 3590, 120, 10, consolidation.Avg, 0, 0, 1, 60, 7200, 2),
+			reqStepOut(test.GetMKey(2), 120, 3600, 120, 10, consolidation.Avg, 0, 0, 1, 60, 7200, 2).WithAlign(models.AlignForward),
+			reqStepOut(test.GetMKey(3), 0, 3480, 120, 10, consolidation.Avg, 0, 0, 1, 60, 7200, 2).WithAlign(models.AlignBackward),
+		},
+		nil,
+		3600,
+		t,
+	)
+}
+
+// a coarser archive which doesn't retain the data we need does not win from one that does
+func TestAlignRequestsStepPreferTTL(t *testing.T) {
+	testAlign([]models.Req{
+		reqStep(test.GetMKey(1), 0, 3600, 600, 10, consolidation.Avg, 0, 0),
+	},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(10, 3600, 0, 0, 0),
+				conf.NewRetentionMT(60, 3599, 600, 2, 0), // just not long enough
+			},
+		},
+		[]models.Req{
+			reqStepOut(test.GetMKey(1), 0, 3600, 600, 10, consolidation.Avg, 0, 0, 0, 10, 3600, 60),
+		},
+		nil,
+		3600,
+		t,
+	)
+}
+
+// we never upsample: a step of 30 can't be served from 60s data
+func TestAlignRequestsStepNoUpsampling(t *testing.T) {
+	testAlign([]models.Req{
+		reqStep(test.GetMKey(1), 0, 3600, 30, 60, consolidation.Avg, 0, 0),
+	},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(60, 3600, 0, 0, 0),
+			},
+		},
+		nil,
+		errStepUnSatisfiable,
+		3600,
+		t,
+	)
+}
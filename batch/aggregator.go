@@ -39,6 +39,15 @@ func Cnt(in []schema.Point) float64 {
 	return valid
 }
 
+func Fst(in []schema.Point) float64 {
+	for _, v := range in {
+		if !math.IsNaN(v.Val) {
+			return v.Val
+		}
+	}
+	return math.NaN()
+}
+
 func Lst(in []schema.Point) float64 {
 	lst := math.NaN()
 	for _, v := range in {
@@ -188,3 +197,25 @@ func Sum(in []schema.Point) float64 {
 	}
 	return sum
 }
+
+// Percentile returns an AggFunc that computes the nth percentile (0 < n <= 100)
+// of the non-NaN values, using the nearest-rank method.
+func Percentile(n float64) AggFunc {
+	return func(in []schema.Point) float64 {
+		vals := make([]float64, 0, len(in))
+		for _, v := range in {
+			if !math.IsNaN(v.Val) {
+				vals = append(vals, v.Val)
+			}
+		}
+		if len(vals) == 0 {
+			return math.NaN()
+		}
+		sort.Float64s(vals)
+		rank := int(math.Ceil(n / 100 * float64(len(vals))))
+		if rank < 1 {
+			rank = 1
+		}
+		return vals[rank-1]
+	}
+}
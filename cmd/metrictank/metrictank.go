@@ -182,6 +182,8 @@ func main() {
 	notifierKafka.ConfigProcess(*instance)
 	statsConfig.ConfigProcess(*instance)
 	mdata.ConfigProcess()
+	api.CheckAggregations()
+	api.CheckRollupIntervals()
 	memory.ConfigProcess()
 	cassandra.ConfigProcess()
 	bigtable.ConfigProcess()
@@ -334,7 +336,7 @@ func main() {
 		if metricIndex != nil {
 			log.Fatal("Only 1 metricIndex handler can be enabled.")
 		}
-		metricIndex = memory.New()
+		metricIndex = memory.NewIndex()
 	}
 	if cassandra.CliConfig.Enabled {
 		if metricIndex != nil {
@@ -2,6 +2,7 @@ package consolidation
 
 import (
 	"context"
+	"math"
 
 	"github.com/raintank/schema"
 )
@@ -64,6 +65,28 @@ func Consolidate(in []schema.Point, aggNum uint32, consolidator Consolidator) []
 	return out
 }
 
+// AlignStart prepares the points, which must be quantized to interval, for consolidation by aggNum,
+// such that the groups Consolidate forms are aligned to multiples of the output interval (interval*aggNum),
+// rather than to the first point. This way, requests with different start times consolidate the same points together.
+// It does so by prepending nulls up to the start of the first group, so the first group may be based on fewer points.
+// (unlike ConsolidateStable, which strips them)
+func AlignStart(in []schema.Point, interval, aggNum uint32) []schema.Point {
+	if len(in) == 0 || aggNum <= 1 {
+		return in
+	}
+	postAggInterval := interval * aggNum
+	// a group consists of the points after a multiple of postAggInterval, up to and including the next one.
+	num := ((in[0].Ts - interval) % postAggInterval) / interval
+	if num == 0 {
+		return in
+	}
+	out := make([]schema.Point, 0, int(num)+len(in))
+	for ts := in[0].Ts - num*interval; ts < in[0].Ts; ts += interval {
+		out = append(out, schema.Point{Val: math.NaN(), Ts: ts})
+	}
+	return append(out, in...)
+}
+
 // returns how many points should be aggregated together so that you end up with as many points as possible,
 // but never more than maxPoints
 func AggEvery(numPoints, maxPoints uint32) uint32 {
@@ -73,6 +96,17 @@ func AggEvery(numPoints, maxPoints uint32) uint32 {
 	return (numPoints + maxPoints - 1) / maxPoints
 }
 
+// OutPoints returns how many points you end up with when consolidating numPoints points
+// such that there are no more than maxPoints (a maxPoints of 0 means no limit)
+// the result is never more than maxPoints, because AggEvery rounds up.
+func OutPoints(numPoints, maxPoints uint32) uint32 {
+	if maxPoints == 0 || numPoints <= maxPoints {
+		return numPoints
+	}
+	aggNum := AggEvery(numPoints, maxPoints)
+	return (numPoints + aggNum - 1) / aggNum
+}
+
 // ConsolidateStable consolidates points in a "stable" way, meaning if you run the same function again so that the input
 // receives new points at the end and old points get removed at the beginning, we keep picking the same points to consolidate together
 // interval is the interval between the input points
@@ -1,6 +1,7 @@
 package consolidation
 
 import (
+	"math"
 	"testing"
 
 	"github.com/grafana/metrictank/test"
@@ -391,6 +392,41 @@ func TestAggEvery(t *testing.T) {
 	}
 }
 
+func TestOutPoints(t *testing.T) {
+	for numPoints := uint32(1); numPoints <= 300; numPoints++ {
+		in := make([]schema.Point, numPoints)
+		for i := range in {
+			in[i] = schema.Point{Val: float64(i), Ts: uint32(i+1) * 10}
+		}
+		for maxPoints := uint32(1); maxPoints <= 50; maxPoints++ {
+			exp := OutPoints(numPoints, maxPoints)
+			if exp > maxPoints {
+				t.Fatalf("OutPoints(%d, %d) = %d, more than maxPoints", numPoints, maxPoints, exp)
+			}
+			if numPoints <= maxPoints {
+				if exp != numPoints {
+					t.Fatalf("OutPoints(%d, %d) = %d, expected %d", numPoints, maxPoints, exp, numPoints)
+				}
+				continue
+			}
+			buf := make([]schema.Point, numPoints)
+			copy(buf, in)
+			out := Consolidate(buf, AggEvery(numPoints, maxPoints), Avg)
+			if uint32(len(out)) != exp {
+				t.Fatalf("OutPoints(%d, %d) = %d, but consolidation returned %d points", numPoints, maxPoints, exp, len(out))
+			}
+			copy(buf, in)
+			out, _ = ConsolidateStable(buf, 10, maxPoints, Avg)
+			if uint32(len(out)) > maxPoints {
+				t.Fatalf("ConsolidateStable of %d points with maxPoints %d returned %d points", numPoints, maxPoints, len(out))
+			}
+		}
+	}
+	if OutPoints(1000, 0) != 1000 {
+		t.Fatalf("OutPoints with maxPoints 0 should not limit the amount of points")
+	}
+}
+
 // each "operation" is a consolidation of 1M+1 points
 func BenchmarkConsolidateAvgRand1M_1(b *testing.B) {
 	benchmarkConsolidate(test.RandFloats1M, 1, Avg, b)
@@ -506,3 +542,78 @@ func benchmarkConsolidate(fn func() []schema.Point, aggNum uint32, consolidator
 	}
 	b.SetBytes(int64(l * 12))
 }
+
+func TestConsolidationPercentiles(t *testing.T) {
+	in := func() []schema.Point {
+		var out []schema.Point
+		for i := 1; i <= 20; i++ {
+			out = append(out, schema.Point{Val: float64(i), Ts: uint32(i * 10)})
+		}
+		out[3].Val = math.NaN()
+		return out
+	}
+	cases := []testCase{
+		{in(), P90, 10, []schema.Point{{Val: 10, Ts: 100}, {Val: 19, Ts: 200}}},
+		{in(), P95, 10, []schema.Point{{Val: 10, Ts: 100}, {Val: 20, Ts: 200}}},
+		{in(), P99, 20, []schema.Point{{Val: 20, Ts: 200}}},
+	}
+	validate(cases, t)
+}
+
+func TestConsolidationFirstLastNulls(t *testing.T) {
+	nan := math.NaN()
+	in := func() []schema.Point {
+		return []schema.Point{
+			{Val: nan, Ts: 10}, {Val: 2, Ts: 20}, {Val: 3, Ts: 30}, {Val: nan, Ts: 40},
+			{Val: nan, Ts: 50}, {Val: nan, Ts: 60}, {Val: nan, Ts: 70}, {Val: nan, Ts: 80},
+			{Val: 9, Ts: 90}, {Val: nan, Ts: 100},
+		}
+	}
+	cases := []struct {
+		consol Consolidator
+		out    []schema.Point
+	}{
+		{Fst, []schema.Point{{Val: 2, Ts: 40}, {Val: nan, Ts: 80}, {Val: 9, Ts: 120}}},
+		{Lst, []schema.Point{{Val: 3, Ts: 40}, {Val: nan, Ts: 80}, {Val: 9, Ts: 120}}},
+	}
+	for _, c := range cases {
+		out := Consolidate(in(), 4, c.consol)
+		if len(out) != len(c.out) {
+			t.Fatalf("%s: expected %v, got %v", c.consol, c.out, out)
+		}
+		for i, p := range out {
+			exp := c.out[i]
+			if p.Ts != exp.Ts || math.IsNaN(p.Val) != math.IsNaN(exp.Val) || (!math.IsNaN(exp.Val) && p.Val != exp.Val) {
+				t.Fatalf("%s: point %d: expected %v, got %v", c.consol, i, exp, p)
+			}
+		}
+	}
+}
+
+func TestAlignStart(t *testing.T) {
+	// points 10, 20, ... 200 with value ts/10, consolidated by 3 (output interval 30).
+	// whichever point we start at, the buckets must end at multiples of 30 and contain the same points.
+	points := func(from uint32) []schema.Point {
+		var out []schema.Point
+		for ts := from; ts <= 200; ts += 10 {
+			out = append(out, schema.Point{Val: float64(ts / 10), Ts: ts})
+		}
+		return out
+	}
+	full := Consolidate(AlignStart(points(10), 10, 3), 3, Sum)
+	for _, from := range []uint32{10, 20, 30, 40, 50} {
+		out := Consolidate(AlignStart(points(from), 10, 3), 3, Sum)
+		for _, p := range out {
+			if p.Ts%30 != 0 {
+				t.Fatalf("from %d: expected bucket timestamps to be multiples of 30, got %v", from, out)
+			}
+		}
+		// the first bucket may be partial. all following ones must match the ones of the full range
+		for i, p := range out[1:] {
+			exp := full[len(full)-len(out)+1+i]
+			if p != exp {
+				t.Fatalf("from %d: expected bucket %v, got %v", from, exp, p)
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ package consolidation
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/raintank/schema"
 
@@ -30,6 +31,10 @@ const (
 	Diff
 	StdDev
 	Range
+	P90 // percentiles can only be computed from raw data, see IsPercentile
+	P95
+	P99
+	Fst // not stored by rollups, so always computed from raw data
 )
 
 // String provides human friendly names
@@ -41,6 +46,8 @@ func (c Consolidator) String() string {
 		return "AverageConsolidator"
 	case Cnt:
 		return "CountConsolidator"
+	case Fst:
+		return "FirstConsolidator"
 	case Lst:
 		return "LastConsolidator"
 	case Min:
@@ -59,10 +66,42 @@ func (c Consolidator) String() string {
 		return "RangeConsolidator"
 	case Sum:
 		return "SumConsolidator"
+	case P90:
+		return "Percentile90Consolidator"
+	case P95:
+		return "Percentile95Consolidator"
+	case P99:
+		return "Percentile99Consolidator"
 	}
 	panic(fmt.Sprintf("Consolidator.String(): unknown consolidator %d", c))
 }
 
+// IsPercentile returns whether the consolidator computes a percentile.
+// percentiles are not composable, so they can't be derived from rollup archives
+// and must always be computed over raw data.
+func (c Consolidator) IsPercentile() bool {
+	return c == P90 || c == P95 || c == P99
+}
+
+// RollupMethods returns the rollup archives from which the consolidator can be computed,
+// or nil if it can only be computed from raw data, because it doesn't compose across
+// rollup buckets (e.g. percentiles and median) or rollups don't store what it needs (e.g. first).
+// new consolidators that can be computed from rollups must declare here what they need.
+func (c Consolidator) RollupMethods() []schema.Method {
+	switch c {
+	case Avg:
+		return []schema.Method{schema.Sum, schema.Cnt}
+	case Sum, Cnt, Lst, Max, Min:
+		return []schema.Method{c.Archive()}
+	}
+	return nil
+}
+
+// CanUseRollups returns whether the consolidator can be computed from rollup archives at all, see RollupMethods
+func (c Consolidator) CanUseRollups() bool {
+	return c.RollupMethods() != nil
+}
+
 // provide the name of a stored archive
 // see aggregator.go for which archives are available
 func (c Consolidator) Archive() schema.Method {
@@ -101,12 +140,16 @@ func FromArchive(archive schema.Method) Consolidator {
 	return None
 }
 
+// FromConsolidateBy returns the consolidator for the given consolidation function name
+// (e.g. the argument of consolidateBy()), case-insensitively. It returns None for unknown names.
 func FromConsolidateBy(c string) Consolidator {
-	switch c {
+	switch strings.ToLower(c) {
 	case "avg", "average":
 		return Avg
 	case "count":
 		return Cnt
+	case "fst", "first":
+		return Fst
 	case "lst", "last", "current":
 		return Lst
 	case "min":
@@ -121,14 +164,36 @@ func FromConsolidateBy(c string) Consolidator {
 		return Diff
 	case "stddev":
 		return StdDev
-	case "range", "rangeOf":
+	case "range", "rangeof":
 		return Range
 	case "sum", "total":
 		return Sum
+	case "p90":
+		return P90
+	case "p95":
+		return P95
+	case "p99":
+		return P99
 	}
 	return None
 }
 
+// FromString parses a consolidation function name, case-insensitively.
+// Besides the names accepted by FromConsolidateBy, it accepts the output of Consolidator.String(),
+// so that FromString(c.String()) returns c, for every consolidator but None, which is not a consolidation function.
+func FromString(s string) (Consolidator, error) {
+	if c := FromConsolidateBy(s); c != None {
+		return c, nil
+	}
+	// Fst is the last consolidator
+	for c := None + 1; c <= Fst; c++ {
+		if strings.EqualFold(s, c.String()) {
+			return c, nil
+		}
+	}
+	return None, fmt.Errorf("%s: %q", errUnknownConsolidationFunction, s)
+}
+
 // map the consolidation to the respective aggregation function, if applicable.
 func GetAggFunc(consolidator Consolidator) batch.AggFunc {
 	var consFunc batch.AggFunc
@@ -137,6 +202,8 @@ func GetAggFunc(consolidator Consolidator) batch.AggFunc {
 		consFunc = batch.Avg
 	case Cnt:
 		consFunc = batch.Cnt
+	case Fst:
+		consFunc = batch.Fst
 	case Lst:
 		consFunc = batch.Lst
 	case Min:
@@ -155,13 +222,22 @@ func GetAggFunc(consolidator Consolidator) batch.AggFunc {
 		consFunc = batch.Range
 	case Sum:
 		consFunc = batch.Sum
+	case P90:
+		consFunc = batch.Percentile(90)
+	case P95:
+		consFunc = batch.Percentile(95)
+	case P99:
+		consFunc = batch.Percentile(99)
 	}
 	return consFunc
 }
 
+// Validate checks whether fn is a consolidation function name that render functions accept.
+// Unlike FromConsolidateBy, it is case-sensitive, like graphite.
 func Validate(fn string) error {
 	if fn == "avg" || fn == "average" ||
 		fn == "count" ||
+		fn == "first" ||
 		fn == "last" || fn == "current" ||
 		fn == "min" ||
 		fn == "max" ||
@@ -170,7 +246,8 @@ func Validate(fn string) error {
 		fn == "diff" ||
 		fn == "stddev" ||
 		fn == "range" || fn == "rangeOf" ||
-		fn == "sum" || fn == "total" {
+		fn == "sum" || fn == "total" ||
+		fn == "p90" || fn == "p95" || fn == "p99" {
 		return nil
 	}
 	return errUnknownConsolidationFunction
@@ -0,0 +1,86 @@
+package consolidation
+
+import (
+	"testing"
+)
+
+func TestFromString(t *testing.T) {
+	cases := []struct {
+		in  string
+		exp Consolidator
+	}{
+		{"avg", Avg},
+		{"average", Avg},
+		{"AVERAGE", Avg},
+		{"count", Cnt},
+		{"first", Fst},
+		{"last", Lst},
+		{"current", Lst},
+		{"min", Min},
+		{"Max", Max},
+		{"sum", Sum},
+		{"total", Sum},
+		{"multiply", Mult},
+		{"median", Med},
+		{"diff", Diff},
+		{"stddev", StdDev},
+		{"rangeOf", Range},
+		{"range", Range},
+		{"P99", P99},
+	}
+	for _, c := range cases {
+		got, err := FromString(c.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", c.in, err)
+			continue
+		}
+		if got != c.exp {
+			t.Errorf("%q: expected %s, got %s", c.in, c.exp, got)
+		}
+	}
+
+	for _, in := range []string{"", "foo", "averages", "NoneConsolidator", "noneconsolidator"} {
+		if _, err := FromString(in); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestFromStringInverseOfString(t *testing.T) {
+	for c := None + 1; c <= Fst; c++ {
+		got, err := FromString(c.String())
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c, err)
+			continue
+		}
+		if got != c {
+			t.Errorf("%s: expected FromString to return it, got %s", c, got)
+		}
+	}
+}
+
+// Validate sticks to graphite's names, case-sensitively, even though FromConsolidateBy is more lenient
+func TestValidate(t *testing.T) {
+	for _, fn := range []string{"avg", "average", "count", "first", "last", "current", "min", "max", "mult", "multiply", "med", "median", "diff", "stddev", "range", "rangeOf", "sum", "total", "p90", "p95", "p99"} {
+		if err := Validate(fn); err != nil {
+			t.Errorf("%q: unexpected error %s", fn, err)
+		}
+	}
+	for _, fn := range []string{"", "foo", "AVG", "Sum", "rangeof", "lst", "fst", "NoneConsolidator", "AverageConsolidator"} {
+		if err := Validate(fn); err == nil {
+			t.Errorf("%q: expected an error", fn)
+		}
+	}
+}
+
+func TestRollupMethods(t *testing.T) {
+	for c := Avg; c <= Fst; c++ {
+		composable := c == Avg || c == Sum || c == Cnt || c == Lst || c == Max || c == Min
+		if c.CanUseRollups() != composable {
+			t.Errorf("%s: expected CanUseRollups %t", c, composable)
+		}
+	}
+	if methods := Avg.RollupMethods(); len(methods) != 2 {
+		t.Errorf("expected avg to need the sum and cnt rollups, got %v", methods)
+	}
+}
@@ -29,3 +29,17 @@ func (b BadRequest) Code() int {
 func (b BadRequest) Error() string {
 	return string(b)
 }
+
+type NotFound string
+
+func NewNotFound(err string) NotFound {
+	return NotFound(err)
+}
+
+func (n NotFound) Code() int {
+	return http.StatusNotFound
+}
+
+func (n NotFound) Error() string {
+	return string(n)
+}
@@ -3,6 +3,7 @@ package bigtable
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 	"github.com/grafana/metrictank/idx"
 	"github.com/grafana/metrictank/idx/memory"
 	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/util"
 	"github.com/raintank/schema"
 	log "github.com/sirupsen/logrus"
 )
@@ -46,6 +48,20 @@ var (
 	statSaveSkipped = stats.NewCounter32("idx.bigtable.save.skipped")
 	// metric idx.bigtable.save.bytes-per-request is the number of bytes written to bigtable in each request.
 	statSaveBytesPerRequest = stats.NewMeter32("idx.bigtable.save.bytes-per-request", true)
+	// metric idx.bigtable.load-retries is how many times loading a partition of the index from bigtable failed and was restarted
+	statLoadRetries = stats.NewCounter32("idx.bigtable.load-retries")
+
+	// how many times loading a partition of the index is attempted before giving up,
+	// and how long to wait after the first failed attempt. this doubles after every attempt.
+	loadAttempts = 5
+	loadBackoff  = time.Second
+
+	// the prune interval is randomly adjusted by up to this fraction, every time
+	pruneJitter = 0.1
+
+	// how many times a bulk write of defs that fails as a whole is attempted before dropping it.
+	// (individual rows that fail are retried until they succeed)
+	maxWriteAttempts = 10
 )
 
 type writeReq struct {
@@ -53,14 +69,18 @@ type writeReq struct {
 	recvTime time.Time
 }
 
+// BigtableIdx embeds the MemoryIndex interface rather than a MemoryIdx, so that it can use either in-memory index
+// (see memory.NewIndex). Code that used the MemoryIdx field must use the MemoryIndex field instead.
 type BigtableIdx struct {
-	memory.MemoryIdx
+	memory.MemoryIndex
 	cfg        *IdxConfig
 	tbl        *bigtable.Table
 	client     *bigtable.Client
 	writeQueue chan writeReq
-	shutdown   chan struct{}
-	wg         sync.WaitGroup
+	// held for reading while sending to writeQueue, and for writing while closing it
+	writeQueueLock sync.RWMutex
+	shutdown       chan struct{}
+	wg             sync.WaitGroup
 }
 
 func New(cfg *IdxConfig) *BigtableIdx {
@@ -70,9 +90,9 @@ func New(cfg *IdxConfig) *BigtableIdx {
 		log.Fatalf("bigtable-idx: %s", err)
 	}
 	idx := &BigtableIdx{
-		MemoryIdx: *memory.New(),
-		cfg:       cfg,
-		shutdown:  make(chan struct{}),
+		MemoryIndex: memory.NewIndex(),
+		cfg:         cfg,
+		shutdown:    make(chan struct{}),
 	}
 	if cfg.UpdateBigtableIdx {
 		idx.writeQueue = make(chan writeReq, cfg.WriteQueueSize-cfg.WriteMaxFlushSize)
@@ -165,7 +185,7 @@ func (b *BigtableIdx) InitBare() error {
 // rebuilds the in-memory index, sets up write queues, metrics and pruning routines
 func (b *BigtableIdx) Init() error {
 	log.Infof("bigtable-idx: Initializing. Project=%s, Instance=%s", b.cfg.GcpProject, b.cfg.BigtableInstance)
-	if err := b.MemoryIdx.Init(); err != nil {
+	if err := b.MemoryIndex.Init(); err != nil {
 		return err
 	}
 
@@ -181,7 +201,9 @@ func (b *BigtableIdx) Init() error {
 		log.Infof("bigtable-idx: started %d writeQueue handlers", b.cfg.WriteConcurrency)
 	}
 
-	b.rebuildIndex()
+	if err := b.rebuildIndex(); err != nil {
+		return err
+	}
 	if memory.IndexRules.Prunable() {
 		b.wg.Add(1)
 		go b.prune()
@@ -190,10 +212,13 @@ func (b *BigtableIdx) Init() error {
 }
 
 func (b *BigtableIdx) Stop() {
-	b.MemoryIdx.Stop()
+	b.MemoryIndex.Stop()
 	close(b.shutdown)
 	if b.cfg.UpdateBigtableIdx {
+		// wait for the enqueues in progress. later ones see the shutdown and give up
+		b.writeQueueLock.Lock()
 		close(b.writeQueue)
+		b.writeQueueLock.Unlock()
 	}
 	b.wg.Wait()
 
@@ -208,7 +233,7 @@ func (b *BigtableIdx) Stop() {
 func (b *BigtableIdx) Update(point schema.MetricPoint, partition int32) (idx.Archive, int32, bool) {
 	pre := time.Now()
 
-	archive, oldPartition, inMemory := b.MemoryIdx.Update(point, partition)
+	archive, oldPartition, inMemory := b.MemoryIndex.Update(point, partition)
 
 	if !b.cfg.UpdateBigtableIdx {
 		statUpdateDuration.Value(time.Since(pre))
@@ -241,7 +266,7 @@ func (b *BigtableIdx) Update(point schema.MetricPoint, partition int32) (idx.Arc
 func (b *BigtableIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, partition int32) (idx.Archive, int32, bool) {
 	pre := time.Now()
 
-	archive, oldPartition, inMemory := b.MemoryIdx.AddOrUpdate(mkey, data, partition)
+	archive, oldPartition, inMemory := b.MemoryIndex.AddOrUpdate(mkey, data, partition)
 
 	stat := statUpdateDuration
 	if !inMemory {
@@ -277,6 +302,34 @@ func (b *BigtableIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, par
 	return archive, oldPartition, inMemory
 }
 
+// AddOrUpdateMany is the batch equivalent of AddOrUpdate.
+// see memory.MemoryIdx.AddOrUpdateMany
+func (b *BigtableIdx) AddOrUpdateMany(mkeys []schema.MKey, data []*schema.MetricData, partition int32) []memory.AddOrUpdateResult {
+	results := b.MemoryIndex.AddOrUpdateMany(mkeys, data, partition)
+
+	if !b.cfg.UpdateBigtableIdx {
+		return results
+	}
+
+	now := uint32(time.Now().Unix())
+	for i := range results {
+		res := &results[i]
+		// see AddOrUpdate for why we need to delete the old entry
+		if res.InMemory && res.OldPartition != partition {
+			go func(key schema.MKey, oldPartition int32) {
+				err := b.deleteRow(FormatRowKey(key, oldPartition))
+				if err != nil {
+					log.Errorf("bigtable-idx: Failed to delete row %s: %s", key, err)
+				}
+			}(res.Archive.Id, res.OldPartition)
+		}
+		if res.Archive.LastSave < (now - b.cfg.updateInterval32) {
+			res.Archive = b.updateBigtable(now, res.InMemory, res.Archive, partition)
+		}
+	}
+	return results
+}
+
 // updateBigtable saves the archive to bigtable and
 // updates the memory index with the updated fields.
 func (b *BigtableIdx) updateBigtable(now uint32, inMemory bool, archive idx.Archive, partition int32) idx.Archive {
@@ -284,9 +337,11 @@ func (b *BigtableIdx) updateBigtable(now uint32, inMemory bool, archive idx.Arch
 	// then perform a blocking save.
 	if archive.LastSave < (now - b.cfg.updateInterval32 - (b.cfg.updateInterval32 / 2)) {
 		log.Debugf("bigtable-idx: updating def %s in index.", archive.MetricDefinition.Id)
-		b.writeQueue <- writeReq{recvTime: time.Now(), def: &archive.MetricDefinition}
+		if !b.enqueue(&archive.MetricDefinition, true) {
+			return archive
+		}
 		archive.LastSave = now
-		b.MemoryIdx.UpdateArchive(archive)
+		b.MemoryIndex.UpdateArchive(archive)
 	} else {
 		// perform a non-blocking write to the writeQueue. If the queue is full, then
 		// this will fail and we won't update the LastSave timestamp. The next time
@@ -294,11 +349,10 @@ func (b *BigtableIdx) updateBigtable(now uint32, inMemory bool, archive idx.Arch
 		// we will try and save again.  This will continue until we are successful or the
 		// lastSave timestamp become more then 1.5 x UpdateInterval, in which case we will
 		// do a blocking write to the queue.
-		select {
-		case b.writeQueue <- writeReq{recvTime: time.Now(), def: &archive.MetricDefinition}:
+		if b.enqueue(&archive.MetricDefinition, false) {
 			archive.LastSave = now
-			b.MemoryIdx.UpdateArchive(archive)
-		default:
+			b.MemoryIndex.UpdateArchive(archive)
+		} else {
 			statSaveSkipped.Inc()
 			log.Debugf("bigtable-idx: writeQueue is full, update of %s not saved this time", archive.MetricDefinition.Id)
 		}
@@ -307,21 +361,82 @@ func (b *BigtableIdx) updateBigtable(now uint32, inMemory bool, archive idx.Arch
 	return archive
 }
 
-func (b *BigtableIdx) rebuildIndex() {
+// enqueue queues the def to be saved. If block is set, it waits for room in the writeQueue,
+// otherwise it gives up when the queue is full. It returns whether the def was queued.
+// Once Stop is called, defs are never queued, as the writeQueue gets closed.
+func (b *BigtableIdx) enqueue(def *schema.MetricDefinition, block bool) bool {
+	b.writeQueueLock.RLock()
+	defer b.writeQueueLock.RUnlock()
+	select {
+	case <-b.shutdown:
+		log.Debugf("bigtable-idx: index is stopping, def %s not saved", def.Id)
+		return false
+	default:
+	}
+	req := writeReq{recvTime: time.Now(), def: def}
+	if !block {
+		select {
+		case b.writeQueue <- req:
+			return true
+		default:
+			return false
+		}
+	}
+	b.writeQueue <- req
+	return true
+}
+
+func (b *BigtableIdx) rebuildIndex() error {
 	log.Info("bigtable-idx: Rebuilding Memory Index from metricDefinitions in bigtable")
 	pre := time.Now()
 
 	num := 0
 	var defs []schema.MetricDefinition
+	var err error
 	for _, partition := range cluster.Manager.GetPartitions() {
-		defs = b.LoadPartition(partition, defs[:0], pre)
-		num += b.MemoryIdx.Load(defs)
+		defs, err = retryLoad(partition, func() ([]schema.MetricDefinition, error) {
+			return b.loadPartition(partition, defs[:0], pre)
+		})
+		if err != nil {
+			return err
+		}
+		num += b.MemoryIndex.Load(defs)
 	}
 
 	log.Infof("bigtable-idx: Rebuilding Memory Index Complete. Imported %d. Took %s", num, time.Since(pre))
+	return nil
+}
+
+// retryLoad calls load until it succeeds, at most loadAttempts times, backing off exponentially in between.
+// every attempt starts loading the partition over, so we never return partial results.
+func retryLoad(partition int32, load func() ([]schema.MetricDefinition, error)) ([]schema.MetricDefinition, error) {
+	backoff := loadBackoff
+	for attempt := 1; ; attempt++ {
+		defs, err := load()
+		if err == nil {
+			return defs, nil
+		}
+		if attempt >= loadAttempts {
+			return nil, fmt.Errorf("bigtable-idx: failed to load partition %d after %d attempts: %s", partition, attempt, err)
+		}
+		statLoadRetries.Inc()
+		log.Warnf("bigtable-idx: failed to load partition %d: %s. restarting in %s. attempt: %d", partition, err, backoff, attempt)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
 func (b *BigtableIdx) LoadPartition(partition int32, defs []schema.MetricDefinition, now time.Time) []schema.MetricDefinition {
+	defs, err := b.loadPartition(partition, defs, now)
+	if err != nil {
+		log.Fatalf("bigtable-idx: %s", err)
+	}
+	return defs
+}
+
+// loadPartition reads all defs of the partition and appends the non-stale ones to defs.
+// on failure, defs is returned as it was passed in, along with the error.
+func (b *BigtableIdx) loadPartition(partition int32, defs []schema.MetricDefinition, now time.Time) ([]schema.MetricDefinition, error) {
 	ctx := context.Background()
 	rr := bigtable.PrefixRange(fmt.Sprintf("%d_", partition))
 	defsByNames := make(map[string][]schema.MetricDefinition)
@@ -329,6 +444,12 @@ func (b *BigtableIdx) LoadPartition(partition int32, defs []schema.MetricDefinit
 	err := b.tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
 		def := schema.MetricDefinition{}
 		marshalErr = RowToSchema(r, &def)
+		if _, ok := marshalErr.(invalidOrgIdError); ok {
+			// like the cassandra index, skip the row rather than failing the load of the whole partition
+			log.Errorf("bigtable-idx: loadPartition() found %s for row %q -> skipping", marshalErr, r.Key())
+			marshalErr = nil
+			return true
+		}
 		if marshalErr != nil {
 			return false
 		}
@@ -338,10 +459,10 @@ func (b *BigtableIdx) LoadPartition(partition int32, defs []schema.MetricDefinit
 		return true
 	}, bigtable.RowFilter(bigtable.FamilyFilter(COLUMN_FAMILY)))
 	if err != nil {
-		log.Fatalf("bigtable-idx: failed to load defs from Bigtable. %s", err)
+		return defs, fmt.Errorf("failed to load defs from Bigtable. %s", err)
 	}
 	if marshalErr != nil {
-		log.Fatalf("bigtable-idx: failed to marshal row to metricDef. %s", marshalErr)
+		return defs, fmt.Errorf("failed to marshal row to metricDef. %s", marshalErr)
 	}
 
 	// getting all cutoffs once saves having to recompute everytime we have a match
@@ -363,11 +484,11 @@ NAMES:
 		delete(defsByNames, nameWithTags)
 	}
 
-	return defs
+	return defs, nil
 }
 
 func (b *BigtableIdx) processWriteQueue() {
-	timer := time.NewTimer(time.Second)
+	timer := time.NewTimer(b.cfg.WriteFlushInterval)
 	buffer := make([]writeReq, 0)
 
 	flush := func() {
@@ -393,8 +514,19 @@ func (b *BigtableIdx) processWriteQueue() {
 			errs, err := b.tbl.ApplyBulk(context.Background(), rowKeys, mutations)
 			if err != nil {
 				statQueryInsertFail.Add(len(rowKeys))
-				log.Errorf("bigtable-idx: Failed to write %d defs to bigtable. they won't be retried: %s", len(rowKeys), err)
-				complete = true
+				if attempts+1 >= maxWriteAttempts {
+					// the defs will be saved again once their LastSave is older than the update-interval
+					log.Errorf("bigtable-idx: Failed to write %d defs to bigtable after %d attempts. they won't be retried: %s", len(rowKeys), attempts+1, err)
+					complete = true
+					continue
+				}
+				log.Warnf("bigtable-idx: Failed to write %d defs to bigtable. They will be retried. %s", len(rowKeys), err)
+				sleepTime := 100 * attempts
+				if sleepTime > 2000 {
+					sleepTime = 2000
+				}
+				time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+				attempts++
 			} else if len(errs) > 0 {
 				var failedRowKeys []string
 				var failedMutations []*bigtable.Mutation
@@ -430,7 +562,7 @@ LOOP:
 	for {
 		select {
 		case <-timer.C:
-			timer.Reset(time.Second)
+			timer.Reset(b.cfg.WriteFlushInterval)
 			if len(buffer) > 0 {
 				flush()
 			}
@@ -448,7 +580,7 @@ LOOP:
 				if !timer.Stop() {
 					<-timer.C
 				}
-				timer.Reset(time.Second)
+				timer.Reset(b.cfg.WriteFlushInterval)
 				flush()
 			}
 		}
@@ -459,7 +591,7 @@ LOOP:
 
 func (b *BigtableIdx) Delete(orgId uint32, pattern string) ([]idx.Archive, error) {
 	pre := time.Now()
-	defs, err := b.MemoryIdx.Delete(orgId, pattern)
+	defs, err := b.MemoryIndex.Delete(orgId, pattern)
 	if err != nil {
 		return defs, err
 	}
@@ -477,6 +609,57 @@ func (b *BigtableIdx) Delete(orgId uint32, pattern string) ([]idx.Archive, error
 	return defs, err
 }
 
+// DeleteById deletes the metricDefinition with the given id from the index,
+// including the bigtable table.
+func (b *BigtableIdx) DeleteById(id schema.MKey) (idx.Archive, error) {
+	pre := time.Now()
+	def, err := b.MemoryIndex.DeleteById(id)
+	if err != nil {
+		return def, err
+	}
+	if b.cfg.UpdateBigtableIdx {
+		err = b.deleteDef(&def.MetricDefinition)
+		if err != nil {
+			log.Errorf("bigtable-idx: Failed to delete def %s: %s", def.MetricDefinition.Id, err)
+		}
+	}
+	statDeleteDuration.Value(time.Since(pre))
+	return def, err
+}
+
+// DeleteOrg deletes all metricDefinitions of the given org from the index,
+// including the bigtable table.
+func (b *BigtableIdx) DeleteOrg(orgId uint32) ([]idx.Archive, error) {
+	pre := time.Now()
+	defs, err := b.MemoryIndex.DeleteOrg(orgId)
+	if err != nil {
+		return defs, err
+	}
+	if b.cfg.UpdateBigtableIdx {
+		for _, def := range defs {
+			delErr := b.deleteDef(&def.MetricDefinition)
+			// the last error encountered will be passed back to the caller
+			if delErr != nil {
+				log.Errorf("bigtable-idx: Failed to delete def %s: %s", def.MetricDefinition.Id, delErr)
+				err = delErr
+			}
+		}
+	}
+	statDeleteDuration.Value(time.Since(pre))
+	return defs, err
+}
+
+// Rename renames the metricDefinition with the given id in the memory index,
+// and queues it to be saved to bigtable, where its row is keyed by the unchanged id.
+func (b *BigtableIdx) Rename(id schema.MKey, newName string) (idx.Archive, error) {
+	archive, err := b.MemoryIndex.Rename(id, newName)
+	if err != nil || !b.cfg.UpdateBigtableIdx {
+		return archive, err
+	}
+	b.enqueue(&archive.MetricDefinition, true)
+	return archive, nil
+}
+
 func (b *BigtableIdx) deleteDef(def *schema.MetricDefinition) error {
 	return b.deleteRow(FormatRowKey(def.Id, def.Partition))
 }
@@ -498,7 +681,7 @@ func (b *BigtableIdx) deleteRow(key string) error {
 
 func (b *BigtableIdx) Prune(now time.Time) ([]idx.Archive, error) {
 	log.Info("bigtable-idx: start pruning of series")
-	pruned, err := b.MemoryIdx.Prune(now)
+	pruned, err := b.MemoryIndex.Prune(now)
 	duration := time.Since(now)
 	if err != nil {
 		log.Errorf("bigtable-idx: prune error. %s", err)
@@ -512,11 +695,15 @@ func (b *BigtableIdx) Prune(now time.Time) ([]idx.Archive, error) {
 
 func (b *BigtableIdx) prune() {
 	defer b.wg.Done()
-	ticker := time.NewTicker(b.cfg.PruneInterval)
+	// jitter every interval, so that instances that were started together don't keep pruning at the same time
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	timer := time.NewTimer(util.Jitter(r, b.cfg.PruneInterval, pruneJitter))
+	defer timer.Stop()
 	for {
 		select {
-		case now := <-ticker.C:
+		case now := <-timer.C:
 			b.Prune(now)
+			timer.Reset(util.Jitter(r, b.cfg.PruneInterval, pruneJitter))
 		case <-b.shutdown:
 			return
 		}
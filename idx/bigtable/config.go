@@ -10,29 +10,39 @@ import (
 )
 
 type IdxConfig struct {
-	Enabled           bool
-	GcpProject        string
-	BigtableInstance  string
-	TableName         string
-	WriteQueueSize    int
-	WriteMaxFlushSize int
-	WriteConcurrency  int
-	UpdateBigtableIdx bool
-	UpdateInterval    time.Duration
-	updateInterval32  uint32
-	PruneInterval     time.Duration
-	CreateCF          bool
+	Enabled            bool
+	GcpProject         string
+	BigtableInstance   string
+	TableName          string
+	WriteQueueSize     int
+	WriteMaxFlushSize  int
+	WriteFlushInterval time.Duration
+	WriteConcurrency   int
+	UpdateBigtableIdx  bool
+	UpdateInterval     time.Duration
+	updateInterval32   uint32
+	PruneInterval      time.Duration
+	CreateCF           bool
 }
 
 func (cfg *IdxConfig) Validate() error {
 	cfg.updateInterval32 = uint32(cfg.UpdateInterval.Nanoseconds() / int64(time.Second))
+	if cfg.WriteMaxFlushSize < 1 {
+		return errors.New("write-max-flush-size must be >= 1.")
+	}
 	if cfg.WriteMaxFlushSize > 100000 {
 		return errors.New("write-max-flush-size must be <= 100000.")
 	}
 	if cfg.WriteMaxFlushSize >= cfg.WriteQueueSize {
 		return errors.New("write-queue-size must be larger then write-max-flush-size")
 	}
-	if cfg.PruneInterval == 0 {
+	if cfg.WriteFlushInterval < 10*time.Millisecond {
+		return errors.New("write-flush-interval must be >= 10ms.")
+	}
+	if cfg.UpdateInterval < 0 {
+		return errors.New("update-interval must not be negative")
+	}
+	if cfg.PruneInterval <= 0 {
 		return errors.New("pruneInterval must be greater then 0")
 	}
 	return nil
@@ -41,17 +51,18 @@ func (cfg *IdxConfig) Validate() error {
 // return StoreConfig with default values set.
 func NewIdxConfig() *IdxConfig {
 	return &IdxConfig{
-		Enabled:           false,
-		GcpProject:        "default",
-		BigtableInstance:  "default",
-		TableName:         "metrics",
-		WriteQueueSize:    100000,
-		WriteMaxFlushSize: 10000,
-		WriteConcurrency:  5,
-		UpdateBigtableIdx: true,
-		UpdateInterval:    time.Hour * 3,
-		PruneInterval:     time.Hour * 3,
-		CreateCF:          true,
+		Enabled:            false,
+		GcpProject:         "default",
+		BigtableInstance:   "default",
+		TableName:          "metrics",
+		WriteQueueSize:     100000,
+		WriteMaxFlushSize:  10000,
+		WriteFlushInterval: time.Second,
+		WriteConcurrency:   5,
+		UpdateBigtableIdx:  true,
+		UpdateInterval:     time.Hour * 3,
+		PruneInterval:      time.Hour * 3,
+		CreateCF:           true,
 	}
 }
 
@@ -66,10 +77,11 @@ func ConfigSetup() {
 	btIdx.StringVar(&CliConfig.TableName, "table-name", CliConfig.TableName, "Name of bigtable table used for metricDefs")
 	btIdx.IntVar(&CliConfig.WriteQueueSize, "write-queue-size", CliConfig.WriteQueueSize, "Max number of metricDefs allowed to be unwritten to bigtable. Must be larger then write-max-flush-size")
 	btIdx.IntVar(&CliConfig.WriteMaxFlushSize, "write-max-flush-size", CliConfig.WriteMaxFlushSize, "Max number of metricDefs in each batch write to bigtable")
+	btIdx.DurationVar(&CliConfig.WriteFlushInterval, "write-flush-interval", CliConfig.WriteFlushInterval, "Max time metricDefs are buffered before being written to bigtable, even if write-max-flush-size is not reached")
 	btIdx.IntVar(&CliConfig.WriteConcurrency, "write-concurrency", CliConfig.WriteConcurrency, "Number of writer threads to use")
 	btIdx.BoolVar(&CliConfig.UpdateBigtableIdx, "update-bigtable-index", CliConfig.UpdateBigtableIdx, "synchronize index changes to bigtable. not all your nodes need to do this.")
 	btIdx.DurationVar(&CliConfig.UpdateInterval, "update-interval", CliConfig.UpdateInterval, "frequency at which we should update the metricDef lastUpdate field, use 0s for instant updates")
-	btIdx.DurationVar(&CliConfig.PruneInterval, "prune-interval", CliConfig.PruneInterval, "Interval at which the index should be checked for stale series.")
+	btIdx.DurationVar(&CliConfig.PruneInterval, "prune-interval", CliConfig.PruneInterval, "Interval at which the index should be checked for stale series (randomly adjusted by up to 10% every time, so instances don't all prune at once).")
 	btIdx.BoolVar(&CliConfig.CreateCF, "create-cf", CliConfig.CreateCF, "enable the creation of the table and column families")
 
 	globalconf.Register("bigtable-idx", btIdx, flag.ExitOnError)
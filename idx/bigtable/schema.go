@@ -50,6 +50,14 @@ func DecodeRowKey(key string) (schema.MKey, int32, error) {
 	return mkey, int32(partition), nil
 }
 
+// invalidOrgIdError is returned by RowToSchema for rows with an orgId that can't be loaded.
+// unlike other errors, it only affects the row, so such rows can be skipped.
+type invalidOrgIdError int64
+
+func (e invalidOrgIdError) Error() string {
+	return fmt.Sprintf("invalid OrgId %d", int64(e))
+}
+
 // RowToSchema takes a row and unmarshals the data into the provided MetricDefinition.
 func RowToSchema(row bigtable.Row, def *schema.MetricDefinition) error {
 	if def == nil {
@@ -74,8 +82,10 @@ func RowToSchema(row bigtable.Row, def *schema.MetricDefinition) error {
 			if err != nil {
 				return err
 			}
-			if val < 0 {
+			if val == idx.OrgIdStoredPublic {
 				def.OrgId = idx.OrgIdPublic
+			} else if val < 0 {
+				return invalidOrgIdError(val)
 			} else {
 				def.OrgId = uint32(val)
 			}
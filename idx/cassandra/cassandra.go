@@ -1,15 +1,21 @@
 package cassandra
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gocql/gocql"
 	"github.com/grafana/metrictank/cassandra"
 	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/errors"
 	"github.com/grafana/metrictank/idx"
 	"github.com/grafana/metrictank/idx/memory"
 	"github.com/grafana/metrictank/stats"
@@ -32,6 +38,8 @@ var (
 	statQueryInsertWaitDuration = stats.NewLatencyHistogram12h32("idx.cassandra.query-insert.wait")
 	// metric idx.cassandra.query-insert.exec is time spent executing inserts (possibly repeatedly until success)
 	statQueryInsertExecDuration = stats.NewLatencyHistogram15s32("idx.cassandra.query-insert.exec")
+	// metric idx.cassandra.query-insert.total is time from queueing inserts until they completed, i.e. the wait and exec time together
+	statQueryInsertTotalDuration = stats.NewLatencyHistogram12h32("idx.cassandra.query-insert.total")
 	// metric idx.cassandra.query-delete.exec is time spent executing deletes (possibly repeatedly until success)
 	statQueryDeleteExecDuration = stats.NewLatencyHistogram15s32("idx.cassandra.query-delete.exec")
 
@@ -45,7 +53,31 @@ var (
 	statDeleteDuration = stats.NewLatencyHistogram15s32("idx.cassandra.delete")
 	// metric idx.cassandra.save.skipped is how many saves have been skipped due to the writeQueue being full
 	statSaveSkipped = stats.NewCounter32("idx.cassandra.save.skipped")
-	errmetrics      = cassandra.NewErrMetrics("idx.cassandra")
+	// metric idx.cassandra.save.refresh is how many saves of existing defs have been queued because their lastUpdate was older than the update-interval
+	statSaveRefresh = stats.NewCounter32("idx.cassandra.save.refresh")
+	// metric idx.cassandra.save.enqueue is time spent waiting for room in the writeQueue by saves that can't be skipped
+	statSaveEnqueueDuration = stats.NewLatencyHistogram15s32("idx.cassandra.save.enqueue")
+	// metric idx.cassandra.save.pending is how many defs have been queued for saving, but are not saved yet
+	statSavePending = stats.NewGauge32("idx.cassandra.save.pending")
+	// metric idx.cassandra.load-retries is how many times loading the index from cassandra failed and was restarted
+	statLoadRetries = stats.NewCounter32("idx.cassandra.load-retries")
+	// metric idx.cassandra.load-resumed is how many times loading the index resumed where a failed attempt left off, rather than starting over
+	statLoadResumed = stats.NewCounter32("idx.cassandra.load-resumed")
+	// metric idx.cassandra.load-fallback is how many times loading the index from the load-hosts failed, and it was loaded from the hosts instead
+	statLoadFallback = stats.NewCounter32("idx.cassandra.load-fallback")
+	// metric idx.cassandra.read-through is how many times a def that was not in the memory index was looked up in cassandra (see the read-through setting)
+	statReadThrough = stats.NewCounter32("idx.cassandra.read-through")
+	// metric idx.cassandra.read-through.miss-cached is how many read-throughs didn't look up a def in cassandra, because it was recently not found there (see the read-through-miss-ttl setting)
+	statReadThroughMissCached = stats.NewCounter32("idx.cassandra.read-through.miss-cached")
+	errmetrics                = cassandra.NewErrMetrics("idx.cassandra")
+
+	// how many times loading the index is attempted before giving up,
+	// and how long to wait after the first failed attempt. this doubles after every attempt.
+	loadAttempts = 5
+	loadBackoff  = time.Second
+
+	// the prune interval is randomly adjusted by up to this fraction, every time
+	pruneJitter = 0.1
 )
 
 type writeReq struct {
@@ -54,14 +86,32 @@ type writeReq struct {
 }
 
 // CasIdx implements the the "MetricIndex" interface
+// It embeds the MemoryIndex interface rather than a MemoryIdx, so that it can use either in-memory index
+// (see memory.NewIndex). Code that used the MemoryIdx field must use the MemoryIndex field instead.
 type CasIdx struct {
-	memory.MemoryIdx
+	memory.MemoryIndex
 	cfg              *IdxConfig
 	cluster          *gocql.ClusterConfig
 	session          *gocql.Session
+	loadCluster      *gocql.ClusterConfig // for the load-hosts, if configured
+	loadSession      *gocql.Session       // nil if there are no load-hosts, or we couldn't connect to them
 	writeQueue       chan writeReq
+	writeQueueLock   sync.RWMutex // held for reading while sending to writeQueue, and for writing while closing it
+	pending          int64        // number of defs queued for saving that are not saved yet
+	shutdown         chan struct{}
 	wg               sync.WaitGroup
 	updateInterval32 uint32
+
+	lookupsLock sync.Mutex
+	lookups     map[schema.MKey]*lookup // read-throughs in progress
+	misses      *memory.MissCache       // ids that read-throughs recently didn't find. nil if disabled
+}
+
+// lookup is a read-through of a def in cassandra, that concurrent Gets of the same id wait for
+type lookup struct {
+	sync.WaitGroup
+	archive idx.Archive
+	ok      bool
 }
 
 type cqlIterator interface {
@@ -73,13 +123,39 @@ func New(cfg *IdxConfig) *CasIdx {
 	if err := cfg.Validate(); err != nil {
 		log.Fatalf("cassandra-idx: %s", err)
 	}
-	cluster := gocql.NewCluster(strings.Split(cfg.hosts, ",")...)
+	idx := &CasIdx{
+		MemoryIndex:      memory.NewIndex(),
+		cfg:              cfg,
+		cluster:          newCluster(cfg, cfg.hosts),
+		shutdown:         make(chan struct{}),
+		updateInterval32: uint32(cfg.updateInterval.Nanoseconds() / int64(time.Second)),
+		lookups:          make(map[schema.MKey]*lookup),
+	}
+	if cfg.loadHosts != "" {
+		idx.loadCluster = newCluster(cfg, cfg.loadHosts)
+	}
+	if cfg.updateCassIdx {
+		idx.writeQueue = make(chan writeReq, cfg.writeQueueSize)
+	}
+	if cfg.readThrough && cfg.readThroughMissTTL > 0 {
+		idx.misses = memory.NewMissCache(cfg.readThroughMissTTL, cfg.readThroughMissSize)
+	}
+
+	return idx
+}
+
+// newCluster returns the cluster config to connect to the given comma separated cassandra hosts
+func newCluster(cfg *IdxConfig, hosts string) *gocql.ClusterConfig {
+	cluster := gocql.NewCluster(strings.Split(hosts, ",")...)
 	cluster.Consistency = gocql.ParseConsistency(cfg.consistency)
 	cluster.Timeout = cfg.timeout
 	cluster.ConnectTimeout = cluster.Timeout
 	cluster.NumConns = cfg.numConns
 	cluster.ProtoVersion = cfg.protoVer
 	cluster.DisableInitialHostLookup = cfg.disableInitialHostLookup
+	if cfg.compression {
+		cluster.Compressor = gocql.SnappyCompressor{}
+	}
 	if cfg.ssl {
 		cluster.SslOpts = &gocql.SslOptions{
 			CaPath:                 cfg.capath,
@@ -92,18 +168,7 @@ func New(cfg *IdxConfig) *CasIdx {
 			Password: cfg.password,
 		}
 	}
-
-	idx := &CasIdx{
-		MemoryIdx:        *memory.New(),
-		cfg:              cfg,
-		cluster:          cluster,
-		updateInterval32: uint32(cfg.updateInterval.Nanoseconds() / int64(time.Second)),
-	}
-	if cfg.updateCassIdx {
-		idx.writeQueue = make(chan writeReq, cfg.writeQueueSize)
-	}
-
-	return idx
+	return cluster
 }
 
 // InitBare makes sure the keyspace, tables, and index exists in cassandra and creates a session
@@ -164,6 +229,16 @@ func (c *CasIdx) InitBare() error {
 
 	c.session = session
 
+	if c.loadCluster != nil {
+		c.loadCluster.Keyspace = c.cfg.keyspace
+		loadSession, err := c.loadCluster.CreateSession()
+		if err != nil {
+			log.Warnf("cassandra-idx: failed to create cassandra session for load-hosts %s, loading from hosts instead: %s", c.cfg.loadHosts, err)
+		} else {
+			c.loadSession = loadSession
+		}
+	}
+
 	return nil
 }
 
@@ -171,7 +246,7 @@ func (c *CasIdx) InitBare() error {
 // rebuilds the in-memory index, sets up write queues, metrics and pruning routines
 func (c *CasIdx) Init() error {
 	log.Infof("initializing cassandra-idx. Hosts=%s", c.cfg.hosts)
-	if err := c.MemoryIdx.Init(); err != nil {
+	if err := c.MemoryIndex.Init(); err != nil {
 		return err
 	}
 
@@ -188,9 +263,12 @@ func (c *CasIdx) Init() error {
 	}
 
 	//Rebuild the in-memory index.
-	c.rebuildIndex()
+	if err := c.rebuildIndex(); err != nil {
+		return err
+	}
 
 	if memory.IndexRules.Prunable() {
+		c.wg.Add(1)
 		go c.prune()
 	}
 	return nil
@@ -198,14 +276,21 @@ func (c *CasIdx) Init() error {
 
 func (c *CasIdx) Stop() {
 	log.Info("cassandra-idx: stopping")
-	c.MemoryIdx.Stop()
+	c.MemoryIndex.Stop()
+	close(c.shutdown)
 
 	// if updateCassIdx is disabled then writeQueue should never have been initialized
 	if c.cfg.updateCassIdx {
+		// wait for the enqueues in progress. later ones see the shutdown and give up
+		c.writeQueueLock.Lock()
 		close(c.writeQueue)
+		c.writeQueueLock.Unlock()
 	}
 	c.wg.Wait()
 	c.session.Close()
+	if c.loadSession != nil {
+		c.loadSession.Close()
+	}
 }
 
 // Update updates an existing archive, if found.
@@ -213,7 +298,7 @@ func (c *CasIdx) Stop() {
 func (c *CasIdx) Update(point schema.MetricPoint, partition int32) (idx.Archive, int32, bool) {
 	pre := time.Now()
 
-	archive, oldPartition, inMemory := c.MemoryIdx.Update(point, partition)
+	archive, oldPartition, inMemory := c.MemoryIndex.Update(point, partition)
 
 	if !c.cfg.updateCassIdx {
 		statUpdateDuration.Value(time.Since(pre))
@@ -242,11 +327,14 @@ func (c *CasIdx) Update(point schema.MetricPoint, partition int32) (idx.Archive,
 func (c *CasIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, partition int32) (idx.Archive, int32, bool) {
 	pre := time.Now()
 
-	archive, oldPartition, inMemory := c.MemoryIdx.AddOrUpdate(mkey, data, partition)
+	archive, oldPartition, inMemory := c.MemoryIndex.AddOrUpdate(mkey, data, partition)
 
 	stat := statUpdateDuration
 	if !inMemory {
 		stat = statAddDuration
+		if c.misses != nil {
+			c.misses.Remove(mkey)
+		}
 	}
 
 	if !c.cfg.updateCassIdx {
@@ -273,6 +361,37 @@ func (c *CasIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, partitio
 	return archive, oldPartition, inMemory
 }
 
+// AddOrUpdateMany is the batch equivalent of AddOrUpdate.
+// see memory.MemoryIdx.AddOrUpdateMany
+func (c *CasIdx) AddOrUpdateMany(mkeys []schema.MKey, data []*schema.MetricData, partition int32) []memory.AddOrUpdateResult {
+	results := c.MemoryIndex.AddOrUpdateMany(mkeys, data, partition)
+
+	if c.misses != nil {
+		for i := range results {
+			if !results[i].InMemory {
+				c.misses.Remove(mkeys[i])
+			}
+		}
+	}
+
+	if !c.cfg.updateCassIdx {
+		return results
+	}
+
+	now := uint32(time.Now().Unix())
+	for i := range results {
+		res := &results[i]
+		// see AddOrUpdate for why we need to delete the old entry
+		if res.InMemory && res.OldPartition != partition {
+			c.deleteDefAsync(mkeys[i], res.OldPartition)
+		}
+		if res.Archive.LastSave < (now - c.updateInterval32) {
+			res.Archive = c.updateCassandra(now, res.InMemory, res.Archive, partition)
+		}
+	}
+	return results
+}
+
 // updateCassandra saves the archive to cassandra and
 // updates the memory index with the updated fields.
 func (c *CasIdx) updateCassandra(now uint32, inMemory bool, archive idx.Archive, partition int32) idx.Archive {
@@ -280,9 +399,14 @@ func (c *CasIdx) updateCassandra(now uint32, inMemory bool, archive idx.Archive,
 	// then perform a blocking save.
 	if archive.LastSave < (now - c.updateInterval32 - c.updateInterval32/2) {
 		log.Debugf("cassandra-idx: updating def %s in index.", archive.MetricDefinition.Id)
-		c.writeQueue <- writeReq{recvTime: time.Now(), def: &archive.MetricDefinition}
+		if !c.enqueue(&archive.MetricDefinition, true) {
+			return archive
+		}
 		archive.LastSave = now
-		c.MemoryIdx.UpdateArchive(archive)
+		c.MemoryIndex.UpdateArchive(archive)
+		if inMemory {
+			statSaveRefresh.Inc()
+		}
 	} else {
 		// perform a non-blocking write to the writeQueue. If the queue is full, then
 		// this will fail and we won't update the LastSave timestamp. The next time
@@ -290,11 +414,13 @@ func (c *CasIdx) updateCassandra(now uint32, inMemory bool, archive idx.Archive,
 		// we will try and save again.  This will continue until we are successful or the
 		// lastSave timestamp become more then 1.5 x UpdateInterval, in which case we will
 		// do a blocking write to the queue.
-		select {
-		case c.writeQueue <- writeReq{recvTime: time.Now(), def: &archive.MetricDefinition}:
+		if c.enqueue(&archive.MetricDefinition, false) {
 			archive.LastSave = now
-			c.MemoryIdx.UpdateArchive(archive)
-		default:
+			c.MemoryIndex.UpdateArchive(archive)
+			if inMemory {
+				statSaveRefresh.Inc()
+			}
+		} else {
 			statSaveSkipped.Inc()
 			log.Debugf("cassandra-idx: writeQueue is full, update of %s not saved this time.", archive.MetricDefinition.Id)
 		}
@@ -303,47 +429,350 @@ func (c *CasIdx) updateCassandra(now uint32, inMemory bool, archive idx.Archive,
 	return archive
 }
 
-func (c *CasIdx) rebuildIndex() {
+func (c *CasIdx) rebuildIndex() error {
 	log.Info("cassandra-idx: Rebuilding Memory Index from metricDefinitions in Cassandra")
 	pre := time.Now()
-	defs := c.LoadPartitions(cluster.Manager.GetPartitions(), nil, pre)
-	num := c.MemoryIdx.Load(defs)
+	partitions := cluster.Manager.GetPartitions()
+	cp := newLoadCheckpoint()
+	defs, err := retryLoad(func() ([]schema.MetricDefinition, error) {
+		return c.resumeLoad(cp, partitionsQuery(partitions), pre)
+	})
+	if err != nil {
+		return err
+	}
+	num := c.MemoryIndex.Load(defs)
 	log.Infof("cassandra-idx: Rebuilding Memory Index Complete. Imported %d. Took %s", num, time.Since(pre))
+	return nil
+}
+
+// retryLoad calls load until it succeeds, at most loadAttempts times, backing off exponentially in between.
+// load may resume where a failed attempt left off (see resumeLoad), but must never return partial results.
+func retryLoad(load func() ([]schema.MetricDefinition, error)) ([]schema.MetricDefinition, error) {
+	backoff := loadBackoff
+	for attempt := 1; ; attempt++ {
+		defs, err := load()
+		if err == nil {
+			return defs, nil
+		}
+		if attempt >= loadAttempts {
+			return nil, fmt.Errorf("cassandra-idx: failed to load index after %d attempts: %s", attempt, err)
+		}
+		statLoadRetries.Inc()
+		log.Warnf("cassandra-idx: failed to load index: %s. restarting in %s. attempt: %d", err, backoff, attempt)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
 func (c *CasIdx) Load(defs []schema.MetricDefinition, now time.Time) []schema.MetricDefinition {
-	iter := c.session.Query("SELECT id, orgid, partition, name, interval, unit, mtype, tags, lastupdate from metric_idx").Iter()
-	return c.load(defs, iter, now)
+	defs, err := c.loadQuery("SELECT id, orgid, partition, name, interval, unit, mtype, tags, lastupdate from metric_idx", defs, now)
+	if err != nil {
+		log.Fatalf("cassandra-idx: %s", err)
+	}
+	return defs
+}
+
+// loadQuery loads the defs read by the given query, like load.
+func (c *CasIdx) loadQuery(query string, defs []schema.MetricDefinition, now time.Time) ([]schema.MetricDefinition, error) {
+	cp := newLoadCheckpoint()
+	if err := c.readQuery(cp, query); err != nil {
+		return defs, err
+	}
+	return cp.defs(defs, now), nil
+}
+
+// resumeLoad loads the defs read by the given query, like loadQuery, but rather than starting over,
+// it resumes reading after the pages that previous failed attempts with the same checkpoint read completely.
+// If a resumed attempt fails without reading any page, the paging state may be no longer valid,
+// so the checkpoint is reset for the next attempt to start over.
+func (c *CasIdx) resumeLoad(cp *loadCheckpoint, query string, now time.Time) ([]schema.MetricDefinition, error) {
+	resumed := cp.pageState != nil
+	if resumed {
+		statLoadResumed.Inc()
+		log.Infof("cassandra-idx: resuming load of index after %d rows", cp.rows)
+	}
+	rows := cp.rows
+	if err := c.readQuery(cp, query); err != nil {
+		if resumed && cp.rows == rows {
+			cp.reset()
+		}
+		return nil, err
+	}
+	return cp.defs(nil, now), nil
+}
+
+// readQuery reads the rows of the given query into the checkpoint, starting at its paging state.
+// If load-hosts are configured, it reads from those, falling back to the hosts if that fails,
+// so the loading doesn't add read load to the cluster we write to.
+func (c *CasIdx) readQuery(cp *loadCheckpoint, query string) error {
+	if c.loadSession != nil {
+		err := cp.read(c.loadSession.Query(query).PageSize(c.cfg.loadPageSize).PageState(cp.pageState).Iter())
+		if err == nil {
+			return nil
+		}
+		statLoadFallback.Inc()
+		log.Warnf("cassandra-idx: failed to load index from load-hosts %s, loading from hosts instead: %s", c.cfg.loadHosts, err)
+	}
+	return cp.read(c.session.Query(query).PageSize(c.cfg.loadPageSize).PageState(cp.pageState).Iter())
+}
+
+// Get returns the archive with the given id from the memory index.
+// If it is not there and read-through is enabled, e.g. because it was evicted, it is looked up in
+// the partitions of this node in cassandra, and added to the memory index if found.
+func (c *CasIdx) Get(id schema.MKey) (idx.Archive, bool) {
+	archive, ok := c.MemoryIndex.Get(id)
+	if ok || !c.cfg.readThrough {
+		return archive, ok
+	}
+	return c.readThrough(id, func() cqlIterator {
+		return c.session.Query(partitionsQuery(cluster.Manager.GetPartitions())+" AND id=?", id.String()).Iter()
+	})
+}
+
+// readThrough looks up the def with the given id in cassandra, using the iterator returned by query,
+// and loads it into the memory index. Like when loading the index, stale defs are ignored.
+// Concurrent read-throughs of the same id share a single lookup.
+// Ids that were not found are not looked up again for read-through-miss-ttl, unless they get added.
+func (c *CasIdx) readThrough(id schema.MKey, query func() cqlIterator) (idx.Archive, bool) {
+	if c.misses != nil && c.misses.Missing(id, time.Now()) {
+		statReadThroughMissCached.Inc()
+		return idx.Archive{}, false
+	}
+	c.lookupsLock.Lock()
+	if l, ok := c.lookups[id]; ok {
+		c.lookupsLock.Unlock()
+		l.Wait()
+		return l.archive, l.ok
+	}
+	l := &lookup{}
+	l.Add(1)
+	c.lookups[id] = l
+	c.lookupsLock.Unlock()
+
+	// the def may have been loaded by a lookup that finished after our Get
+	l.archive, l.ok = c.MemoryIndex.Get(id)
+	if !l.ok {
+		statReadThrough.Inc()
+		defs, err := c.load(nil, query(), time.Now())
+		if err != nil {
+			log.Errorf("cassandra-idx: failed to look up metricDef %s: %s", id, err)
+		} else if len(defs) > 0 {
+			c.MemoryIndex.Load(defs)
+			l.archive, l.ok = c.MemoryIndex.Get(id)
+		}
+		// failed lookups are retried by the next Get
+		if err == nil && !l.ok && c.misses != nil {
+			c.misses.Add(id, time.Now())
+		}
+	}
+
+	c.lookupsLock.Lock()
+	delete(c.lookups, id)
+	c.lookupsLock.Unlock()
+	l.Done()
+	return l.archive, l.ok
+}
+
+// Refresh re-reads the def with the given id from cassandra and replaces it in the memory index.
+// This is an escape hatch for operators who corrected a def in cassandra directly, for the change
+// to be picked up without a restart. Only defs that are in the memory index can be refreshed,
+// as their partition is needed to look them up.
+func (c *CasIdx) Refresh(id schema.MKey) (idx.Archive, error) {
+	archive, ok := c.MemoryIndex.Get(id)
+	if !ok {
+		return idx.Archive{}, errors.NewNotFound(fmt.Sprintf("metricDef %s not found in index", id))
+	}
+	iter := c.session.Query("SELECT id, orgid, partition, name, interval, unit, mtype, tags, lastupdate from metric_idx where partition=? AND id=?", archive.Partition, id.String()).Iter()
+	return c.refresh(id, iter)
+}
+
+func (c *CasIdx) refresh(id schema.MKey, iter cqlIterator) (idx.Archive, error) {
+	var idStr, name, unit, mtype string
+	var orgId, interval int
+	var partition int32
+	var lastupdate int64
+	var tags []string
+	found := iter.Scan(&idStr, &orgId, &partition, &name, &interval, &unit, &mtype, &tags, &lastupdate)
+	if err := iter.Close(); err != nil {
+		return idx.Archive{}, fmt.Errorf("cassandra-idx: failed to read metricDef %s: %s", id, err)
+	}
+	if !found {
+		return idx.Archive{}, errors.NewNotFound(fmt.Sprintf("metricDef %s not found in cassandra", id))
+	}
+	if orgId == idx.OrgIdStoredPublic {
+		orgId = int(idx.OrgIdPublic)
+	} else if orgId < 0 {
+		return idx.Archive{}, fmt.Errorf("cassandra-idx: metricDef %s has invalid orgId %d", id, orgId)
+	}
+	def := schema.MetricDefinition{
+		Id:         id,
+		OrgId:      uint32(orgId),
+		Partition:  partition,
+		Name:       name,
+		Interval:   interval,
+		Unit:       unit,
+		Mtype:      mtype,
+		Tags:       tags,
+		LastUpdate: lastupdate,
+	}
+	log.Infof("cassandra-idx: refreshing metricDef %s from cassandra", id)
+	return c.MemoryIndex.Replace(def), nil
 }
 
 func (c *CasIdx) LoadPartitions(partitions []int32, defs []schema.MetricDefinition, now time.Time) []schema.MetricDefinition {
+	defs, err := c.loadPartitions(partitions, defs, now)
+	if err != nil {
+		log.Fatalf("cassandra-idx: %s", err)
+	}
+	return defs
+}
+
+func (c *CasIdx) loadPartitions(partitions []int32, defs []schema.MetricDefinition, now time.Time) ([]schema.MetricDefinition, error) {
+	return c.loadQuery(partitionsQuery(partitions), defs, now)
+}
+
+// partitionsQuery returns the query to read all defs of the given partitions
+func partitionsQuery(partitions []int32) string {
 	placeholders := make([]string, len(partitions))
 	for i, p := range partitions {
 		placeholders[i] = strconv.Itoa(int(p))
 	}
-	q := fmt.Sprintf("SELECT id, orgid, partition, name, interval, unit, mtype, tags, lastupdate from metric_idx where partition in (%s)", strings.Join(placeholders, ","))
-	iter := c.session.Query(q).Iter()
-	return c.load(defs, iter, now)
+	return fmt.Sprintf("SELECT id, orgid, partition, name, interval, unit, mtype, tags, lastupdate from metric_idx where partition in (%s)", strings.Join(placeholders, ","))
+}
+
+// Audit compares the ids of the defs in cassandra for the partitions handled by this node against the memory index.
+// It returns the ids of defs that are in cassandra but not in memory (missing) and of those that are in memory
+// but not in cassandra (extra). Like when loading the index, stale defs in cassandra are not expected in memory.
+// The memory index is only read locked to take a snapshot of its ids, so it is safe to call on a live instance,
+// but defs that are added, saved or pruned while the audit runs may show up in the results.
+func (c *CasIdx) Audit(ctx context.Context) ([]string, []string, error) {
+	pre := time.Now()
+	iter := c.session.Query(partitionsQuery(cluster.Manager.GetPartitions())).PageSize(c.cfg.loadPageSize).Iter()
+	return c.audit(ctx, iter, pre)
+}
+
+func (c *CasIdx) audit(ctx context.Context, iter cqlIterator, now time.Time) ([]string, []string, error) {
+	defs, err := c.load(nil, ctxIterator{ctx, iter}, now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cassandra-idx: audit failed: %s", err)
+	}
+	inCass := make(map[schema.MKey]struct{}, len(defs))
+	for _, def := range defs {
+		inCass[def.Id] = struct{}{}
+	}
+
+	var missing, extra []string
+	for _, id := range c.MemoryIndex.Ids() {
+		if _, ok := inCass[id]; ok {
+			delete(inCass, id)
+			continue
+		}
+		extra = append(extra, id.String())
+	}
+	for id := range inCass {
+		missing = append(missing, id.String())
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra, nil
+}
+
+// ctxIterator stops iterating as soon as its context is done
+type ctxIterator struct {
+	ctx context.Context
+	cqlIterator
+}
+
+func (i ctxIterator) Scan(dest ...interface{}) bool {
+	if i.ctx.Err() != nil {
+		return false
+	}
+	return i.cqlIterator.Scan(dest...)
+}
+
+func (i ctxIterator) Close() error {
+	err := i.cqlIterator.Close()
+	if err == nil {
+		err = i.ctx.Err()
+	}
+	return err
 }
 
-func (c *CasIdx) load(defs []schema.MetricDefinition, iter cqlIterator, now time.Time) []schema.MetricDefinition {
-	defsByNames := make(map[string][]*schema.MetricDefinition)
+// load reads all defs from the iterator and appends the non-stale ones to defs.
+// if the iterator fails, defs is returned as it was passed in, along with the error.
+func (c *CasIdx) load(defs []schema.MetricDefinition, iter cqlIterator, now time.Time) ([]schema.MetricDefinition, error) {
+	cp := newLoadCheckpoint()
+	if err := cp.read(iter); err != nil {
+		return defs, err
+	}
+	return cp.defs(defs, now), nil
+}
+
+// pagedIterator is a cqlIterator that reads rows in pages, like gocql.Iter.
+// PageState returns the paging state to read the page after the one the last row was scanned from,
+// and nil if it was the last page.
+type pagedIterator interface {
+	cqlIterator
+	PageState() []byte
+}
+
+// loadCheckpoint holds the defs read by a load so far, and the paging state to resume reading after them,
+// such that a load that fails halfway can be resumed by the next attempt, rather than started over.
+type loadCheckpoint struct {
+	defsByNames map[string][]*schema.MetricDefinition
+	rows        int    // number of defs in defsByNames
+	pageState   []byte // paging state of the first page that wasn't read completely. nil to read from the start
+}
+
+func newLoadCheckpoint() *loadCheckpoint {
+	return &loadCheckpoint{
+		defsByNames: make(map[string][]*schema.MetricDefinition),
+	}
+}
+
+// reset discards everything read, so that the next read starts over
+func (cp *loadCheckpoint) reset() {
+	*cp = *newLoadCheckpoint()
+}
+
+// read reads all defs from the iterator into the checkpoint.
+// When the iterator fails, only the defs of the pages that were read completely are kept, and the paging state
+// is set to read the page that failed. As iterators that aren't paged have no paging state, it is kept as is for them.
+func (cp *loadCheckpoint) read(iter cqlIterator) error {
+	paged, isPaged := iter.(pagedIterator)
+	var next []byte
+	if isPaged {
+		next = paged.PageState()
+	}
+	var page []*schema.MetricDefinition
 	var id, name, unit, mtype string
 	var orgId, interval int
 	var partition int32
 	var lastupdate int64
 	var tags []string
 	for iter.Scan(&id, &orgId, &partition, &name, &interval, &unit, &mtype, &tags, &lastupdate) {
+		if isPaged {
+			if state := paged.PageState(); !bytes.Equal(state, next) {
+				// this row is the first one of a new page, so we're done reading the previous one
+				cp.add(page)
+				cp.pageState = next
+				page = page[:0]
+				next = state
+			}
+		}
 		mkey, err := schema.MKeyFromString(id)
 		if err != nil {
 			log.Errorf("cassandra-idx: load() could not parse ID %q: %s -> skipping", id, err)
 			continue
 		}
-		if orgId < 0 {
+		if orgId == idx.OrgIdStoredPublic {
 			orgId = int(idx.OrgIdPublic)
+		} else if orgId < 0 {
+			log.Errorf("cassandra-idx: load() found invalid orgId %d for ID %q -> skipping", orgId, id)
+			continue
 		}
 
-		mdef := &schema.MetricDefinition{
+		page = append(page, &schema.MetricDefinition{
 			Id:         mkey,
 			OrgId:      uint32(orgId),
 			Partition:  partition,
@@ -353,26 +782,39 @@ func (c *CasIdx) load(defs []schema.MetricDefinition, iter cqlIterator, now time
 			Mtype:      mtype,
 			Tags:       tags,
 			LastUpdate: lastupdate,
-		}
-		nameWithTags := mdef.NameWithTags()
-		defsByNames[nameWithTags] = append(defsByNames[nameWithTags], mdef)
+		})
 	}
 	if err := iter.Close(); err != nil {
-		log.Fatalf("Could not close iterator: %s", err.Error())
+		return fmt.Errorf("could not close iterator: %s", err)
 	}
+	cp.add(page)
+	cp.pageState = nil
+	return nil
+}
 
+// add adds the defs of a page that was read completely
+func (cp *loadCheckpoint) add(page []*schema.MetricDefinition) {
+	for _, mdef := range page {
+		nameWithTags := mdef.NameWithTags()
+		cp.defsByNames[nameWithTags] = append(cp.defsByNames[nameWithTags], mdef)
+	}
+	cp.rows += len(page)
+}
+
+// defs appends the non-stale defs that were read to defs
+func (cp *loadCheckpoint) defs(defs []schema.MetricDefinition, now time.Time) []schema.MetricDefinition {
 	// getting all cutoffs once saves having to recompute everytime we have a match
 	cutoffs := memory.IndexRules.Cutoffs(now)
 
 NAMES:
-	for nameWithTags, defsByName := range defsByNames {
+	for nameWithTags, defsByName := range cp.defsByNames {
 		irId, _ := memory.IndexRules.Match(nameWithTags)
 		cutoff := cutoffs[irId]
 		for _, def := range defsByName {
 			if def.LastUpdate >= cutoff {
 				// if any of the defs for a given nameWithTags is not stale, then we need to load
 				// all the defs for that nameWithTags.
-				for _, defToAdd := range defsByNames[nameWithTags] {
+				for _, defToAdd := range cp.defsByNames[nameWithTags] {
 					defs = append(defs, *defToAdd)
 				}
 				continue NAMES
@@ -383,6 +825,55 @@ NAMES:
 	return defs
 }
 
+// addPending adjusts the number of defs queued for saving that are not saved yet
+func (c *CasIdx) addPending(delta int64) {
+	statSavePending.Set(int(atomic.AddInt64(&c.pending, delta)))
+}
+
+// Flush waits until all defs queued for saving have been saved to cassandra, or until the context is done.
+// This can be used before a planned restart, to make sure no queued saves get lost.
+func (c *CasIdx) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&c.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cassandra-idx: %d defs not saved yet: %s", atomic.LoadInt64(&c.pending), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// enqueue queues the def to be saved. If block is set, it waits for room in the writeQueue,
+// otherwise it gives up when the queue is full. It returns whether the def was queued.
+// Once Stop is called, defs are never queued, as the writeQueue gets closed.
+func (c *CasIdx) enqueue(def *schema.MetricDefinition, block bool) bool {
+	c.writeQueueLock.RLock()
+	defer c.writeQueueLock.RUnlock()
+	select {
+	case <-c.shutdown:
+		log.Debugf("cassandra-idx: index is stopping, def %s not saved.", def.Id)
+		return false
+	default:
+	}
+	c.addPending(1)
+	pre := time.Now()
+	req := writeReq{recvTime: pre, def: def}
+	if !block {
+		select {
+		case c.writeQueue <- req:
+			return true
+		default:
+			c.addPending(-1)
+			return false
+		}
+	}
+	c.writeQueue <- req
+	statSaveEnqueueDuration.Value(time.Since(pre))
+	return true
+}
+
 func (c *CasIdx) processWriteQueue() {
 	var success bool
 	var attempts int
@@ -426,7 +917,9 @@ func (c *CasIdx) processWriteQueue() {
 			} else {
 				success = true
 				statQueryInsertExecDuration.Value(time.Since(pre))
+				statQueryInsertTotalDuration.Value(time.Since(req.recvTime))
 				statQueryInsertOk.Inc()
+				c.addPending(-1)
 				log.Debugf("cassandra-idx: metricDef %s saved to cassandra", req.def.Id)
 			}
 		}
@@ -437,7 +930,7 @@ func (c *CasIdx) processWriteQueue() {
 
 func (c *CasIdx) Delete(orgId uint32, pattern string) ([]idx.Archive, error) {
 	pre := time.Now()
-	defs, err := c.MemoryIdx.Delete(orgId, pattern)
+	defs, err := c.MemoryIndex.Delete(orgId, pattern)
 	if err != nil {
 		return defs, err
 	}
@@ -453,6 +946,55 @@ func (c *CasIdx) Delete(orgId uint32, pattern string) ([]idx.Archive, error) {
 	return defs, err
 }
 
+// DeleteById deletes the metricDefinition with the given id from the index,
+// including the cassandra table.
+func (c *CasIdx) DeleteById(id schema.MKey) (idx.Archive, error) {
+	pre := time.Now()
+	def, err := c.MemoryIndex.DeleteById(id)
+	if err != nil {
+		return def, err
+	}
+	if c.cfg.updateCassIdx {
+		err = c.deleteDef(def.Id, def.Partition)
+		if err != nil {
+			log.Errorf("cassandra-idx: %s", err.Error())
+		}
+	}
+	statDeleteDuration.Value(time.Since(pre))
+	return def, err
+}
+
+// DeleteOrg deletes all metricDefinitions of the given org from the index,
+// including the cassandra table.
+func (c *CasIdx) DeleteOrg(orgId uint32) ([]idx.Archive, error) {
+	pre := time.Now()
+	defs, err := c.MemoryIndex.DeleteOrg(orgId)
+	if err != nil {
+		return defs, err
+	}
+	if c.cfg.updateCassIdx {
+		for _, def := range defs {
+			err = c.deleteDef(def.Id, def.Partition)
+			if err != nil {
+				log.Errorf("cassandra-idx: %s", err.Error())
+			}
+		}
+	}
+	statDeleteDuration.Value(time.Since(pre))
+	return defs, err
+}
+
+// Rename renames the metricDefinition with the given id in the memory index,
+// and queues it to be saved to cassandra, where its row is keyed by the unchanged id.
+func (c *CasIdx) Rename(id schema.MKey, newName string) (idx.Archive, error) {
+	archive, err := c.MemoryIndex.Rename(id, newName)
+	if err != nil || !c.cfg.updateCassIdx {
+		return archive, err
+	}
+	c.enqueue(&archive.MetricDefinition, true)
+	return archive, nil
+}
+
 func (c *CasIdx) deleteDef(key schema.MKey, part int32) error {
 	pre := time.Now()
 	attempts := 0
@@ -484,7 +1026,7 @@ func (c *CasIdx) deleteDefAsync(key schema.MKey, part int32) {
 
 func (c *CasIdx) Prune(now time.Time) ([]idx.Archive, error) {
 	log.Info("cassandra-idx: start pruning of series")
-	pruned, err := c.MemoryIdx.Prune(now)
+	pruned, err := c.MemoryIndex.Prune(now)
 	duration := time.Since(now)
 	if err != nil {
 		log.Errorf("cassandra-idx: pruning error: %s", err)
@@ -496,8 +1038,18 @@ func (c *CasIdx) Prune(now time.Time) ([]idx.Archive, error) {
 }
 
 func (c *CasIdx) prune() {
-	ticker := time.NewTicker(c.cfg.pruneInterval)
-	for now := range ticker.C {
-		c.Prune(now)
+	defer c.wg.Done()
+	// jitter every interval, so that instances that were started together don't keep pruning at the same time
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	timer := time.NewTimer(util.Jitter(r, c.cfg.pruneInterval, pruneJitter))
+	defer timer.Stop()
+	for {
+		select {
+		case now := <-timer.C:
+			c.Prune(now)
+			timer.Reset(util.Jitter(r, c.cfg.pruneInterval, pruneJitter))
+		case <-c.shutdown:
+			return
+		}
 	}
 }
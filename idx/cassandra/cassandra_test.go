@@ -1,13 +1,17 @@
 package cassandra
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"reflect"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -65,6 +69,56 @@ func (i *testIterator) Close() error {
 	return nil
 }
 
+// pagedTestIterator is a testIterator that reads its rows in pages, starting at the page its paging state points at.
+// its paging state is the index of the next page, like cassandra's opaque paging state.
+// it fails after reading failAfter rows, if set.
+type pagedTestIterator struct {
+	pages     [][]cassRow
+	page      int
+	row       int
+	failAfter int
+	read      int
+	err       error
+}
+
+func newPagedTestIterator(pages [][]cassRow, pageState []byte, failAfter int) *pagedTestIterator {
+	i := &pagedTestIterator{pages: pages, failAfter: failAfter}
+	if pageState != nil {
+		i.page = int(pageState[0])
+	}
+	return i
+}
+
+func (i *pagedTestIterator) Scan(dest ...interface{}) bool {
+	for i.page < len(i.pages) && i.row == len(i.pages[i.page]) {
+		i.page++
+		i.row = 0
+	}
+	if i.page == len(i.pages) {
+		return false
+	}
+	if i.failAfter > 0 && i.read == i.failAfter {
+		i.err = fmt.Errorf("failed after %d rows", i.read)
+		return false
+	}
+	rows := &testIterator{rows: i.pages[i.page][i.row:]}
+	rows.Scan(dest...)
+	i.row++
+	i.read++
+	return true
+}
+
+func (i *pagedTestIterator) PageState() []byte {
+	if i.page+1 >= len(i.pages) {
+		return nil
+	}
+	return []byte{byte(i.page + 1)}
+}
+
+func (i *pagedTestIterator) Close() error {
+	return i.err
+}
+
 func init() {
 	CliConfig.keyspace = "metrictank"
 	CliConfig.hosts = ""
@@ -79,7 +133,7 @@ func init() {
 }
 
 func initForTests(c *CasIdx) error {
-	return c.MemoryIdx.Init()
+	return c.MemoryIndex.Init()
 }
 
 func getSeriesNames(depth, count int, prefix string) []string {
@@ -293,8 +347,80 @@ func TestAddToWriteQueue(t *testing.T) {
 			So(time.Now(), ShouldHappenAfter, pre.Add(time.Second))
 		})
 	})
-	ix.MemoryIdx.Stop()
+	ix.MemoryIndex.Stop()
+	close(ix.writeQueue)
+}
+
+func TestFlush(t *testing.T) {
+	originalUpdateCassIdx := CliConfig.updateCassIdx
+	defer func() { CliConfig.updateCassIdx = originalUpdateCassIdx }()
+	CliConfig.updateCassIdx = true
+
+	ix := New(CliConfig)
+	initForTests(ix)
+	defer ix.MemoryIndex.Stop()
+
+	metrics := getMetricData(1, 2, 2, 10, "metric.flush")
+	for _, s := range metrics {
+		mkey, err := schema.MKeyFromString(s.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.AddOrUpdate(mkey, s, 1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ix.Flush(ctx); err == nil {
+		t.Fatalf("expected an error flushing while defs are still queued")
+	}
+
+	// save the queued defs, like processWriteQueue does
+	go func() {
+		for range metrics {
+			<-ix.writeQueue
+			ix.addPending(-1)
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ix.Flush(ctx); err != nil {
+		t.Fatalf("expected flush to succeed once all defs are saved, got %s", err)
+	}
+}
+
+func TestSaveAfterStop(t *testing.T) {
+	originalUpdateCassIdx := CliConfig.updateCassIdx
+	defer func() { CliConfig.updateCassIdx = originalUpdateCassIdx }()
+	CliConfig.updateCassIdx = true
+
+	ix := New(CliConfig)
+	initForTests(ix)
+	defer ix.MemoryIndex.Stop()
+
+	// like Stop does, without a session to close
+	close(ix.shutdown)
+	ix.writeQueueLock.Lock()
 	close(ix.writeQueue)
+	ix.writeQueueLock.Unlock()
+
+	// these would panic if they sent to the closed writeQueue
+	for _, s := range getMetricData(1, 2, 2, 10, "metric.stopped") {
+		mkey, err := schema.MKeyFromString(s.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, _, _ := ix.AddOrUpdate(mkey, s, 1)
+		if archive.LastSave != 0 {
+			t.Fatalf("expected def %s not to be saved after stop, got LastSave %d", mkey, archive.LastSave)
+		}
+		if _, err := ix.Rename(mkey, s.Name+".renamed"); err != nil {
+			t.Fatalf("unexpected error renaming %s: %s", mkey, err)
+		}
+	}
+	if ix.pending != 0 {
+		t.Fatalf("expected no pending saves after stop, got %d", ix.pending)
+	}
 }
 
 func TestFind(t *testing.T) {
@@ -614,7 +740,7 @@ func TestPruneStaleOnLoad(t *testing.T) {
 	})
 
 	idx := &CasIdx{}
-	defs := idx.load(nil, &iter, now)
+	defs, _ := idx.load(nil, &iter, now)
 
 	exp := []schema.MKey{
 		test.GetMKey(1),
@@ -695,7 +821,7 @@ func TestPruneStaleOnLoadWithTags(t *testing.T) {
 	})
 
 	idx := &CasIdx{}
-	defs := idx.load(nil, &iter, now)
+	defs, _ := idx.load(nil, &iter, now)
 	exp := []schema.MKey{
 		test.GetMKey(1),
 		test.GetMKey(2),
@@ -724,3 +850,277 @@ func (m MKeyAsc) Less(i, j int) bool {
 	}
 	return false
 }
+
+func TestPruneStopsOnShutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		ix := New(CliConfig)
+		ix.wg.Add(1)
+		go ix.prune()
+		close(ix.shutdown)
+		ix.wg.Wait()
+	}
+
+	// goroutines that just signalled the waitgroup may not have fully exited yet
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("expected goroutine count to return to %d after stopping the prune routines, got %d", before, after)
+	}
+}
+
+func TestRetryLoad(t *testing.T) {
+	defer func(attempts int, backoff time.Duration) {
+		loadAttempts = attempts
+		loadBackoff = backoff
+	}(loadAttempts, loadBackoff)
+	loadAttempts = 3
+	loadBackoff = time.Millisecond
+
+	exp := []schema.MetricDefinition{{Name: "a"}}
+	failures := 2
+	calls := 0
+	load := func() ([]schema.MetricDefinition, error) {
+		calls++
+		if calls <= failures {
+			// a failed attempt may have read some defs already, which must not leak into the result
+			return []schema.MetricDefinition{{Name: "partial"}}, fmt.Errorf("attempt %d failed", calls)
+		}
+		return exp, nil
+	}
+
+	defs, err := retryLoad(load)
+	if err != nil {
+		t.Fatalf("expected load to succeed on attempt 3, got %s", err)
+	}
+	if calls != 3 || !reflect.DeepEqual(defs, exp) {
+		t.Fatalf("expected %v after 3 calls, got %v after %d calls", exp, defs, calls)
+	}
+
+	failures = 3
+	calls = 0
+	defs, err = retryLoad(load)
+	if err == nil {
+		t.Fatalf("expected an error after exhausting all attempts")
+	}
+	if calls != 3 || defs != nil {
+		t.Fatalf("expected no defs after 3 calls, got %v after %d calls", defs, calls)
+	}
+}
+
+func TestLoadCheckpoint(t *testing.T) {
+	defer func(rules conf.IndexRules) { memory.IndexRules = rules }(memory.IndexRules)
+	memory.IndexRules = conf.NewIndexRules()
+
+	var pages [][]cassRow
+	var ids []string
+	for p, mds := range [][]*schema.MetricData{getMetricData(1, 2, 3, 10, "metric.a"), getMetricData(1, 2, 3, 10, "metric.b"), getMetricData(1, 2, 2, 10, "metric.c")} {
+		var page []cassRow
+		for _, md := range mds {
+			page = append(page, cassRow{id: md.Id, orgId: 1, partition: int32(p), name: md.Name, interval: md.Interval, lastUpdate: time.Now().Unix()})
+			ids = append(ids, md.Id)
+		}
+		pages = append(pages, page)
+	}
+	sort.Strings(ids)
+	loaded := func(cp *loadCheckpoint) []string {
+		var got []string
+		for _, def := range cp.defs(nil, time.Now()) {
+			got = append(got, def.Id.String())
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	// fail halfway through the second page: only the first page is kept, and the next read resumes at the second one
+	cp := newLoadCheckpoint()
+	if err := cp.read(newPagedTestIterator(pages, cp.pageState, 4)); err == nil {
+		t.Fatalf("expected the first read to fail")
+	}
+	if cp.rows != 3 || !reflect.DeepEqual(cp.pageState, []byte{1}) {
+		t.Fatalf("expected 3 rows and paging state of page 1, got %d rows and paging state %v", cp.rows, cp.pageState)
+	}
+
+	// fail halfway through the third page: the second page is kept
+	if err := cp.read(newPagedTestIterator(pages, cp.pageState, 4)); err == nil {
+		t.Fatalf("expected the second read to fail")
+	}
+	if cp.rows != 6 || !reflect.DeepEqual(cp.pageState, []byte{2}) {
+		t.Fatalf("expected 6 rows and paging state of page 2, got %d rows and paging state %v", cp.rows, cp.pageState)
+	}
+
+	if err := cp.read(newPagedTestIterator(pages, cp.pageState, 0)); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if cp.pageState != nil {
+		t.Fatalf("expected no paging state after a complete read, got %v", cp.pageState)
+	}
+	if got := loaded(cp); !reflect.DeepEqual(got, ids) {
+		t.Fatalf("expected every def to be loaded exactly once: expected %v, got %v", ids, got)
+	}
+
+	// iterators that aren't paged are read as a single page
+	cp = newLoadCheckpoint()
+	iter := &testIterator{rows: pages[0]}
+	if err := cp.read(iter); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if cp.rows != 3 || cp.pageState != nil {
+		t.Fatalf("expected 3 rows and no paging state, got %d rows and paging state %v", cp.rows, cp.pageState)
+	}
+
+	cp.reset()
+	if cp.rows != 0 || cp.pageState != nil || len(cp.defsByNames) != 0 {
+		t.Fatalf("expected an empty checkpoint after reset, got %d rows and paging state %v", cp.rows, cp.pageState)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	defer func(rules conf.IndexRules) { memory.IndexRules = rules }(memory.IndexRules)
+	memory.IndexRules = conf.NewIndexRules()
+
+	ix := New(CliConfig)
+	initForTests(ix)
+	data := getMetricData(1, 2, 4, 10, "metric.demo")
+	for _, md := range data[:3] {
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.MemoryIndex.AddOrUpdate(mkey, md, 1)
+	}
+	rows := func() *testIterator {
+		iter := &testIterator{}
+		for _, md := range data[1:] {
+			iter.rows = append(iter.rows, cassRow{id: md.Id, orgId: 1, partition: 1, name: md.Name, interval: md.Interval, lastUpdate: time.Now().Unix()})
+		}
+		return iter
+	}
+
+	missing, extra, err := ix.audit(context.Background(), rows(), time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !reflect.DeepEqual(missing, []string{data[3].Id}) {
+		t.Errorf("expected missing %v, got %v", []string{data[3].Id}, missing)
+	}
+	if !reflect.DeepEqual(extra, []string{data[0].Id}) {
+		t.Errorf("expected extra %v, got %v", []string{data[0].Id}, extra)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = ix.audit(ctx, rows(), time.Now())
+	if err == nil {
+		t.Fatalf("expected an error for a canceled audit")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	ix := New(CliConfig)
+	initForTests(ix)
+	md := getMetricData(1, 2, 1, 10, "metric.demo")[0]
+	md.Time = 1000
+	mkey, _ := schema.MKeyFromString(md.Id)
+	ix.MemoryIndex.AddOrUpdate(mkey, md, 1)
+
+	// the unit was corrected in cassandra, which has an older lastUpdate than the memory index
+	iter := &testIterator{rows: []cassRow{{id: md.Id, orgId: 1, partition: 1, name: md.Name, interval: md.Interval, unit: "ms", lastUpdate: 500}}}
+	archive, err := ix.refresh(mkey, iter)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if archive.Unit != "ms" || archive.LastUpdate != 1000 {
+		t.Fatalf("expected unit ms and lastUpdate 1000, got %v", archive)
+	}
+	if got, _ := ix.Get(mkey); got.Unit != "ms" {
+		t.Fatalf("expected the memory index to have unit ms, got %v", got)
+	}
+	if nodes, _ := ix.Find(1, md.Name, 0); len(nodes) != 1 || len(nodes[0].Defs) != 1 {
+		t.Fatalf("expected to find the refreshed def once, got %v", nodes)
+	}
+
+	if _, err := ix.refresh(mkey, &testIterator{}); err == nil {
+		t.Fatalf("expected an error for a def that is not in cassandra")
+	}
+}
+
+func TestReadThrough(t *testing.T) {
+	ix := New(CliConfig)
+	initForTests(ix)
+	md := getMetricData(1, 2, 1, 10, "metric.demo")[0]
+	mkey, _ := schema.MKeyFromString(md.Id)
+	lastUpdate := time.Now().Unix()
+
+	var queries int32
+	release := make(chan struct{})
+	query := func() cqlIterator {
+		atomic.AddInt32(&queries, 1)
+		<-release
+		return &testIterator{rows: []cassRow{{id: md.Id, orgId: 1, partition: 1, name: md.Name, interval: md.Interval, lastUpdate: lastUpdate}}}
+	}
+
+	var wg sync.WaitGroup
+	results := make([]bool, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			_, results[i] = ix.readThrough(mkey, query)
+			wg.Done()
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+
+	if queries != 1 {
+		t.Fatalf("expected 1 lookup in cassandra, got %d", queries)
+	}
+	for i, ok := range results {
+		if !ok {
+			t.Fatalf("read-through %d: expected to find the def", i)
+		}
+	}
+	if archive, ok := ix.MemoryIndex.Get(mkey); !ok || archive.Name != md.Name || archive.LastUpdate != lastUpdate {
+		t.Fatalf("expected the def to be loaded into the memory index, got %v", archive)
+	}
+
+	other := getMetricData(1, 2, 1, 10, "metric.other")[0]
+	otherKey, _ := schema.MKeyFromString(other.Id)
+	if _, ok := ix.readThrough(otherKey, func() cqlIterator { return &testIterator{} }); ok {
+		t.Fatalf("expected not to find a def that is not in cassandra")
+	}
+}
+
+func TestReadThroughMissCache(t *testing.T) {
+	originalReadThrough := CliConfig.readThrough
+	defer func() { CliConfig.readThrough = originalReadThrough }()
+	CliConfig.readThrough = true
+
+	ix := New(CliConfig)
+	initForTests(ix)
+	defer ix.MemoryIndex.Stop()
+	md := getMetricData(1, 2, 1, 10, "metric.unknown")[0]
+	mkey, _ := schema.MKeyFromString(md.Id)
+
+	var queries int
+	query := func() cqlIterator {
+		queries++
+		return &testIterator{}
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := ix.readThrough(mkey, query); ok {
+			t.Fatalf("expected not to find a def that is not in cassandra")
+		}
+	}
+	if queries != 1 {
+		t.Fatalf("expected the def that was not found to be looked up in cassandra once, got %d lookups", queries)
+	}
+
+	// once added, the def must not be considered missing anymore, e.g. after it is evicted from memory
+	ix.AddOrUpdate(mkey, md, 1)
+	ix.MemoryIndex.DeleteById(mkey)
+	ix.readThrough(mkey, query)
+	if queries != 2 {
+		t.Fatalf("expected the def to be looked up in cassandra again after it was added, got %d lookups", queries)
+	}
+}
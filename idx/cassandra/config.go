@@ -39,6 +39,12 @@ type IdxConfig struct {
 	numConns                 int
 	protoVer                 int
 	disableInitialHostLookup bool
+	compression              bool
+	loadPageSize             int
+	loadHosts                string
+	readThrough              bool
+	readThroughMissTTL       time.Duration
+	readThroughMissSize      int
 }
 
 // NewIdxConfig returns IdxConfig with default values set.
@@ -58,23 +64,36 @@ func NewIdxConfig() *IdxConfig {
 		createKeyspace:           true,
 		schemaFile:               "/etc/metrictank/schema-idx-cassandra.toml",
 		disableInitialHostLookup: false,
+		compression:              false,
 		ssl:                      false,
 		capath:                   "/etc/metrictank/ca.pem",
 		hostverification:         true,
 		auth:                     false,
 		username:                 "cassandra",
 		password:                 "cassandra",
+		loadPageSize:             5000,
+		readThroughMissTTL:       time.Minute,
+		readThroughMissSize:      10000,
 	}
 }
 
 // Validate validates IdxConfig settings
 func (cfg *IdxConfig) Validate() error {
-	if cfg.pruneInterval == 0 {
+	if cfg.pruneInterval <= 0 {
 		return errors.New("pruneInterval must be greater then 0. " + timeUnits)
 	}
+	if cfg.updateInterval < 0 {
+		return errors.New("updateInterval must not be negative. " + timeUnits)
+	}
 	if cfg.timeout == 0 {
 		return errors.New("timeout must be greater than 0. " + timeUnits)
 	}
+	if cfg.loadPageSize < 1 {
+		return errors.New("load-page-size must be at least 1")
+	}
+	if cfg.readThroughMissSize < 1 {
+		return errors.New("read-through-miss-size must be at least 1")
+	}
 	return nil
 }
 
@@ -84,6 +103,7 @@ func ConfigSetup() *flag.FlagSet {
 
 	casIdx.BoolVar(&CliConfig.Enabled, "enabled", CliConfig.Enabled, "")
 	casIdx.StringVar(&CliConfig.hosts, "hosts", CliConfig.hosts, "comma separated list of cassandra addresses in host:port form")
+	casIdx.StringVar(&CliConfig.loadHosts, "load-hosts", CliConfig.loadHosts, "comma separated list of cassandra addresses in host:port form to load the index from, e.g. a read-only replica datacenter. writes always go to the hosts, which are also used for loading if this is empty or loading from these hosts fails")
 	casIdx.StringVar(&CliConfig.keyspace, "keyspace", CliConfig.keyspace, "Cassandra keyspace to store metricDefinitions in.")
 	casIdx.StringVar(&CliConfig.consistency, "consistency", CliConfig.consistency, "write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
 	casIdx.DurationVar(&CliConfig.timeout, "timeout", CliConfig.timeout, "cassandra request timeout")
@@ -91,11 +111,16 @@ func ConfigSetup() *flag.FlagSet {
 	casIdx.IntVar(&CliConfig.writeQueueSize, "write-queue-size", CliConfig.writeQueueSize, "Max number of metricDefs allowed to be unwritten to cassandra")
 	casIdx.BoolVar(&CliConfig.updateCassIdx, "update-cassandra-index", CliConfig.updateCassIdx, "synchronize index changes to cassandra. not all your nodes need to do this.")
 	casIdx.DurationVar(&CliConfig.updateInterval, "update-interval", CliConfig.updateInterval, "frequency at which we should update the metricDef lastUpdate field, use 0s for instant updates")
-	casIdx.DurationVar(&CliConfig.pruneInterval, "prune-interval", CliConfig.pruneInterval, "Interval at which the index should be checked for stale series.")
+	casIdx.DurationVar(&CliConfig.pruneInterval, "prune-interval", CliConfig.pruneInterval, "Interval at which the index should be checked for stale series (randomly adjusted by up to 10% every time, so instances don't all prune at once).")
 	casIdx.IntVar(&CliConfig.protoVer, "protocol-version", CliConfig.protoVer, "cql protocol version to use")
 	casIdx.BoolVar(&CliConfig.createKeyspace, "create-keyspace", CliConfig.createKeyspace, "enable the creation of the index keyspace and tables, only one node needs this")
 	casIdx.StringVar(&CliConfig.schemaFile, "schema-file", CliConfig.schemaFile, "File containing the needed schemas in case database needs initializing")
 	casIdx.BoolVar(&CliConfig.disableInitialHostLookup, "disable-initial-host-lookup", CliConfig.disableInitialHostLookup, "instruct the driver to not attempt to get host info from the system.peers table")
+	casIdx.BoolVar(&CliConfig.compression, "compression", CliConfig.compression, "compress the traffic with cassandra using snappy. trades cpu for network bandwidth, which mostly helps loading large indexes")
+	casIdx.IntVar(&CliConfig.loadPageSize, "load-page-size", CliConfig.loadPageSize, "number of metricDefs to fetch per page when loading the index. larger pages need fewer roundtrips to cassandra, but more memory to hold each page")
+	casIdx.BoolVar(&CliConfig.readThrough, "read-through", CliConfig.readThrough, "when a def is requested that is not in the memory index, e.g. because it was evicted due to memory-idx.max-series, look it up in cassandra and add it to the memory index")
+	casIdx.DurationVar(&CliConfig.readThroughMissTTL, "read-through-miss-ttl", CliConfig.readThroughMissTTL, "how long read-through remembers defs it didn't find in cassandra, so that repeated gets of an unknown id don't query cassandra every time. defs added to this instance are looked up right away. 0 to disable")
+	casIdx.IntVar(&CliConfig.readThroughMissSize, "read-through-miss-size", CliConfig.readThroughMissSize, "maximum number of defs remembered for read-through-miss-ttl")
 	casIdx.BoolVar(&CliConfig.ssl, "ssl", CliConfig.ssl, "enable SSL connection to cassandra")
 	casIdx.StringVar(&CliConfig.capath, "ca-path", CliConfig.capath, "cassandra CA certficate path when using SSL")
 	casIdx.BoolVar(&CliConfig.hostverification, "host-verification", CliConfig.hostverification, "host (hostname and server cert) verification when using SSL")
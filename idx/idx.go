@@ -3,13 +3,33 @@
 package idx
 
 import (
+	"context"
 	"time"
 
 	"github.com/raintank/schema"
 )
 
+// OrgIdPublic is the org whose metricDefinitions are visible to all orgs.
+// 0 means there is no public org.
 var OrgIdPublic = uint32(0)
 
+// OrgIdStoredPublic is the org id with which backend stores may have persisted metricDefinitions
+// of the public org. They are loaded as belonging to OrgIdPublic, whatever it is configured to.
+const OrgIdStoredPublic = -1
+
+// ValidOrgId returns whether metricDefinitions can be added or queried for the given org.
+// Org 0 is never valid: it is what requests without an org default to, and it is
+// not the public org, even when OrgIdPublic is 0 (disabled).
+func ValidOrgId(orgId uint32) bool {
+	return orgId != 0
+}
+
+// VisibleTo returns whether metricDefinitions of org defOrgId are visible to org orgId,
+// which is the case if they belong to it, or to the public org if there is one.
+func VisibleTo(defOrgId, orgId uint32) bool {
+	return defOrgId == orgId || (OrgIdPublic != 0 && defOrgId == OrgIdPublic)
+}
+
 //go:generate msgp
 type Node struct {
 	Path        string
@@ -24,6 +44,16 @@ type Archive struct {
 	AggId    uint16 // index in mdata.aggregations (not persisted)
 	IrId     uint16 // index in mdata.indexrules (not persisted)
 	LastSave uint32 // last time the metricDefinition was saved to a backend store (cassandra)
+	// number of points seen for the metricDefinition since it was added to this instance's index (not persisted).
+	// 0 means it was loaded from a backend store, and we don't know how many points were seen.
+	Observations uint32
+}
+
+// IntervalProvisional returns whether the Interval of the metricDefinition is based on a single point.
+// With only one point seen, the interval is just what the sender claimed, rather than one confirmed by a series of points.
+// metricDefinitions loaded from a backend store are not provisional, since they were persisted by an instance that received their data.
+func (a Archive) IntervalProvisional() bool {
+	return a.Observations == 1
 }
 
 // used primarily by tests, for convenience
@@ -79,7 +109,12 @@ type MetricIndex interface {
 	// * from is a unix timestamp. series not updated since then are excluded.
 	Find(orgId uint32, pattern string, from int64) ([]Node, error)
 
-	// List returns all Archives for the passed OrgId and the public orgId
+	// FindContext is like Find, but gives up once ctx is done, returning an error and no nodes.
+	// This bounds the time expensive patterns can take.
+	FindContext(ctx context.Context, orgId uint32, pattern string, from int64) ([]Node, error)
+
+	// List returns all Archives for the passed OrgId and the public orgId.
+	// They are in no particular order, which may differ between calls.
 	List(orgId uint32) []Archive
 
 	// Prune deletes all metrics that haven't been seen since the given timestamp.
@@ -54,6 +54,12 @@ func (z *Archive) DecodeMsg(dc *msgp.Reader) (err error) {
 				err = msgp.WrapError(err, "LastSave")
 				return
 			}
+		case "Observations":
+			z.Observations, err = dc.ReadUint32()
+			if err != nil {
+				err = msgp.WrapError(err, "Observations")
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -67,9 +73,9 @@ func (z *Archive) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *Archive) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 5
+	// map header, size 6
 	// write "MetricDefinition"
-	err = en.Append(0x85, 0xb0, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x44, 0x65, 0x66, 0x69, 0x6e, 0x69, 0x74, 0x69, 0x6f, 0x6e)
+	err = en.Append(0x86, 0xb0, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x44, 0x65, 0x66, 0x69, 0x6e, 0x69, 0x74, 0x69, 0x6f, 0x6e)
 	if err != nil {
 		return
 	}
@@ -118,15 +124,25 @@ func (z *Archive) EncodeMsg(en *msgp.Writer) (err error) {
 		err = msgp.WrapError(err, "LastSave")
 		return
 	}
+	// write "Observations"
+	err = en.Append(0xac, 0x4f, 0x62, 0x73, 0x65, 0x72, 0x76, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint32(z.Observations)
+	if err != nil {
+		err = msgp.WrapError(err, "Observations")
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *Archive) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 5
+	// map header, size 6
 	// string "MetricDefinition"
-	o = append(o, 0x85, 0xb0, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x44, 0x65, 0x66, 0x69, 0x6e, 0x69, 0x74, 0x69, 0x6f, 0x6e)
+	o = append(o, 0x86, 0xb0, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x44, 0x65, 0x66, 0x69, 0x6e, 0x69, 0x74, 0x69, 0x6f, 0x6e)
 	o, err = z.MetricDefinition.MarshalMsg(o)
 	if err != nil {
 		err = msgp.WrapError(err, "MetricDefinition")
@@ -144,6 +160,9 @@ func (z *Archive) MarshalMsg(b []byte) (o []byte, err error) {
 	// string "LastSave"
 	o = append(o, 0xa8, 0x4c, 0x61, 0x73, 0x74, 0x53, 0x61, 0x76, 0x65)
 	o = msgp.AppendUint32(o, z.LastSave)
+	// string "Observations"
+	o = append(o, 0xac, 0x4f, 0x62, 0x73, 0x65, 0x72, 0x76, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73)
+	o = msgp.AppendUint32(o, z.Observations)
 	return
 }
 
@@ -195,6 +214,12 @@ func (z *Archive) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				err = msgp.WrapError(err, "LastSave")
 				return
 			}
+		case "Observations":
+			z.Observations, bts, err = msgp.ReadUint32Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Observations")
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -209,7 +234,7 @@ func (z *Archive) UnmarshalMsg(bts []byte) (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *Archive) Msgsize() (s int) {
-	s = 1 + 17 + z.MetricDefinition.Msgsize() + 9 + msgp.Uint16Size + 6 + msgp.Uint16Size + 5 + msgp.Uint16Size + 9 + msgp.Uint32Size
+	s = 1 + 17 + z.MetricDefinition.Msgsize() + 9 + msgp.Uint16Size + 6 + msgp.Uint16Size + 5 + msgp.Uint16Size + 9 + msgp.Uint32Size + 13 + msgp.Uint32Size
 	return
 }
 
@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+// corpusPatterns are sample find patterns for the corpus, from very to hardly selective
+var corpusPatterns = []string{
+	"collectd.dc2.host7.cpu.0.idle",
+	"collectd.dc2.host7.cpu.*.idle",
+	"collectd.dc2.host1*.disk.disk0.disk_ops.*",
+	"collectd.{dc1,dc2}.host2.cpu.[0-1].{user,system}",
+	"collectd.*.host12.disk.*.disk_time.read",
+	"collectd.dc4.*.cpu.3.w*",
+	"collectd.dc0.host0.*",
+	"*.*.host3?.*.*.*",
+}
+
+// corpus returns n synthetic series, shaped like collectd's cpu and disk metrics (see cpuMetrics and diskMetrics).
+// Hosts are added until there are n series. Every host has 4 cpus and 2 disks, so 48 series,
+// and host h is in datacenter dc<h%5>. Series of the same host are adjacent, so any n gives a realistic mix.
+func corpus(n int) []metric {
+	series := make([]metric, 0, n+48)
+	for host := 0; len(series) < n; host++ {
+		hostSeries := append(cpuMetrics(1, 1, host, 4, "collectd"), diskMetrics(1, 1, host, 2, "collectd")...)
+		// for a single datacenter, cpuMetrics and diskMetrics generate dc0
+		dc := "dc" + strconv.Itoa(host%5)
+		for _, s := range hostSeries {
+			s.Name = "collectd." + dc + s.Name[len("collectd.dc0"):]
+			for i, tag := range s.Tags {
+				if tag == "dc=dc0" {
+					s.Tags[i] = "dc=" + dc
+				}
+			}
+			series = append(series, s)
+		}
+	}
+	return series[:n]
+}
+
+// newCorpusIndex adds the series of corpus(n) to ix for org 1, spread over the given number of partitions,
+// and returns their keys in corpus order. With tags, the series are tagged, so with TagSupport they
+// only go into the tag index. Without tags, they all go into the tree, which is what finds search.
+// It is meant for benchmarks, to share a realistic index.
+func newCorpusIndex(ix MemoryIndex, n, partitions int, tags bool) []schema.MKey {
+	mkeys := make([]schema.MKey, 0, n)
+	for i, series := range corpus(n) {
+		md := &schema.MetricData{Name: series.Name, OrgId: 1, Interval: 10, Time: int64(i + 100)}
+		if tags {
+			md.Tags = series.Tags
+		}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, int32(i%partitions))
+		mkeys = append(mkeys, mkey)
+	}
+	return mkeys
+}
+
+func TestCorpus(t *testing.T) {
+	for _, n := range []int{1, 47, 48, 49, 10000} {
+		if series := corpus(n); len(series) != n {
+			t.Fatalf("expected %d series, got %d", n, len(series))
+		}
+	}
+
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+	mkeys := newCorpusIndex(ix, 10000, 1, false)
+	if len(mkeys) != 10000 || ix.CountAll() != 10000 {
+		t.Fatalf("expected 10000 unique series, got %d keys and %d defs", len(mkeys), ix.CountAll())
+	}
+	for _, pattern := range corpusPatterns {
+		nodes, err := ix.Find(1, pattern, 0)
+		if err != nil || len(nodes) == 0 {
+			t.Errorf("pattern %q: expected matches, got %d (error %v)", pattern, len(nodes), err)
+		}
+	}
+}
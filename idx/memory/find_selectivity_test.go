@@ -0,0 +1,32 @@
+//go:build go1.13
+// +build go1.13
+
+package memory
+
+import (
+	"testing"
+)
+
+// BenchmarkFindSelectivity reports, besides the usual timings, how many tree nodes the corpus patterns
+// match against for every node they return.
+// the corpus is loaded without tags, so that all series go into the tree.
+// it needs b.ReportMetric, hence go1.13.
+func BenchmarkFindSelectivity(b *testing.B) {
+	index := New()
+	index.Init()
+	defer index.Stop()
+	newCorpusIndex(index, 100000, 1, false)
+
+	candidates, results := statFindCandidates.Peek(), statFindResults.Peek()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := index.Find(1, corpusPatterns[n%len(corpusPatterns)], 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if found := statFindResults.Peek() - results; found > 0 {
+		b.ReportMetric(float64(statFindCandidates.Peek()-candidates)/float64(found), "candidates/result")
+	}
+}
@@ -0,0 +1,153 @@
+//go:build go1.18
+// +build go1.18
+
+package memory
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// FuzzMatch checks that Match never panics, and that it agrees with refMatch,
+// a straightforward implementation of graphite's matching of a single node.
+func FuzzMatch(f *testing.F) {
+	for _, seed := range []struct {
+		pattern string
+		name    string
+	}{
+		{"*", "abc"},
+		{"a?c", "abc"},
+		{"a*c", "abbbc"},
+		{"{a,b}", "b"},
+		{"{a,{b,c}}", "c"},
+		{"{{a,b},{c,d}}x", "dx"},
+		{"{a,}", ""},
+		{"{}", ""},
+		{"a{}b", "ab"},
+		{"{a,b", "{a,b"},
+		{"a}", "a}"},
+		{"}{", "}{"},
+		{"[abc]", "b"},
+		{"[a-c]x", "bx"},
+		{"[!a-c]", "d"},
+		{"[]]", "]"},
+		{"[!]]", "a"},
+		{"[]a]", "a"},
+		{"[]", "[]"},
+		{"[!]", "[!]"},
+		{"[ab", "[ab"},
+		{"[a-]", "-"},
+		{"[\\]", "\\"},
+		{"a\\.b", "a\\"},
+		{"a+b(c)", "a+b(c)"},
+		{"^$", "^$"},
+		{"{a*,*b}", "xb"},
+		{"*[0-9]?", "x1y"},
+	} {
+		f.Add(seed.pattern, seed.name)
+	}
+	f.Fuzz(func(t *testing.T, pattern, name string) {
+		ok, err := Match(pattern, name)
+		if err != nil {
+			return
+		}
+		// the reference implementation works on single, valid utf-8 nodes
+		if strings.Contains(pattern, ".") || strings.Contains(name, ".") || !utf8.ValidString(pattern) || !utf8.ValidString(name) {
+			return
+		}
+		if exp := refMatch(pattern, name); ok != exp {
+			t.Fatalf("pattern %q, name %q: expected match %t, got %t", pattern, name, exp, ok)
+		}
+	})
+}
+
+// refMatch returns whether name matches the graphite pattern for a single node
+func refMatch(pattern, name string) bool {
+	for _, p := range refExpand(pattern) {
+		if refGlob([]rune(p), []rune(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// refExpand expands the innermost braces of the pattern, until there are none left
+func refExpand(pattern string) []string {
+	end := strings.Index(pattern, "}")
+	for end > -1 {
+		start := strings.LastIndex(pattern[:end], "{")
+		if start > -1 {
+			var expanded []string
+			for _, option := range strings.Split(pattern[start+1:end], ",") {
+				expanded = append(expanded, refExpand(pattern[:start]+option+pattern[end+1:])...)
+			}
+			return expanded
+		}
+		// a } without a { before it is literal, look for the next one
+		next := strings.Index(pattern[end+1:], "}")
+		if next == -1 {
+			break
+		}
+		end += next + 1
+	}
+	return []string{pattern}
+}
+
+// refGlob matches like fnmatch: * matches any runes, ? one rune, and [...] or [!...] one rune of a class
+func refGlob(pattern, name []rune) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(name); i++ {
+			if refGlob(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return len(name) > 0 && refGlob(pattern[1:], name[1:])
+	case '[':
+		start := 1
+		negate := start < len(pattern) && pattern[start] == '!'
+		if negate {
+			start++
+		}
+		end := start
+		if end < len(pattern) && pattern[end] == ']' {
+			end++
+		}
+		for end < len(pattern) && pattern[end] != ']' {
+			end++
+		}
+		if end == len(pattern) {
+			// no class, so the rest of the pattern is literal
+			return string(pattern) == string(name)
+		}
+		if len(name) == 0 || refInClass(pattern[start:end], name[0]) == negate {
+			return false
+		}
+		return refGlob(pattern[end+1:], name[1:])
+	default:
+		return len(name) > 0 && pattern[0] == name[0] && refGlob(pattern[1:], name[1:])
+	}
+}
+
+// refInClass returns whether r is in the class, which consists of single runes and ranges like a-z
+func refInClass(class []rune, r rune) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= r && r <= class[i+2] {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if class[i] == r {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,11 @@
 package memory
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"regexp"
 	"sort"
@@ -10,6 +13,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/grafana/globalconf"
 	"github.com/grafana/metrictank/conf"
@@ -28,18 +32,43 @@ var (
 	statAdd = stats.NewCounter32("idx.memory.ops.add")
 	// metric idx.memory.add is the duration of a (successful) add of a metric to the memory idx
 	statAddDuration = stats.NewLatencyHistogram15s32("idx.memory.add")
+	// metric idx.memory.add-many is the duration of adding or updating a batch of metrics in the memory idx
+	statAddManyDuration = stats.NewLatencyHistogram15s32("idx.memory.add-many")
 	// metric idx.memory.update is the duration of (successful) update of a metric to the memory idx
 	statUpdateDuration = stats.NewLatencyHistogram15s32("idx.memory.update")
 	// metric idx.memory.get is the duration of a get of one metric in the memory idx
 	statGetDuration = stats.NewLatencyHistogram15s32("idx.memory.get")
+	// metric idx.memory.get.hit is the number of gets of one metric in the memory idx that found it
+	statGetHit = stats.NewCounter32("idx.memory.get.hit")
+	// metric idx.memory.get.miss is the number of gets of one metric in the memory idx that didn't find it. a sustained high rate may mean unknown ids are being looked up
+	statGetMiss = stats.NewCounter32("idx.memory.get.miss")
+	// metric idx.memory.get.miss-cached is the number of gets of one metric in the memory idx that were answered by the negative cache (see memory-idx.miss-cache-ttl). they are also counted in idx.memory.get.miss
+	statGetMissCached = stats.NewCounter32("idx.memory.get.miss-cached")
 	// metric idx.memory.list is the duration of memory idx listings
 	statListDuration = stats.NewLatencyHistogram15s32("idx.memory.list")
 	// metric idx.memory.find is the duration of memory idx find
 	statFindDuration = stats.NewLatencyHistogram15s32("idx.memory.find")
+	// metric idx.memory.find.candidates is the number of tree nodes that memory idx finds matched against their patterns. compare to idx.memory.find.results for the selectivity of the tree
+	statFindCandidates = stats.NewCounter64("idx.memory.find.candidates")
+	// metric idx.memory.find.results is the number of tree nodes that memory idx finds matched
+	statFindResults = stats.NewCounter64("idx.memory.find.results")
+	// metric idx.memory.find.timeout is the number of memory idx finds that were aborted because their deadline passed
+	statFindTimeout = stats.NewCounter32("idx.memory.find.timeout")
+	// metric idx.memory.find.series is the number of series returned by memory idx finds
+	statFindSeries = stats.NewMeter32("idx.memory.find.series", true)
+	// metric idx.memory.find.broad is the number of memory idx finds that returned more series than memory-idx.find-broad-threshold. they are logged with their org and pattern
+	statFindBroad = stats.NewCounter32("idx.memory.find.broad")
 	// metric idx.memory.delete is the duration of a delete of one or more metrics from the memory idx
 	statDeleteDuration = stats.NewLatencyHistogram15s32("idx.memory.delete")
 	// metric idx.memory.prune is the duration of successful memory idx prunes
 	statPruneDuration = stats.NewLatencyHistogram15s32("idx.memory.prune")
+	// metric idx.memory.prune.lock is how long memory idx prunes hold the write lock at a time. the max shows the longest lock hold
+	statPruneLockDuration = stats.NewLatencyHistogram15s32("idx.memory.prune.lock")
+	// metric idx.memory.evicted is the number of series evicted from the memory idx because it exceeded memory-idx.max-series
+	statEvicted = stats.NewCounter32("idx.memory.evicted")
+
+	// metric idx.memory.load.duplicates is the number of defs that were loaded while already in the memory idx. the one with the newest lastUpdate is kept
+	statLoadDuplicates = stats.NewCounter32("idx.memory.load.duplicates")
 
 	// metric idx.memory.filtered is number of series that have been excluded from responses due to their lastUpdate property
 	statFiltered = stats.NewCounter32("idx.memory.filtered")
@@ -47,12 +76,37 @@ var (
 	// metric idx.metrics_active is the number of currently known metrics in the index
 	statMetricsActive = stats.NewGauge32("idx.metrics_active")
 
+	// metric idx.memory.tree.nodes is the number of nodes in the hierarchy trees of the memory idx, updated every minute
+	statTreeNodes = stats.NewGauge32("idx.memory.tree.nodes")
+	// metric idx.memory.tags.keys is the number of distinct tag keys in the tag index of the memory idx, updated every minute
+	statTagKeys = stats.NewGauge32("idx.memory.tags.keys")
+	// metric idx.memory.tags.values is the number of distinct tag key/value pairs in the tag index of the memory idx, updated every minute
+	statTagValues = stats.NewGauge32("idx.memory.tags.values")
+	// metric idx.memory.tags.entries is the number of ids referenced by the tag index of the memory idx, summed over all tag key/value pairs. updated every minute
+	statTagEntries = stats.NewGauge32("idx.memory.tags.entries")
+	// metric idx.memory.tags.bytes is the approximate amount of bytes held by the tag index of the memory idx (excluding map overhead), updated every minute
+	statTagBytes = stats.NewGauge64("idx.memory.tags.bytes")
+	// metric idx.memory.defs.age.p50 is the median time in seconds since the defs in the memory idx were last updated, rounded up to a bucket (see ageBuckets). updated every minute
+	statDefsAgeP50 = stats.NewGauge32("idx.memory.defs.age.p50")
+	// metric idx.memory.defs.age.p90 is the 90th percentile of the time in seconds since the defs in the memory idx were last updated, rounded up to a bucket. updated every minute
+	statDefsAgeP90 = stats.NewGauge32("idx.memory.defs.age.p90")
+	// metric idx.memory.defs.age.p99 is the 99th percentile of the time in seconds since the defs in the memory idx were last updated, rounded up to a bucket. updated every minute
+	statDefsAgeP99 = stats.NewGauge32("idx.memory.defs.age.p99")
+
 	Enabled             bool
+	Partitioned         bool
 	matchCacheSize      int
+	findCaseInsensitive bool
 	maxPruneLockTime    = time.Millisecond * 100
+	pruneChunkSize      = 1000 // how many tagged series prune deletes under a single lock
 	maxPruneLockTimeStr string
 	TagSupport          bool
-	TagQueryWorkers     int // number of workers to spin up when evaluation tag expressions
+	TagQueryWorkers     int           // number of workers to spin up when evaluation tag expressions
+	MaxSeries           int           // max number of series to keep in memory. 0 means no limit
+	findBroadThreshold  int           // number of series above which finds are considered too broad. 0 means no limit
+	missCacheTTL        time.Duration // how long gets remember that an id is missing. 0 disables the negative cache
+	missCacheSize       int           // max number of missing ids remembered
+	evictInterval       = 10 * time.Second
 	indexRulesFile      string
 	IndexRules          conf.IndexRules
 )
@@ -60,11 +114,17 @@ var (
 func ConfigSetup() {
 	memoryIdx := flag.NewFlagSet("memory-idx", flag.ExitOnError)
 	memoryIdx.BoolVar(&Enabled, "enabled", false, "")
+	memoryIdx.BoolVar(&Partitioned, "partitioned", false, "use a separately locked index per partition, to reduce lock contention between ingest and queries")
 	memoryIdx.BoolVar(&TagSupport, "tag-support", false, "enables/disables querying based on tags")
 	memoryIdx.IntVar(&TagQueryWorkers, "tag-query-workers", 50, "number of workers to spin up to evaluate tag queries")
 	memoryIdx.IntVar(&matchCacheSize, "match-cache-size", 1000, "size of regular expression cache in tag query evaluation")
+	memoryIdx.BoolVar(&findCaseInsensitive, "find-case-insensitive", false, "match graphite patterns of queries against metric names case-insensitively. deletes always match the exact case")
 	memoryIdx.StringVar(&indexRulesFile, "rules-file", "/etc/metrictank/index-rules.conf", "path to index-rules.conf file")
 	memoryIdx.StringVar(&maxPruneLockTimeStr, "max-prune-lock-time", "100ms", "Maximum duration each second a prune job can lock the index.")
+	memoryIdx.IntVar(&MaxSeries, "max-series", 0, "maximum number of series to keep in memory. when exceeded, the least recently updated series are evicted from memory, but not from a persistent index. 0 to disable")
+	memoryIdx.IntVar(&findBroadThreshold, "find-broad-threshold", 0, "number of series above which a find is considered too broad. such finds are counted in idx.memory.find.broad and logged with their org and pattern. 0 to disable")
+	memoryIdx.DurationVar(&missCacheTTL, "miss-cache-ttl", 0, "how long gets of an id that is not in the index remember it as missing, so that repeated gets of it don't need the index lock. adding the id ends this early. 0 to disable")
+	memoryIdx.IntVar(&missCacheSize, "miss-cache-size", 10000, "maximum number of missing ids remembered for miss-cache-ttl")
 	globalconf.Register("memory-idx", memoryIdx, flag.ExitOnError)
 }
 
@@ -74,8 +134,8 @@ func ConfigProcess() {
 	if err != nil {
 		log.Fatalf("could not parse max-prune-lock-time %q: %s", maxPruneLockTimeStr, err)
 	}
-	if maxPruneLockTime > time.Second {
-		log.Fatalf("invalid max-prune-lock-time of %s. Must be <= 1 second", maxPruneLockTimeStr)
+	if maxPruneLockTime <= 0 || maxPruneLockTime > time.Second {
+		log.Fatalf("invalid max-prune-lock-time of %s. Must be > 0 and <= 1 second", maxPruneLockTimeStr)
 	}
 	// read index-rules.conf
 	IndexRules, err = conf.ReadIndexRules(indexRulesFile)
@@ -201,6 +261,46 @@ func (n *Node) String() string {
 	return fmt.Sprintf("branch - %s", n.Path)
 }
 
+// MemoryIndex is the in-memory index, as used by itself or embedded by the persistent indexes.
+// It is implemented by MemoryIdx and PartitionedMemoryIdx
+type MemoryIndex interface {
+	idx.MetricIndex
+	AddOrUpdateMany(mkeys []schema.MKey, data []*schema.MetricData, partition int32) []AddOrUpdateResult
+	UpdateArchive(archive idx.Archive)
+	Replace(def schema.MetricDefinition) idx.Archive
+	Load(defs []schema.MetricDefinition) int
+	DeleteById(id schema.MKey) (idx.Archive, error)
+	DeleteOrg(orgId uint32) ([]idx.Archive, error)
+	Rename(id schema.MKey, newName string) (idx.Archive, error)
+	Ids() []schema.MKey
+	Count(orgId uint32) int
+	FindLimit(orgId uint32, pattern string, from int64, limit int) ([]idx.Node, bool, error)
+	IngestStats() map[uint32]OrgIngestCounts
+	ListFunc(orgId uint32, fn func(archive idx.Archive) bool) bool
+	OnNewSeries(fn func(def *schema.MetricDefinition))
+	GetMany(ids []schema.MKey) map[schema.MKey]idx.Archive
+	GetPaths(orgId uint32, paths []string) []idx.Archive
+	FindAllOrgs(pattern string, from int64) (map[uint32][]idx.Node, error)
+	FindFiltered(orgId uint32, pattern string, from int64, filters map[string]string) ([]idx.Node, error)
+	FindExcluding(orgId uint32, include, exclude string, from int64) ([]idx.Node, error)
+	ListSince(orgId uint32, since int64) []idx.Archive
+	ListSorted(orgId uint32) []idx.Archive
+	ListPrefix(orgId uint32, prefix string, offset, limit int) []idx.Archive
+	Walk(fn func(orgId uint32, id schema.MKey, name string) bool) bool
+	SnapshotDefs() ([]byte, error)
+	LoadDefsSnapshot(snap []byte) (int, error)
+	ExportJSON(w io.Writer) error
+	ImportJSON(r io.Reader) (int, error)
+}
+
+// NewIndex returns a PartitionedMemoryIdx if memory-idx.partitioned is enabled, a MemoryIdx otherwise
+func NewIndex() MemoryIndex {
+	if Partitioned {
+		return NewPartitionedMemoryIdx()
+	}
+	return New()
+}
+
 // Implements the the "MetricIndex" interface
 type MemoryIdx struct {
 	sync.RWMutex
@@ -208,6 +308,8 @@ type MemoryIdx struct {
 	// used for both hierarchy and tag index, so includes all MDs, with
 	// and without tags. It also mixes all orgs into one flat map.
 	defById map[schema.MKey]*idx.Archive
+	// number of defs in defById, by orgId. maintained by addDefById and deleteDefById
+	defCountByOrg map[uint32]int
 
 	// used by hierarchy index only
 	tree map[uint32]*Tree // by orgId
@@ -215,23 +317,179 @@ type MemoryIdx struct {
 	// used by tag index
 	defByTagSet defByTagSet
 	tags        map[uint32]TagIndex // by orgId
+
+	// per-org counts of created and refreshed defs
+	orgStats *OrgStats
+
+	// called for every series created by AddOrUpdate(Many), see OnNewSeries
+	onNewSeries func(def *schema.MetricDefinition)
+
+	// ids that Get recently didn't find. nil if memory-idx.miss-cache-ttl is 0
+	misses *MissCache
+
+	stopStats chan struct{}
 }
 
 func New() *MemoryIdx {
-	return &MemoryIdx{
-		defById:     make(map[schema.MKey]*idx.Archive),
-		defByTagSet: make(defByTagSet),
-		tree:        make(map[uint32]*Tree),
-		tags:        make(map[uint32]TagIndex),
-	}
+	m := &MemoryIdx{
+		defById:       make(map[schema.MKey]*idx.Archive),
+		defCountByOrg: make(map[uint32]int),
+		defByTagSet:   make(defByTagSet),
+		tree:          make(map[uint32]*Tree),
+		tags:          make(map[uint32]TagIndex),
+		orgStats:      NewOrgStats(),
+	}
+	if missCacheTTL > 0 {
+		m.misses = NewMissCache(missCacheTTL, missCacheSize)
+	}
+	return m
 }
 
 func (m *MemoryIdx) Init() error {
+	m.stopStats = make(chan struct{})
+	go reportStats(m.Stats, m.stopStats)
+	if MaxSeries > 0 {
+		go evictLoop(m.Evict, m.stopStats)
+	}
 	return nil
 }
 
 func (m *MemoryIdx) Stop() {
-	return
+	if m.stopStats != nil {
+		close(m.stopStats)
+		m.stopStats = nil
+	}
+}
+
+// IndexStats describes the size of the index
+type IndexStats struct {
+	TreeNodes  int // nodes in the hierarchy trees
+	TagKeys    int // distinct tag keys
+	TagValues  int // distinct tag key/value pairs
+	TagEntries int // ids referenced by the tag index, summed over all tag key/value pairs
+	TagBytes   int // approximate size of the strings and ids held by the tag index, excluding map overhead
+
+	// the number of defs by age (time since their lastUpdate): DefAges[i] counts the defs with an age
+	// up to ageBuckets[i], and not counted by earlier buckets. the last one counts all older defs.
+	DefAges [len(ageBuckets) + 1]int
+}
+
+// ageBuckets are the upper bounds, in seconds, of the buckets that IndexStats.DefAges counts defs in
+var ageBuckets = [...]int64{60, 600, 3600, 6 * 3600, 24 * 3600, 2 * 24 * 3600, 7 * 24 * 3600, 14 * 24 * 3600, 30 * 24 * 3600, 90 * 24 * 3600, 365 * 24 * 3600}
+
+// DefAgePercentile returns the age in seconds that p percent of the defs are younger than or equal to,
+// rounded up to the upper bound of its bucket. Defs older than the last bucket are reported as math.MaxInt32.
+// it returns 0 if there are no defs.
+func (s IndexStats) DefAgePercentile(p float64) int {
+	var total int
+	for _, n := range s.DefAges {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(total)))
+	var seen int
+	for i, n := range s.DefAges[:len(ageBuckets)] {
+		seen += n
+		if seen >= rank {
+			return int(ageBuckets[i])
+		}
+	}
+	return math.MaxInt32
+}
+
+// Stats returns the size of the index, across all orgs.
+// It walks the tag keys and values, but not their ids, and all defs once, so it is cheap enough to call periodically.
+func (m *MemoryIdx) Stats() IndexStats {
+	return m.stats(time.Now().Unix())
+}
+
+func (m *MemoryIdx) stats(now int64) IndexStats {
+	var s IndexStats
+	idSize := int(unsafe.Sizeof(schema.MKey{}))
+	m.RLock()
+	defer m.RUnlock()
+	for _, def := range m.defById {
+		age := now - atomic.LoadInt64(&def.LastUpdate)
+		i := sort.Search(len(ageBuckets), func(i int) bool { return ageBuckets[i] >= age })
+		s.DefAges[i]++
+	}
+	for _, tree := range m.tree {
+		s.TreeNodes += len(tree.Items)
+	}
+	for _, tags := range m.tags {
+		s.TagKeys += len(tags)
+		for key, values := range tags {
+			s.TagValues += len(values)
+			s.TagBytes += len(key)
+			for value, ids := range values {
+				s.TagEntries += len(ids)
+				s.TagBytes += len(value) + len(ids)*idSize
+			}
+		}
+	}
+	return s
+}
+
+// IngestStats returns, by orgId, how many defs have been created and how many have been
+// refreshed by incoming data via Update, AddOrUpdate and AddOrUpdateMany.
+// defs loaded at startup are not included.
+func (m *MemoryIdx) IngestStats() map[uint32]OrgIngestCounts {
+	return m.orgStats.Snapshot()
+}
+
+// reportStats updates the index size metrics every minute, until the index is stopped
+func reportStats(stats func() IndexStats, shutdown chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s := stats()
+			statTreeNodes.Set(s.TreeNodes)
+			statTagKeys.Set(s.TagKeys)
+			statTagValues.Set(s.TagValues)
+			statTagEntries.Set(s.TagEntries)
+			statTagBytes.Set(s.TagBytes)
+			statDefsAgeP50.Set(s.DefAgePercentile(50))
+			statDefsAgeP90.Set(s.DefAgePercentile(90))
+			statDefsAgeP99.Set(s.DefAgePercentile(99))
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// evictLoop evicts series beyond MaxSeries every evictInterval, until the index is stopped
+func evictLoop(evict func(max int) []idx.Archive, shutdown chan struct{}) {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			evicted := evict(MaxSeries)
+			if len(evicted) > 0 {
+				log.Infof("memory-idx: evicted %d least recently updated series to stay within max-series %d", len(evicted), MaxSeries)
+			}
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// evictCandidate is a series that may get evicted, along with the lastUpdate it had when it was chosen
+type evictCandidate struct {
+	id         schema.MKey
+	lastUpdate int64
+}
+
+// oldest returns the n least recently updated candidates
+func oldest(candidates []evictCandidate, n int) []evictCandidate {
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUpdate < candidates[j].lastUpdate
+	})
+	return candidates[:n]
 }
 
 // bumpLastUpdate increases lastUpdate.
@@ -261,20 +519,72 @@ func (m *MemoryIdx) Update(point schema.MetricPoint, partition int32) (idx.Archi
 		log.Debugf("memory-idx: metricDef with id %v already in index", point.MKey)
 
 		bumpLastUpdate(&existing.LastUpdate, int64(point.Time))
+		atomic.AddUint32(&existing.Observations, 1)
 
 		oldPart := atomic.SwapInt32(&existing.Partition, partition)
 		statUpdate.Inc()
+		m.orgStats.Refreshed(point.MKey)
 		statUpdateDuration.Value(time.Since(pre))
-		return *existing, oldPart, true
+		return copyArchive(existing), oldPart, true
 	}
 
 	return idx.Archive{}, 0, false
 }
 
+// copyArchive returns a copy of an archive while only the read lock is held.
+// Under the read lock, ingest updates lastUpdate, partition and observations atomically,
+// so they must be read atomically as well.
+func copyArchive(a *idx.Archive) idx.Archive {
+	return idx.Archive{
+		MetricDefinition: schema.MetricDefinition{
+			Id:         a.Id,
+			OrgId:      a.OrgId,
+			Name:       a.Name,
+			Interval:   a.Interval,
+			Unit:       a.Unit,
+			Mtype:      a.Mtype,
+			Tags:       a.Tags,
+			LastUpdate: atomic.LoadInt64(&a.LastUpdate),
+			Partition:  atomic.LoadInt32(&a.Partition),
+		},
+		SchemaId:     a.SchemaId,
+		AggId:        a.AggId,
+		IrId:         a.IrId,
+		LastSave:     a.LastSave,
+		Observations: atomic.LoadUint32(&a.Observations),
+	}
+}
+
 // AddOrUpdate returns the corresponding Archive for the MetricData.
 // if it is existing -> updates lastUpdate based on .Time, and partition
-// if was new        -> adds new MetricDefinition to index
+// if was new        -> adds new MetricDefinition to index, and calls the OnNewSeries hook
+// the MetricData must be valid (see MetricData.Validate), which among others means its org is valid (see idx.ValidOrgId).
+// it is not checked again here: the input handler validates every MetricData before indexing it,
+// and AddOrUpdate is on the ingest hot path and has no way to return an error.
 func (m *MemoryIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, partition int32) (idx.Archive, int32, bool) {
+	archive, oldPart, inMemory := m.addOrUpdate(mkey, data, partition)
+	if !inMemory {
+		m.newSeries(archive)
+	}
+	return archive, oldPart, inMemory
+}
+
+// OnNewSeries sets a hook that is called for every series that AddOrUpdate or AddOrUpdateMany create in the index,
+// i.e. the first time a series is seen (again after it was pruned or deleted), but not when defs are loaded
+// from a persistent store. It is called without holding any locks, but it runs on the ingest path,
+// so it must be fast and must not block. It is meant to be set once, before the index is used.
+func (m *MemoryIdx) OnNewSeries(fn func(def *schema.MetricDefinition)) {
+	m.onNewSeries = fn
+}
+
+// newSeries calls the OnNewSeries hook, if any, for a series that was just created
+func (m *MemoryIdx) newSeries(archive idx.Archive) {
+	if m.onNewSeries != nil {
+		m.onNewSeries(&archive.MetricDefinition)
+	}
+}
+
+func (m *MemoryIdx) addOrUpdate(mkey schema.MKey, data *schema.MetricData, partition int32) (idx.Archive, int32, bool) {
 	pre := time.Now()
 
 	// Optimistically read lock
@@ -284,21 +594,36 @@ func (m *MemoryIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, parti
 	if ok {
 		log.Debugf("memory-idx: metricDef with id %s already in index.", mkey)
 		bumpLastUpdate(&existing.LastUpdate, data.Time)
+		atomic.AddUint32(&existing.Observations, 1)
 		oldPart := atomic.SwapInt32(&existing.Partition, partition)
 		statUpdate.Inc()
+		m.orgStats.Refreshed(mkey)
 		statUpdateDuration.Value(time.Since(pre))
+		archive := copyArchive(existing)
 		m.RUnlock()
-		return *existing, oldPart, ok
+		return archive, oldPart, ok
 	}
 
 	m.RUnlock()
 	m.Lock()
 	defer m.Unlock()
 
+	// the metric may have been added since we released the read lock
+	if existing, ok := m.defById[mkey]; ok {
+		bumpLastUpdate(&existing.LastUpdate, data.Time)
+		atomic.AddUint32(&existing.Observations, 1)
+		oldPart := atomic.SwapInt32(&existing.Partition, partition)
+		statUpdate.Inc()
+		m.orgStats.Refreshed(mkey)
+		statUpdateDuration.Value(time.Since(pre))
+		return *existing, oldPart, true
+	}
+
 	def := schema.MetricDefinitionFromMetricData(data)
 	def.Partition = partition
-	archive := m.add(def)
+	archive := m.addObserved(def)
 	statMetricsActive.Inc()
+	m.orgStats.Added(mkey)
 	statAddDuration.Value(time.Since(pre))
 
 	if TagSupport {
@@ -308,6 +633,77 @@ func (m *MemoryIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, parti
 	return archive, 0, false
 }
 
+// AddOrUpdateResult describes what happened to a single metric in AddOrUpdateMany.
+// The fields correspond to the return values of AddOrUpdate.
+type AddOrUpdateResult struct {
+	Archive      idx.Archive
+	OldPartition int32
+	InMemory     bool
+}
+
+// AddOrUpdateMany is the batch equivalent of AddOrUpdate, including the calls to the OnNewSeries hook.
+// Rather than taking the locks for every metric, it takes the read lock once to update
+// all known metrics, and the write lock at most once to add all new ones. This reduces
+// lock churn when a burst of new series shows up, e.g. shortly after startup.
+// Metrics that occur more than once in the batch are only added once.
+// mkeys and data must have the same length; results are returned in the same order.
+func (m *MemoryIdx) AddOrUpdateMany(mkeys []schema.MKey, data []*schema.MetricData, partition int32) []AddOrUpdateResult {
+	pre := time.Now()
+	results := make([]AddOrUpdateResult, len(mkeys))
+	var missing []int
+
+	m.RLock()
+	for i, mkey := range mkeys {
+		existing, ok := m.defById[mkey]
+		if !ok {
+			missing = append(missing, i)
+			continue
+		}
+		bumpLastUpdate(&existing.LastUpdate, data[i].Time)
+		atomic.AddUint32(&existing.Observations, 1)
+		oldPart := atomic.SwapInt32(&existing.Partition, partition)
+		statUpdate.Inc()
+		m.orgStats.Refreshed(mkey)
+		results[i] = AddOrUpdateResult{copyArchive(existing), oldPart, true}
+	}
+	m.RUnlock()
+
+	if len(missing) > 0 {
+		m.Lock()
+		for _, i := range missing {
+			// the metric may have been added since we released the read lock,
+			// or it may occur more than once in this batch.
+			if existing, ok := m.defById[mkeys[i]]; ok {
+				bumpLastUpdate(&existing.LastUpdate, data[i].Time)
+				atomic.AddUint32(&existing.Observations, 1)
+				oldPart := atomic.SwapInt32(&existing.Partition, partition)
+				statUpdate.Inc()
+				m.orgStats.Refreshed(mkeys[i])
+				results[i] = AddOrUpdateResult{*existing, oldPart, true}
+				continue
+			}
+			def := schema.MetricDefinitionFromMetricData(data[i])
+			def.Partition = partition
+			results[i] = AddOrUpdateResult{Archive: m.addObserved(def)}
+			statMetricsActive.Inc()
+			m.orgStats.Added(mkeys[i])
+
+			if TagSupport {
+				m.indexTags(def)
+			}
+		}
+		m.Unlock()
+		for _, i := range missing {
+			if !results[i].InMemory {
+				m.newSeries(results[i].Archive)
+			}
+		}
+	}
+
+	statAddManyDuration.Value(time.Since(pre))
+	return results
+}
+
 // UpdateArchive updates the archive information
 func (m *MemoryIdx) UpdateArchive(archive idx.Archive) {
 	m.Lock()
@@ -318,6 +714,97 @@ func (m *MemoryIdx) UpdateArchive(archive idx.Archive) {
 	*(m.defById[archive.Id]) = archive
 }
 
+// Replace replaces the metricDefinition with the same id by def, re-indexing it, or adds def if it's not in the index yet.
+// This is meant for picking up corrections made to defs in a persistent store.
+// The lastUpdate in the index is kept if it is newer, as it is updated by incoming data.
+// It returns the resulting archive.
+func (m *MemoryIdx) Replace(def schema.MetricDefinition) idx.Archive {
+	m.Lock()
+	defer m.Unlock()
+	var observations uint32
+	if existing, ok := m.defById[def.Id]; ok {
+		if lastUpdate := atomic.LoadInt64(&existing.LastUpdate); lastUpdate > def.LastUpdate {
+			def.LastUpdate = lastUpdate
+		}
+		observations = atomic.LoadUint32(&existing.Observations)
+		m.deleteArchive(existing)
+	} else {
+		statMetricsActive.Inc()
+	}
+	m.add(&def)
+	if TagSupport {
+		m.indexTags(&def)
+	}
+	// like Load, as the def comes from a persistent store
+	m.defById[def.Id].LastSave = uint32(def.LastUpdate)
+	m.defById[def.Id].Observations = observations
+	return *m.defById[def.Id]
+}
+
+// Rename changes the name of the metricDefinition with the given id, e.g. to fix a typo in its path.
+// The id stays the same, so the data stored for it remains available under the new name.
+// As the id is no longer the one derived from the name, data sent with the old name keeps updating
+// the renamed metricDefinition, whereas data sent with the new name creates a new one.
+// It fails if the org already has a metricDefinition with the new name (and the same tags).
+func (m *MemoryIdx) Rename(id schema.MKey, newName string) (idx.Archive, error) {
+	if newName == "" {
+		return idx.Archive{}, errors.NewBadRequest("the new name can't be empty")
+	}
+	m.Lock()
+	defer m.Unlock()
+	existing, ok := m.defById[id]
+	if !ok {
+		return idx.Archive{}, errors.NewNotFound(fmt.Sprintf("metricDef %s not found in index", id))
+	}
+	def := renamed(&existing.MetricDefinition, newName)
+	if m.hasDefsWithName(&def) {
+		return idx.Archive{}, errors.NewBadRequest(fmt.Sprintf("can't rename metricDef %s: org %d already has a metric named %s", id, def.OrgId, def.NameWithTags()))
+	}
+
+	def.LastUpdate = atomic.LoadInt64(&existing.LastUpdate)
+	def.Partition = atomic.LoadInt32(&existing.Partition)
+	lastSave := existing.LastSave
+	observations := atomic.LoadUint32(&existing.Observations)
+	m.deleteArchive(existing)
+	m.add(&def)
+	if TagSupport {
+		m.indexTags(&def)
+	}
+	m.defById[id].LastSave = lastSave
+	m.defById[id].Observations = observations
+	return *m.defById[id], nil
+}
+
+// renamed returns a copy of the def with the given name
+func renamed(def *schema.MetricDefinition, name string) schema.MetricDefinition {
+	// we can't copy the def as a whole, as it caches its name with tags
+	return schema.MetricDefinition{
+		Id:         def.Id,
+		OrgId:      def.OrgId,
+		Name:       name,
+		Interval:   def.Interval,
+		Unit:       def.Unit,
+		Mtype:      def.Mtype,
+		Tags:       append([]string(nil), def.Tags...),
+		LastUpdate: def.LastUpdate,
+		Partition:  def.Partition,
+	}
+}
+
+// hasDefsWithName returns whether the org of the def has metricDefinitions with the same name and tags.
+// It assumes a lock is already held.
+func (m *MemoryIdx) hasDefsWithName(def *schema.MetricDefinition) bool {
+	if TagSupport && len(def.Tags) > 0 {
+		return len(m.defByTagSet.defs(def.OrgId, def.NameWithTags())) > 0
+	}
+	tree, ok := m.tree[def.OrgId]
+	if !ok {
+		return false
+	}
+	node, ok := tree.Items[def.Name]
+	return ok && node.Leaf()
+}
+
 // indexTags reads the tags of a given metric definition and creates the
 // corresponding tag index entries to refer to it. It assumes a lock is
 // already held.
@@ -376,15 +863,29 @@ func (m *MemoryIdx) deindexTags(tags TagIndex, def *schema.MetricDefinition) boo
 }
 
 // Used to rebuild the index from an existing set of metricDefinitions.
+// If a def is already in the index (e.g. because the persistent index holds a stale copy in another partition)
+// the one with the newest lastUpdate wins.
 func (m *MemoryIdx) Load(defs []schema.MetricDefinition) int {
 	m.Lock()
 	defer m.Unlock()
+	if len(m.defById) == 0 {
+		m.presize(defs)
+	}
 	var pre time.Time
-	var num int
+	var num, duplicates int
+	defer func() { logDuplicates(duplicates) }()
 	for i := range defs {
 		def := &defs[i]
 		pre = time.Now()
-		if _, ok := m.defById[def.Id]; ok {
+		if existing, ok := m.defById[def.Id]; ok {
+			duplicates++
+			// the id is derived from all other properties, so only lastUpdate and partition can differ
+			if def.LastUpdate > atomic.LoadInt64(&existing.LastUpdate) {
+				log.Debugf("memory-idx: Load: def %s loaded again with newer lastUpdate %d, using that", def.Id, def.LastUpdate)
+				atomic.StoreInt64(&existing.LastUpdate, def.LastUpdate)
+				atomic.StoreInt32(&existing.Partition, def.Partition)
+				existing.LastSave = uint32(def.LastUpdate)
+			}
 			continue
 		}
 
@@ -407,6 +908,57 @@ func (m *MemoryIdx) Load(defs []schema.MetricDefinition) int {
 	return num
 }
 
+// presize allocates the maps of an empty index with room for the given defs, such that loading them
+// at startup doesn't spend much of its time growing the maps one def at a time.
+// It assumes the write lock is held.
+func (m *MemoryIdx) presize(defs []schema.MetricDefinition) {
+	inTree := make(map[uint32]int)
+	byOrg := make(map[uint32]int)
+	for i := range defs {
+		byOrg[defs[i].OrgId]++
+		if !TagSupport || len(defs[i].Tags) == 0 {
+			inTree[defs[i].OrgId]++
+		}
+	}
+	m.defById = make(map[schema.MKey]*idx.Archive, len(defs))
+	for orgId, num := range inTree {
+		// the root node is created like add does. the branches need room too, but we can't know how many there are
+		m.tree[orgId] = &Tree{
+			Items: make(map[string]*Node, num),
+		}
+		m.tree[orgId].Items[""] = &Node{
+			Path:     "",
+			Children: make([]string, 0),
+			Defs:     make([]schema.MKey, 0),
+		}
+	}
+	if !TagSupport {
+		return
+	}
+	// indexTags adds all defs to the name tag and defByTagSet, whether they have tags or not
+	for orgId, num := range byOrg {
+		m.tags[orgId] = TagIndex{"name": make(TagValue, num)}
+		m.defByTagSet[orgId] = make(map[string]map[*schema.MetricDefinition]struct{}, num)
+	}
+}
+
+// logDuplicates reports the given number of duplicate defs seen while loading
+func logDuplicates(duplicates int) {
+	if duplicates == 0 {
+		return
+	}
+	statLoadDuplicates.Add(duplicates)
+	log.Warnf("memory-idx: Load: %d defs were loaded more than once, the persistent index may hold stale copies", duplicates)
+}
+
+// addObserved adds a def for which we have just seen its first point, see add.
+func (m *MemoryIdx) addObserved(def *schema.MetricDefinition) idx.Archive {
+	archive := m.add(def)
+	archive.Observations = 1
+	m.defById[def.Id].Observations = 1
+	return archive
+}
+
 func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 	path := def.NameWithTags()
 
@@ -423,7 +975,7 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 
 	if TagSupport && len(def.Tags) > 0 {
 		if _, ok := m.defById[def.Id]; !ok {
-			m.defById[def.Id] = archive
+			m.addDefById(archive)
 			statAdd.Inc()
 			log.Debugf("memory-idx: adding %s to DefById", path)
 		}
@@ -450,7 +1002,7 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 		if node, ok := tree.Items[path]; ok {
 			log.Debugf("memory-idx: existing index entry for %s. Adding %s to Defs list", path, def.Id)
 			node.Defs = append(node.Defs, def.Id)
-			m.defById[def.Id] = archive
+			m.addDefById(archive)
 			statAdd.Inc()
 			return *archive
 		}
@@ -496,7 +1048,7 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 		Children: []string{},
 		Defs:     []schema.MKey{def.Id},
 	}
-	m.defById[def.Id] = archive
+	m.addDefById(archive)
 	statAdd.Inc()
 
 	return *archive
@@ -504,16 +1056,79 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 
 func (m *MemoryIdx) Get(id schema.MKey) (idx.Archive, bool) {
 	pre := time.Now()
+	archive, ok, cached := m.getOrMiss(id, pre)
+	statGetDuration.Value(time.Since(pre))
+	countGet(ok)
+	if cached {
+		statGetMissCached.Inc()
+	}
+	return archive, ok
+}
+
+// getOrMiss is like get, but uses the negative cache, if any: ids that were recently not found
+// are not looked up again, and ids that are not found are remembered.
+// It also returns whether the miss was answered by the negative cache.
+func (m *MemoryIdx) getOrMiss(id schema.MKey, now time.Time) (idx.Archive, bool, bool) {
+	if m.misses == nil {
+		archive, ok := m.get(id)
+		return archive, ok, false
+	}
+	if m.misses.Missing(id, now) {
+		return idx.Archive{}, false, true
+	}
+	m.RLock()
+	defer m.RUnlock()
+	if def, ok := m.defById[id]; ok {
+		return *def, true, false
+	}
+	// still under the read lock, so the id can't be added before we remember it's missing
+	m.misses.Add(id, now)
+	return idx.Archive{}, false, false
+}
+
+// get returns the archive with the given id, if found, without recording any stats
+func (m *MemoryIdx) get(id schema.MKey) (idx.Archive, bool) {
 	m.RLock()
 	defer m.RUnlock()
 	def, ok := m.defById[id]
-	statGetDuration.Value(time.Since(pre))
 	if ok {
 		return *def, ok
 	}
 	return idx.Archive{}, ok
 }
 
+// GetMany returns the archives with the given ids, looking them all up under a single read lock.
+// ids that are not found are absent from the returned map.
+func (m *MemoryIdx) GetMany(ids []schema.MKey) map[schema.MKey]idx.Archive {
+	pre := time.Now()
+	archives := make(map[schema.MKey]idx.Archive, len(ids))
+	m.RLock()
+	for _, id := range ids {
+		if def, ok := m.defById[id]; ok {
+			archives[id] = *def
+		}
+	}
+	m.RUnlock()
+	statGetDuration.Value(time.Since(pre))
+	countGets(len(archives), len(ids)-len(archives))
+	return archives
+}
+
+// countGets records the number of requested archives that gets found and didn't find
+func countGets(hits, misses int) {
+	statGetHit.Add(hits)
+	statGetMiss.Add(misses)
+}
+
+// countGet records whether a get found the requested archive
+func countGet(found bool) {
+	if found {
+		statGetHit.Inc()
+	} else {
+		statGetMiss.Inc()
+	}
+}
+
 // GetPath returns the node under the given org and path.
 // this is an alternative to Find for when you have a path, not a pattern, and want to lookup in a specific org tree only.
 func (m *MemoryIdx) GetPath(orgId uint32, path string) []idx.Archive {
@@ -535,7 +1150,32 @@ func (m *MemoryIdx) GetPath(orgId uint32, path string) []idx.Archive {
 	return archives
 }
 
+// GetPaths is like GetPath for several paths at once, taking the read lock only once.
+// The archives are returned in the order of the paths. Paths that are not found are skipped.
+func (m *MemoryIdx) GetPaths(orgId uint32, paths []string) []idx.Archive {
+	m.RLock()
+	defer m.RUnlock()
+	tree, ok := m.tree[orgId]
+	if !ok {
+		return nil
+	}
+	var archives []idx.Archive
+	for _, path := range paths {
+		node := tree.Items[path]
+		if node == nil {
+			continue
+		}
+		for _, def := range node.Defs {
+			archives = append(archives, *m.defById[def])
+		}
+	}
+	return archives
+}
+
 func (m *MemoryIdx) TagDetails(orgId uint32, key, filter string, from int64) (map[string]uint64, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
 		return nil, nil
@@ -608,6 +1248,9 @@ func (m *MemoryIdx) TagDetails(orgId uint32, key, filter string, from int64) (ma
 //
 // the results will always be sorted alphabetically for consistency
 func (m *MemoryIdx) FindTags(orgId uint32, prefix string, expressions []string, from int64, limit uint) ([]string, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
 		return nil, nil
@@ -691,6 +1334,9 @@ func (m *MemoryIdx) FindTags(orgId uint32, prefix string, expressions []string,
 //
 // the results will always be sorted alphabetically for consistency
 func (m *MemoryIdx) FindTagValues(orgId uint32, tag, prefix string, expressions []string, from int64, limit uint) ([]string, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
 		return nil, nil
@@ -794,6 +1440,9 @@ func (m *MemoryIdx) FindTagValues(orgId uint32, tag, prefix string, expressions
 // If the third parameter is >0 then only metrics will be accounted of which the
 // LastUpdate time is >= the given value.
 func (m *MemoryIdx) Tags(orgId uint32, filter string, from int64) ([]string, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
 		return nil, nil
@@ -864,6 +1513,9 @@ func (m *MemoryIdx) hasOneMetricFrom(tags TagIndex, tag string, from int64) bool
 }
 
 func (m *MemoryIdx) FindByTag(orgId uint32, expressions []string, from int64) ([]idx.Node, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
 		return nil, nil
@@ -919,21 +1571,184 @@ func (m *MemoryIdx) idsByTagQuery(orgId uint32, query TagQuery) IdSet {
 }
 
 func (m *MemoryIdx) Find(orgId uint32, pattern string, from int64) ([]idx.Node, error) {
+	results, _, err := m.FindLimit(orgId, pattern, from, 0)
+	return results, err
+}
+
+// recordFindSeries records the number of series returned by a find, and whether it was too broad
+func recordFindSeries(orgId uint32, pattern string, nodes []idx.Node) {
+	var series int
+	for i := range nodes {
+		series += len(nodes[i].Defs)
+	}
+	statFindSeries.Value(series)
+	if findBroadThreshold > 0 && series > findBroadThreshold {
+		statFindBroad.Inc()
+		log.Warnf("memory-idx: find for orgId %d with pattern %q returned %d series, more than find-broad-threshold %d", orgId, pattern, series, findBroadThreshold)
+	}
+}
+
+// FindContext is like Find, but gives up searching the tree once ctx is done,
+// such that expensive patterns don't hold the read lock for too long.
+// In that case no results are returned. If the deadline of ctx passed, the error is errFindTimeout.
+func (m *MemoryIdx) FindContext(ctx context.Context, orgId uint32, pattern string, from int64) ([]idx.Node, error) {
+	results, _, err := m.findLimit(ctx, orgId, pattern, from, 0)
+	if err == nil {
+		recordFindSeries(orgId, pattern, results)
+	}
+	return results, err
+}
+
+// FindFiltered is like Find, but only returns the defs of which the fields match the filters,
+// which map field names to the value they must equal. The supported fields are unit and mtype.
+// Nodes without matching defs, including all branches, are left out.
+func (m *MemoryIdx) FindFiltered(orgId uint32, pattern string, from int64, filters map[string]string) ([]idx.Node, error) {
+	if err := validateFindFilters(filters); err != nil {
+		return nil, err
+	}
+	nodes, err := m.Find(orgId, pattern, from)
+	if err != nil {
+		return nil, err
+	}
+	return filterNodes(nodes, filters), nil
+}
+
+// findFilterFields returns the value of each field that FindFiltered supports
+var findFilterFields = map[string]func(def *idx.Archive) string{
+	"unit":  func(def *idx.Archive) string { return def.Unit },
+	"mtype": func(def *idx.Archive) string { return def.Mtype },
+}
+
+func validateFindFilters(filters map[string]string) error {
+	for field := range filters {
+		if _, ok := findFilterFields[field]; !ok {
+			return errors.NewBadRequest(fmt.Sprintf("can't filter on unknown field %q. supported fields are unit and mtype", field))
+		}
+	}
+	return nil
+}
+
+// filterNodes returns the nodes with only their defs that match the filters (see FindFiltered).
+// the nodes are modified in place.
+func filterNodes(nodes []idx.Node, filters map[string]string) []idx.Node {
+	results := nodes[:0]
+	for _, n := range nodes {
+		defs := n.Defs[:0]
+	DefsLoop:
+		for i := range n.Defs {
+			for field, value := range filters {
+				if findFilterFields[field](&n.Defs[i]) != value {
+					continue DefsLoop
+				}
+			}
+			defs = append(defs, n.Defs[i])
+		}
+		if len(defs) > 0 {
+			n.Defs = defs
+			results = append(results, n)
+		}
+	}
+	return results
+}
+
+// FindExcluding is like Find for the include pattern, but leaves out the nodes whose path also matches
+// the exclude pattern. Unlike the regular expression taken by graphite's exclude(), exclude is a glob
+// pattern like include, as both patterns are matched against the tree, which saves returning and diffing
+// two possibly large result sets.
+// Paths matching exclude are left out regardless of from.
+func (m *MemoryIdx) FindExcluding(orgId uint32, include, exclude string, from int64) ([]idx.Node, error) {
+	nodes, err := m.Find(orgId, include, from)
+	if err != nil {
+		return nil, err
+	}
+	excluded := make(map[string]struct{})
+	if err := m.addPaths(orgId, exclude, excluded); err != nil {
+		return nil, err
+	}
+	return excludePaths(nodes, excluded), nil
+}
+
+// addPaths adds the paths of the nodes visible to the given org that match the pattern to paths
+func (m *MemoryIdx) addPaths(orgId uint32, pattern string, paths map[string]struct{}) error {
+	if !idx.ValidOrgId(orgId) {
+		return errInvalidOrgId
+	}
+	m.RLock()
+	defer m.RUnlock()
+	orgs := []uint32{orgId}
+	if orgId != idx.OrgIdPublic && idx.OrgIdPublic > 0 {
+		orgs = append(orgs, idx.OrgIdPublic)
+	}
+	for _, org := range orgs {
+		matchedNodes, _, err := m.find(context.Background(), org, pattern, 0, findCaseInsensitive)
+		if err != nil {
+			return err
+		}
+		for _, n := range matchedNodes {
+			paths[n.Path] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// excludePaths returns the nodes of which the path is not in excluded.
+// the nodes are modified in place.
+func excludePaths(nodes []idx.Node, excluded map[string]struct{}) []idx.Node {
+	results := nodes[:0]
+	for _, n := range nodes {
+		if _, ok := excluded[n.Path]; !ok {
+			results = append(results, n)
+		}
+	}
+	return results
+}
+
+// FindLimit is like Find, but returns at most limit nodes (0 means no limit).
+// The search of the tree stops as soon as more than limit nodes matched, rather than collecting
+// all matches first. The returned bool is true if there were more matches than limit, in which
+// case the results are incomplete.
+// Note that when from is set, the results may come in under the limit after filtering even though
+// the returned bool is true.
+func (m *MemoryIdx) FindLimit(orgId uint32, pattern string, from int64, limit int) ([]idx.Node, bool, error) {
+	results, truncated, err := m.findLimit(context.Background(), orgId, pattern, from, limit)
+	if err == nil {
+		recordFindSeries(orgId, pattern, results)
+	}
+	return results, truncated, err
+}
+
+func (m *MemoryIdx) findLimit(ctx context.Context, orgId uint32, pattern string, from int64, limit int) ([]idx.Node, bool, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, false, errInvalidOrgId
+	}
 	pre := time.Now()
 	m.RLock()
 	defer m.RUnlock()
-	matchedNodes, err := m.find(orgId, pattern)
+	matchedNodes, truncated, err := m.find(ctx, orgId, pattern, limit, findCaseInsensitive)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if orgId != idx.OrgIdPublic && idx.OrgIdPublic > 0 {
-		publicNodes, err := m.find(idx.OrgIdPublic, pattern)
+		publicNodes, publicTruncated, err := m.find(ctx, idx.OrgIdPublic, pattern, limit, findCaseInsensitive)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		matchedNodes = append(matchedNodes, publicNodes...)
+		truncated = truncated || publicTruncated
 	}
 	log.Debugf("memory-idx: %d nodes matching pattern %s found", len(matchedNodes), pattern)
+	results, limited := m.toIdxNodes(matchedNodes, from, limit)
+	truncated = truncated || limited
+	log.Debugf("memory-idx: %d nodes has %d unique paths.", len(matchedNodes), len(results))
+	statFindDuration.Value(time.Since(pre))
+	return results, truncated, nil
+}
+
+// toIdxNodes converts the matched nodes to idx.Nodes, leaving out defs that haven't been updated since from.
+// If limit > 0, it returns at most limit nodes, and whether there were more.
+// It assumes a read lock is already held.
+func (m *MemoryIdx) toIdxNodes(matchedNodes []*Node, from int64, limit int) ([]idx.Node, bool) {
+	var truncated bool
 	results := make([]idx.Node, 0)
 	byPath := make(map[string]struct{})
 	// construct the output slice of idx.Node's such that there is only 1 idx.Node
@@ -942,6 +1757,10 @@ func (m *MemoryIdx) Find(orgId uint32, pattern string, from int64) ([]idx.Node,
 	// path, then the public metricDefs will be excluded.
 	for _, n := range matchedNodes {
 		if _, ok := byPath[n.Path]; !ok {
+			if limit > 0 && len(results) == limit {
+				truncated = true
+				break
+			}
 			idxNode := idx.Node{
 				Path:        n.Path,
 				Leaf:        n.Leaf(),
@@ -969,17 +1788,63 @@ func (m *MemoryIdx) Find(orgId uint32, pattern string, from int64) ([]idx.Node,
 			log.Debugf("memory-idx: path %s already seen", n.Path)
 		}
 	}
-	log.Debugf("memory-idx: %d nodes has %d unique paths.", len(matchedNodes), len(results))
+	return results, truncated
+}
+
+// FindAllOrgs finds the nodes matching the pattern in the trees of all orgs, keyed by org.
+// This bypasses tenant isolation, so it must only be used for administrative purposes.
+// It costs as much as a Find in every org, so it is not meant for the query path either.
+func (m *MemoryIdx) FindAllOrgs(pattern string, from int64) (map[uint32][]idx.Node, error) {
+	pre := time.Now()
+	m.RLock()
+	defer m.RUnlock()
+	results := make(map[uint32][]idx.Node)
+	for orgId := range m.tree {
+		matchedNodes, _, err := m.find(context.Background(), orgId, pattern, 0, findCaseInsensitive)
+		if err != nil {
+			return nil, err
+		}
+		if nodes, _ := m.toIdxNodes(matchedNodes, from, 0); len(nodes) > 0 {
+			results[orgId] = nodes
+		}
+	}
 	statFindDuration.Value(time.Since(pre))
 	return results, nil
 }
 
+// findCheckInterval is the number of branches find searches between checks whether its context is done
+const findCheckInterval = 100
+
+// errInvalidOrgId is returned when querying the index for an org for which idx.ValidOrgId is false.
+// Methods that can't return an error, like Count, List and ListFunc, return no results for such an org
+// instead: no series can belong to it, and the idx.MetricIndex signatures are shared by all index implementations.
+var errInvalidOrgId = errors.NewBadRequest("invalid org id")
+
+// errFindTimeout is returned by finds that were aborted because their deadline passed
+var errFindTimeout = errors.NewBadRequest("find timed out. the pattern is too expensive, try a more specific one")
+
+// findAborted returns the error to abort a find with if ctx is done, nil otherwise.
+func findAborted(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		statFindTimeout.Inc()
+		return errFindTimeout
+	default:
+		return ctx.Err()
+	}
+}
+
 // find returns all Nodes matching the pattern for the given orgId
-func (m *MemoryIdx) find(orgId uint32, pattern string) ([]*Node, error) {
+// if limit > 0, it returns at most limit Nodes, and whether there were more matches.
+// it periodically checks whether ctx is done, in which case it returns an error (see findAborted)
+// if caseInsensitive, the pattern is matched case-insensitively, as queries do when find-case-insensitive is set.
+func (m *MemoryIdx) find(ctx context.Context, orgId uint32, pattern string, limit int, caseInsensitive bool) ([]*Node, bool, error) {
 	tree, ok := m.tree[orgId]
 	if !ok {
 		log.Debugf("memory-idx: orgId %d has no metrics indexed.", orgId)
-		return nil, nil
+		return nil, false, nil
 	}
 
 	var nodes []string
@@ -996,8 +1861,12 @@ func (m *MemoryIdx) find(orgId uint32, pattern string) ([]*Node, error) {
 	// for a query like foo.bar.baz, pos is 3
 	// for a query like foo.bar.* or foo.bar, pos is 2
 	// for a query like foo.b*.baz, pos is 1
+	// when matching case-insensitively, we can't look up the exact branch, so pos is always 0
 	pos := len(nodes)
-	for i := 0; i < len(nodes); i++ {
+	if caseInsensitive {
+		pos = 0
+	}
+	for i := 0; i < pos; i++ {
 		if strings.ContainsAny(nodes[i], "*{}[]?") {
 			log.Debugf("memory-idx: found first pattern sequence at node %s pos %d", nodes[i], i)
 			pos = i
@@ -1013,33 +1882,48 @@ func (m *MemoryIdx) find(orgId uint32, pattern string) ([]*Node, error) {
 
 	if !ok {
 		log.Debugf("memory-idx: branch %q does not exist in the index for orgId %d", branch, orgId)
-		return nil, nil
+		return nil, false, nil
 	}
 
 	if startNode == nil {
 		corruptIndex.Inc()
 		log.Errorf("memory-idx: startNode is nil. org=%d,patt=%q,pos=%d,branch=%q", orgId, pattern, pos, branch)
-		return nil, errors.NewInternal("hit an empty path in the index")
+		return nil, false, errors.NewInternal("hit an empty path in the index")
 	}
 
 	children := []*Node{startNode}
+	truncated := false
+	searched := 0
+	candidates := 0
+	defer func() { statFindCandidates.AddUint64(uint64(candidates)) }()
 	for i := pos; i < len(nodes); i++ {
 		p := nodes[i]
 
-		matcher, err := getMatcher(p)
+		matcher, err := getMatcher(p, caseInsensitive)
 
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
+		// only at the last level we know for sure that a match is a result, so that's where we can stop early
+		last := i == len(nodes)-1
+
 		var grandChildren []*Node
+	ChildrenLoop:
 		for _, c := range children {
+			if searched%findCheckInterval == 0 {
+				if err := findAborted(ctx); err != nil {
+					return nil, false, err
+				}
+			}
+			searched++
 			if !c.HasChildren() {
 				log.Debugf("memory-idx: end of branch reached at %s with no match found for %s", c.Path, pattern)
 				// expecting a branch
 				continue
 			}
 			log.Debugf("memory-idx: searching %d children of %s that match %s", len(c.Children), c.Path, nodes[i])
+			candidates += len(c.Children)
 			matches := matcher(c.Children)
 			for _, m := range matches {
 				newBranch := c.Path + "." + m
@@ -1050,9 +1934,13 @@ func (m *MemoryIdx) find(orgId uint32, pattern string) ([]*Node, error) {
 				if grandChild == nil {
 					corruptIndex.Inc()
 					log.Errorf("memory-idx: grandChild is nil. org=%d,patt=%q,i=%d,pos=%d,p=%q,path=%q", orgId, pattern, i, pos, p, newBranch)
-					return nil, errors.NewInternal("hit an empty path in the index")
+					return nil, false, errors.NewInternal("hit an empty path in the index")
 				}
 
+				if last && limit > 0 && len(grandChildren) == limit {
+					truncated = true
+					break ChildrenLoop
+				}
 				grandChildren = append(grandChildren, grandChild)
 			}
 		}
@@ -1064,17 +1952,203 @@ func (m *MemoryIdx) find(orgId uint32, pattern string) ([]*Node, error) {
 	}
 
 	log.Debugf("memory-idx: reached pattern length. %d nodes matched", len(children))
-	return children, nil
+	statFindResults.AddUint64(uint64(len(children)))
+	return children, truncated, nil
+}
+
+// addDefById adds the archive to defById, keeping the per-org counts up to date.
+// It assumes a write lock is already held.
+func (m *MemoryIdx) addDefById(archive *idx.Archive) {
+	if _, ok := m.defById[archive.Id]; !ok {
+		m.defCountByOrg[archive.OrgId]++
+		if m.misses != nil {
+			m.misses.Remove(archive.Id)
+		}
+	}
+	m.defById[archive.Id] = archive
+}
+
+// deleteDefById removes the archive with the given id from defById, keeping the per-org counts up to date.
+// It assumes a write lock is already held.
+func (m *MemoryIdx) deleteDefById(id schema.MKey) {
+	def, ok := m.defById[id]
+	if !ok {
+		return
+	}
+	m.defCountByOrg[def.OrgId]--
+	if m.defCountByOrg[def.OrgId] <= 0 {
+		delete(m.defCountByOrg, def.OrgId)
+	}
+	delete(m.defById, id)
+}
+
+// Ids returns a snapshot of the ids of all metricDefinitions in the index, across all orgs
+func (m *MemoryIdx) Ids() []schema.MKey {
+	m.RLock()
+	defer m.RUnlock()
+	ids := make([]schema.MKey, 0, len(m.defById))
+	for id := range m.defById {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Walk calls fn for every metricDefinition in the index, across all orgs, until fn returns false.
+// Unlike List, it doesn't build up a slice of all archives. It holds the read lock for the whole walk,
+// so fn should be quick. It returns whether all metricDefinitions were visited.
+func (m *MemoryIdx) Walk(fn func(orgId uint32, id schema.MKey, name string) bool) bool {
+	m.RLock()
+	defer m.RUnlock()
+	for id, def := range m.defById {
+		if !fn(def.OrgId, id, def.NameWithTags()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns the number of metricDefinitions visible to the given org,
+// which like List includes the public org. It does not need to walk the index.
+func (m *MemoryIdx) Count(orgId uint32) int {
+	m.RLock()
+	defer m.RUnlock()
+	if !idx.ValidOrgId(orgId) {
+		return 0
+	}
+	count := m.defCountByOrg[orgId]
+	if orgId != idx.OrgIdPublic && idx.OrgIdPublic != 0 {
+		count += m.defCountByOrg[idx.OrgIdPublic]
+	}
+	return count
+}
+
+// CountAll returns the number of metricDefinitions in the index, across all orgs.
+func (m *MemoryIdx) CountAll() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.defById)
 }
 
+// List returns the archives visible to the given org, in no particular order. See ListSorted.
 func (m *MemoryIdx) List(orgId uint32) []idx.Archive {
 	pre := time.Now()
+	if !idx.ValidOrgId(orgId) {
+		return []idx.Archive{}
+	}
 	m.RLock()
 	defer m.RUnlock()
 
 	defs := make([]idx.Archive, 0)
 	for _, def := range m.defById {
-		if def.OrgId == orgId || def.OrgId == idx.OrgIdPublic {
+		if idx.VisibleTo(def.OrgId, orgId) {
+			defs = append(defs, *def)
+		}
+	}
+
+	statListDuration.Value(time.Since(pre))
+
+	return defs
+}
+
+// ListFunc calls fn for every archive visible to the given org, like List returns them,
+// until fn returns false. It holds the read lock for the whole listing, so fn should be quick,
+// but it avoids allocating a slice of all archives. It returns whether all archives were visited.
+func (m *MemoryIdx) ListFunc(orgId uint32, fn func(archive idx.Archive) bool) bool {
+	if !idx.ValidOrgId(orgId) {
+		return true
+	}
+	pre := time.Now()
+	m.RLock()
+	defer m.RUnlock()
+	defer func() { statListDuration.Value(time.Since(pre)) }()
+
+	for _, def := range m.defById {
+		if idx.VisibleTo(def.OrgId, orgId) {
+			if !fn(*def) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ListSorted returns the archives visible to the given org, like List, but ordered by name.
+// Archives with the same name are ordered by their tags, and then by id, so the order is stable.
+// The archives are sorted on every call, so callers that don't need the order should use List.
+func (m *MemoryIdx) ListSorted(orgId uint32) []idx.Archive {
+	pre := time.Now()
+	archives := m.listPrefix(orgId, "")
+	sortArchives(archives)
+	statListDuration.Value(time.Since(pre))
+	return archives
+}
+
+// ListPrefix returns a page of the archives visible to the given org, like List, whose name starts with prefix.
+// They are ordered like ListSorted orders them, so that pages are consistent.
+// It skips the first offset archives, and returns at most limit archives (all if limit is 0).
+func (m *MemoryIdx) ListPrefix(orgId uint32, prefix string, offset, limit int) []idx.Archive {
+	pre := time.Now()
+	archives := m.listPrefix(orgId, prefix)
+	statListDuration.Value(time.Since(pre))
+	return page(archives, offset, limit)
+}
+
+// listPrefix returns the archives visible to the given org whose name starts with prefix, in no particular order
+func (m *MemoryIdx) listPrefix(orgId uint32, prefix string) []idx.Archive {
+	if !idx.ValidOrgId(orgId) {
+		return []idx.Archive{}
+	}
+	m.RLock()
+	defer m.RUnlock()
+	defs := make([]idx.Archive, 0)
+	for _, def := range m.defById {
+		if idx.VisibleTo(def.OrgId, orgId) && strings.HasPrefix(def.Name, prefix) {
+			defs = append(defs, *def)
+		}
+	}
+	return defs
+}
+
+// sortArchives sorts the archives by name, name including tags, and id
+func sortArchives(archives []idx.Archive) {
+	sort.Slice(archives, func(i, j int) bool {
+		if archives[i].Name != archives[j].Name {
+			return archives[i].Name < archives[j].Name
+		}
+		a, b := archives[i].NameWithTags(), archives[j].NameWithTags()
+		if a != b {
+			return a < b
+		}
+		return archives[i].Id.String() < archives[j].Id.String()
+	})
+}
+
+// page sorts the archives (see sortArchives), and returns the page described by offset and limit
+func page(archives []idx.Archive, offset, limit int) []idx.Archive {
+	sortArchives(archives)
+	if offset >= len(archives) {
+		return []idx.Archive{}
+	}
+	archives = archives[offset:]
+	if limit > 0 && limit < len(archives) {
+		archives = archives[:limit]
+	}
+	return archives
+}
+
+// ListSince returns the archives visible to the given org, like List,
+// but only those that have been updated after the given timestamp.
+func (m *MemoryIdx) ListSince(orgId uint32, since int64) []idx.Archive {
+	pre := time.Now()
+	if !idx.ValidOrgId(orgId) {
+		return []idx.Archive{}
+	}
+	m.RLock()
+	defer m.RUnlock()
+
+	defs := make([]idx.Archive, 0)
+	for _, def := range m.defById {
+		if idx.VisibleTo(def.OrgId, orgId) && atomic.LoadInt64(&def.LastUpdate) > since {
 			defs = append(defs, *def)
 		}
 	}
@@ -1085,6 +2159,9 @@ func (m *MemoryIdx) List(orgId uint32) []idx.Archive {
 }
 
 func (m *MemoryIdx) DeleteTagged(orgId uint32, paths []string) ([]idx.Archive, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
 		return nil, nil
@@ -1122,6 +2199,40 @@ func (m *MemoryIdx) DeleteTagged(orgId uint32, paths []string) ([]idx.Archive, e
 	return m.deleteTaggedByIdSet(orgId, ids), nil
 }
 
+// pruneTaggedChunk deletes the given tagged series of the given org under a single write lock,
+// except those that are no longer stale, or have a series with the same tag set that is no longer stale.
+func (m *MemoryIdx) pruneTaggedChunk(tl *TimeLimiter, org uint32, ids IdSet, cutoffs []int64) []idx.Archive {
+	tl.Wait()
+	lockStart := time.Now()
+	m.Lock()
+	defer func() {
+		m.Unlock()
+		m.pruneLockHeld(tl, lockStart)
+	}()
+IDS:
+	for id := range ids {
+		def, ok := m.defById[id]
+		if !ok {
+			continue
+		}
+		for other := range m.defByTagSet.defs(org, def.NameWithTags()) {
+			if atomic.LoadInt64(&m.defById[other.Id].LastUpdate) >= cutoffs[def.IrId] {
+				log.Debugf("memory-idx: series %s for orgId:%d was identified for pruning but has been updated since.", def.NameWithTags(), org)
+				delete(ids, id)
+				continue IDS
+			}
+		}
+	}
+	return m.deleteTaggedByIdSet(org, ids)
+}
+
+// pruneLockHeld accounts for the time the write lock was held by Prune, since the given start
+func (m *MemoryIdx) pruneLockHeld(tl *TimeLimiter, lockStart time.Time) {
+	held := time.Since(lockStart)
+	tl.Add(held)
+	statPruneLockDuration.Value(held)
+}
+
 // deleteTaggedByIdSet deletes a map of ids from the tag index and also the DefByIds
 // it is important that only IDs of series with tags get passed in here, because
 // otherwise the result might be inconsistencies between DefByIDs and the tree index.
@@ -1144,7 +2255,7 @@ func (m *MemoryIdx) deleteTaggedByIdSet(orgId uint32, ids IdSet) []idx.Archive {
 			continue
 		}
 		deletedDefs = append(deletedDefs, *def)
-		delete(m.defById, idStr)
+		m.deleteDefById(idStr)
 	}
 
 	statMetricsActive.Set(len(m.defById))
@@ -1153,11 +2264,15 @@ func (m *MemoryIdx) deleteTaggedByIdSet(orgId uint32, ids IdSet) []idx.Archive {
 }
 
 func (m *MemoryIdx) Delete(orgId uint32, pattern string) ([]idx.Archive, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
 	var deletedDefs []idx.Archive
 	pre := time.Now()
 	m.Lock()
 	defer m.Unlock()
-	found, err := m.find(orgId, pattern)
+	// deletes always match the exact case, regardless of find-case-insensitive, so they can't remove more than was asked for
+	found, _, err := m.find(context.Background(), orgId, pattern, 0, false)
 	if err != nil {
 		return nil, err
 	}
@@ -1173,6 +2288,153 @@ func (m *MemoryIdx) Delete(orgId uint32, pattern string) ([]idx.Archive, error)
 	return deletedDefs, nil
 }
 
+// DeleteById deletes the metricDefinition with the given id from the index.
+// Unlike Delete, other metricDefinitions under the same path (e.g. with a
+// different interval) are left in place.
+// It returns a copy of the deleted Archive, or an error if the id is unknown.
+// Results of earlier Find calls may still reference the id: they hold copies,
+// so they stay valid, but fetching data for them will come back empty.
+func (m *MemoryIdx) DeleteById(id schema.MKey) (idx.Archive, error) {
+	pre := time.Now()
+	m.Lock()
+	defer m.Unlock()
+
+	def, ok := m.defById[id]
+	if !ok {
+		return idx.Archive{}, errors.NewNotFound(fmt.Sprintf("metricDef %s not found in index", id))
+	}
+	deleted := *def
+	m.deleteArchive(def)
+
+	statMetricsActive.Set(len(m.defById))
+	statDeleteDuration.Value(time.Since(pre))
+
+	return deleted, nil
+}
+
+// DeleteOrg deletes all metricDefinitions of the given org from the index, e.g. when offboarding a tenant.
+// Deleting an org without metricDefinitions is not an error, so it is safe to retry.
+// The public org can't be deleted, as its metricDefinitions are shared with all orgs.
+func (m *MemoryIdx) DeleteOrg(orgId uint32) ([]idx.Archive, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
+	if orgId == idx.OrgIdPublic {
+		return nil, errors.NewBadRequest("the public org can't be deleted")
+	}
+	pre := time.Now()
+	m.Lock()
+	defer m.Unlock()
+
+	deleted := make([]idx.Archive, 0, m.defCountByOrg[orgId])
+	for _, def := range m.defById {
+		if def.OrgId == orgId {
+			deleted = append(deleted, *def)
+		}
+	}
+	for i := range deleted {
+		m.deleteArchive(m.defById[deleted[i].Id])
+	}
+	delete(m.tree, orgId)
+	delete(m.tags, orgId)
+
+	statMetricsActive.Set(len(m.defById))
+	statDeleteDuration.Value(time.Since(pre))
+
+	return deleted, nil
+}
+
+// deleteArchive removes the given archive from the tag index or the tree, and from defById.
+// It assumes a write lock is already held.
+func (m *MemoryIdx) deleteArchive(def *idx.Archive) {
+	if TagSupport && len(def.Tags) > 0 {
+		m.deleteTaggedByIdSet(def.OrgId, IdSet{def.Id: struct{}{}})
+	} else {
+		m.deleteFromTree(&def.MetricDefinition)
+	}
+}
+
+// Evict removes the least recently updated series from the index, until it holds at most max series.
+// Unlike the deletes, this only affects the in-memory index.
+func (m *MemoryIdx) Evict(max int) []idx.Archive {
+	m.RLock()
+	n := len(m.defById) - max
+	if n <= 0 {
+		m.RUnlock()
+		return nil
+	}
+	candidates := m.evictCandidates()
+	m.RUnlock()
+
+	return m.evict(oldest(candidates, n))
+}
+
+// evictCandidates returns all series in the index as eviction candidates.
+// It assumes a read lock is already held.
+func (m *MemoryIdx) evictCandidates() []evictCandidate {
+	candidates := make([]evictCandidate, 0, len(m.defById))
+	for id, def := range m.defById {
+		candidates = append(candidates, evictCandidate{id, atomic.LoadInt64(&def.LastUpdate)})
+	}
+	return candidates
+}
+
+// evict removes the given candidates from the index, unless they have been updated since they were chosen
+func (m *MemoryIdx) evict(candidates []evictCandidate) []idx.Archive {
+	var evicted []idx.Archive
+	m.Lock()
+	for _, c := range candidates {
+		def, ok := m.defById[c.id]
+		if !ok || atomic.LoadInt64(&def.LastUpdate) > c.lastUpdate {
+			continue
+		}
+		evicted = append(evicted, *def)
+		m.deleteArchive(def)
+	}
+	statMetricsActive.Set(len(m.defById))
+	m.Unlock()
+	statEvicted.Add(len(evicted))
+	return evicted
+}
+
+// deleteFromTree removes a single metricDefinition from the tree index and the
+// DefByIds. The leaf node (and any parent branches that become empty) is only
+// deleted if it doesn't hold any other metricDefinitions.
+// It assumes a write lock is already held.
+func (m *MemoryIdx) deleteFromTree(def *schema.MetricDefinition) {
+	tree, ok := m.tree[def.OrgId]
+	if !ok {
+		corruptIndex.Inc()
+		log.Errorf("memory-idx: tree for orgId %d missing while deleting %s. Index is corrupt.", def.OrgId, def.Id)
+		m.deleteDefById(def.Id)
+		return
+	}
+
+	path := def.NameWithTags()
+	n, ok := tree.Items[path]
+	if !ok {
+		corruptIndex.Inc()
+		log.Errorf("memory-idx: node %q missing while deleting %s. Index is corrupt.", path, def.Id)
+		m.deleteDefById(def.Id)
+		return
+	}
+
+	if len(n.Defs) > 1 {
+		newDefs := make([]schema.MKey, 0, len(n.Defs)-1)
+		for _, id := range n.Defs {
+			if id != def.Id {
+				newDefs = append(newDefs, id)
+			}
+		}
+		n.Defs = newDefs
+		log.Debugf("memory-idx: deleting %s from index. node %s has other defs, leaving it in place", def.Id, path)
+		m.deleteDefById(def.Id)
+		return
+	}
+
+	m.delete(def.OrgId, n, true, false)
+}
+
 func (m *MemoryIdx) delete(orgId uint32, n *Node, deleteEmptyParents, deleteChildren bool) []idx.Archive {
 	tree := m.tree[orgId]
 	deletedDefs := make([]idx.Archive, 0)
@@ -1197,7 +2459,7 @@ func (m *MemoryIdx) delete(orgId uint32, n *Node, deleteEmptyParents, deleteChil
 	for _, id := range n.Defs {
 		log.Debugf("memory-idx: deleting %s from index", id)
 		deletedDefs = append(deletedDefs, *m.defById[id])
-		delete(m.defById, id)
+		m.deleteDefById(id)
 	}
 
 	n.Defs = nil
@@ -1324,9 +2586,10 @@ DEFS:
 		} else {
 			defs := m.defByTagSet.defs(def.OrgId, def.NameWithTags())
 			// if any other MetricDef with the same tag set is not expired yet,
-			// then we do not want to prune any of them
+			// then we do not want to prune any of them.
+			// note: defByTagSet holds copies of the defs, we need the LastUpdate of those in defById
 			for def := range defs {
-				if atomic.LoadInt64(&def.LastUpdate) >= cutoff {
+				if atomic.LoadInt64(&m.defById[def.Id].LastUpdate) >= cutoff {
 					continue DEFS
 				}
 			}
@@ -1340,20 +2603,24 @@ DEFS:
 
 	// create a new timeLimiter that allows us to limit the amount of time we spend
 	// holding a lock to maxPruneLockTime (default 100ms) every second.
+	// we delete in small chunks, so that no single lock hold gets long.
+	// series may get updated between the scan above and the deletes,
+	// so we check again under the write lock whether they are still stale.
 	tl := NewTimeLimiter(time.Second, maxPruneLockTime, time.Now())
 
 	for org, ids := range toPruneTagged {
-		if len(ids) == 0 {
-			continue
+		chunk := make(IdSet, pruneChunkSize)
+		for id := range ids {
+			chunk[id] = struct{}{}
+			if len(chunk) < pruneChunkSize {
+				continue
+			}
+			pruned = append(pruned, m.pruneTaggedChunk(tl, org, chunk, cutoffs)...)
+			chunk = make(IdSet, pruneChunkSize)
+		}
+		if len(chunk) > 0 {
+			pruned = append(pruned, m.pruneTaggedChunk(tl, org, chunk, cutoffs)...)
 		}
-		// make sure we are not locking for too long.
-		tl.Wait()
-		lockStart := time.Now()
-		m.Lock()
-		defs := m.deleteTaggedByIdSet(org, ids)
-		m.Unlock()
-		tl.Add(time.Since(lockStart))
-		pruned = append(pruned, defs...)
 	}
 
 ORGS:
@@ -1362,6 +2629,7 @@ ORGS:
 			continue
 		}
 
+	PATHS:
 		for path := range paths {
 			tl.Wait()
 			lockStart := time.Now()
@@ -1370,7 +2638,7 @@ ORGS:
 
 			if !ok {
 				m.Unlock()
-				tl.Add(time.Since(lockStart))
+				m.pruneLockHeld(tl, lockStart)
 				continue ORGS
 			}
 
@@ -1378,15 +2646,25 @@ ORGS:
 
 			if !ok {
 				m.Unlock()
-				tl.Add(time.Since(lockStart))
+				m.pruneLockHeld(tl, lockStart)
 				log.Debugf("memory-idx: series %s for orgId:%d was identified for pruning but cannot be found.", path, org)
 				continue
 			}
 
+			for _, id := range n.Defs {
+				def := m.defById[id]
+				if atomic.LoadInt64(&def.LastUpdate) >= cutoffs[def.IrId] {
+					m.Unlock()
+					m.pruneLockHeld(tl, lockStart)
+					log.Debugf("memory-idx: series %s for orgId:%d was identified for pruning but has been updated since.", path, org)
+					continue PATHS
+				}
+			}
+
 			log.Debugf("memory-idx: series %s for orgId:%d is stale. pruning it.", n.Path, org)
 			defs := m.delete(org, n, true, false)
 			m.Unlock()
-			tl.Add(time.Since(lockStart))
+			m.pruneLockHeld(tl, lockStart)
 			pruned = append(pruned, defs...)
 
 		}
@@ -1401,7 +2679,9 @@ ORGS:
 	return pruned, nil
 }
 
-func getMatcher(path string) (func([]string) []string, error) {
+// getMatcher returns a function that returns the children matching the given node of a graphite pattern.
+// if caseInsensitive is set, case is ignored, but the children are returned as-is.
+func getMatcher(path string, caseInsensitive bool) (func([]string) []string, error) {
 	// Matches everything
 	if path == "*" {
 		return func(children []string) []string {
@@ -1412,7 +2692,11 @@ func getMatcher(path string) (func([]string) []string, error) {
 
 	var patterns []string
 	if strings.ContainsAny(path, "{}") {
-		patterns = expandQueries(path)
+		var err error
+		patterns, err = expandQueries(path)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		patterns = []string{path}
 	}
@@ -1421,7 +2705,11 @@ func getMatcher(path string) (func([]string) []string, error) {
 	if strings.ContainsAny(path, "*[]?") {
 		regexes := make([]*regexp.Regexp, 0, len(patterns))
 		for _, p := range patterns {
-			r, err := regexp.Compile(toRegexp(p))
+			expr := toRegexp(p)
+			if caseInsensitive {
+				expr = "(?i)" + expr
+			}
+			r, err := regexp.Compile(expr)
 			if err != nil {
 				log.Debugf("memory-idx: regexp failed to compile. %s - %s", p, err)
 				return nil, errors.NewBadRequest(err.Error())
@@ -1431,11 +2719,13 @@ func getMatcher(path string) (func([]string) []string, error) {
 
 		return func(children []string) []string {
 			var matches []string
-			for _, r := range regexes {
-				for _, c := range children {
+			for _, c := range children {
+				// a child may match multiple expanded patterns, but must only be returned once
+				for _, r := range regexes {
 					if r.MatchString(c) {
 						log.Debugf("memory-idx: %s =~ %s", c, r.String())
 						matches = append(matches, c)
+						break
 					}
 				}
 			}
@@ -1446,9 +2736,10 @@ func getMatcher(path string) (func([]string) []string, error) {
 	// Exact match one or more values
 	return func(children []string) []string {
 		var results []string
-		for _, p := range patterns {
-			for _, c := range children {
-				if c == p {
+		for _, c := range children {
+			// a child may match multiple expanded patterns, but must only be returned once
+			for _, p := range patterns {
+				if c == p || (caseInsensitive && strings.EqualFold(c, p)) {
 					log.Debugf("memory-idx: %s matches %s", c, p)
 					results = append(results, c)
 					break
@@ -1459,11 +2750,37 @@ func getMatcher(path string) (func([]string) []string, error) {
 	}, nil
 }
 
+// Match returns whether the metric path matches the graphite pattern, the way Find matches them:
+// node by node, honoring the find-case-insensitive setting.
+// It returns an error for patterns that Find would reject.
+func Match(pattern, path string) (bool, error) {
+	patternNodes := strings.Split(pattern, ".")
+	pathNodes := strings.Split(path, ".")
+	if len(patternNodes) != len(pathNodes) {
+		return false, nil
+	}
+	for i, node := range patternNodes {
+		matcher, err := getMatcher(node, findCaseInsensitive)
+		if err != nil {
+			return false, err
+		}
+		if len(matcher([]string{pathNodes[i]})) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// maxExpandedQueries is the maximum number of patterns a single node of a pattern may expand to, see expandQueries.
+// alternatives multiply, so a short pattern like {a,b}{a,b}... could otherwise expand to millions of patterns.
+const maxExpandedQueries = 10000
+
 // We don't use filepath.Match as it doesn't support {} because that's not posix, it's a bashism
 // the easiest way of implementing this extra feature is just expanding single queries
 // that contain these queries into multiple queries, which will be checked separately
 // and the results of which will be ORed.
-func expandQueries(query string) []string {
+// Braces may be nested, and braces without a counterpart are matched literally.
+func expandQueries(query string) ([]string, error) {
 	queries := []string{query}
 
 	// as long as we find a { followed by a }, split it up into subqueries, and process
@@ -1474,16 +2791,8 @@ func expandQueries(query string) []string {
 		expanded := make([]string, 0)
 		keepLooking = false
 		for _, query := range queries {
-			lbrace := strings.Index(query, "{")
-			rbrace := -1
+			lbrace, rbrace := innermostBraces(query)
 			if lbrace > -1 {
-				rbrace = strings.Index(query[lbrace:], "}")
-				if rbrace > -1 {
-					rbrace += lbrace
-				}
-			}
-
-			if lbrace > -1 && rbrace > -1 {
 				keepLooking = true
 				expansion := query[lbrace+1 : rbrace]
 				options := strings.Split(expansion, ",")
@@ -1493,16 +2802,71 @@ func expandQueries(query string) []string {
 			} else {
 				expanded = append(expanded, query)
 			}
+			if len(expanded) > maxExpandedQueries {
+				return nil, errors.NewBadRequest(fmt.Sprintf("pattern %q expands to more than %d alternatives", query, maxExpandedQueries))
+			}
 		}
 		queries = expanded
 	}
-	return queries
+	return queries, nil
+}
+
+// innermostBraces returns the positions of the first { and } that have no braces in between, or -1, -1 if there are none.
+// Expanding the innermost braces first makes nested braces work: {a,{b,c}} expands to {a,b} and {a,c}.
+func innermostBraces(query string) (int, int) {
+	lbrace := -1
+	for i := 0; i < len(query); i++ {
+		switch query[i] {
+		case '{':
+			lbrace = i
+		case '}':
+			if lbrace > -1 {
+				return lbrace, i
+			}
+		}
+	}
+	return -1, -1
 }
 
+// toRegexp converts a graphite pattern for a single node (after {} expansion, see expandQueries)
+// into an anchored regular expression, the way graphite matches it:
+// * matches any amount of characters, ? matches exactly one character,
+// [...] is a character class ([!...] being a negated one), and everything else matches literally.
 func toRegexp(pattern string) string {
-	p := pattern
-	p = strings.Replace(p, "*", ".*", -1)
-	p = strings.Replace(p, "?", ".?", -1)
-	p = "^" + p + "$"
-	return p
+	p := "^"
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*':
+			p += ".*"
+		case '?':
+			p += "."
+		case '[':
+			// like in graphite (fnmatch), a ] right after the [ or [! is part of the class rather than closing it
+			start := i + 1
+			if start < len(pattern) && pattern[start] == '!' {
+				start++
+			}
+			if start < len(pattern) && pattern[start] == ']' {
+				start++
+			}
+			end := strings.Index(pattern[start:], "]")
+			if end == -1 {
+				// not a character class, match it literally
+				p += regexp.QuoteMeta(pattern[i:])
+				i = len(pattern)
+				break
+			}
+			class := pattern[i+1 : start+end]
+			p += "["
+			if strings.HasPrefix(class, "!") {
+				p += "^"
+				class = class[1:]
+			}
+			p += regexp.QuoteMeta(class) + "]"
+			i = start + end
+		default:
+			p += regexp.QuoteMeta(pattern[i : i+1])
+		}
+	}
+	return p + "$"
 }
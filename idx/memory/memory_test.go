@@ -1,15 +1,20 @@
 package memory
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
+	"math"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/errors"
 	"github.com/grafana/metrictank/idx"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/test"
@@ -146,6 +151,152 @@ func TestFind(t *testing.T) {
 	testWithAndWithoutTagSupport(t, testFind)
 }
 
+func TestFindCaseInsensitive(t *testing.T) {
+	defer func(ci bool) { findCaseInsensitive = ci }(findCaseInsensitive)
+
+	ix := New()
+	ix.Init()
+	for _, name := range []string{"Metric.Demo.Foo", "metric.demo.bar"} {
+		md := &schema.MetricData{Name: name, OrgId: 1, Interval: 10}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, 1)
+	}
+
+	cases := []struct {
+		pattern         string
+		caseInsensitive bool
+		exp             []string
+	}{
+		{"METRIC.demo.foo", false, nil},
+		{"metric.demo.*", false, []string{"metric.demo.bar"}},
+		{"METRIC.demo.foo", true, []string{"Metric.Demo.Foo"}},
+		{"metric.demo.*", true, []string{"Metric.Demo.Foo", "metric.demo.bar"}},
+		{"metric.{DEMO,x}.B?r", true, []string{"metric.demo.bar"}},
+	}
+	for i, c := range cases {
+		findCaseInsensitive = c.caseInsensitive
+		nodes, err := ix.Find(1, c.pattern, 0)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error %s", i, err)
+		}
+		var paths []string
+		for _, n := range nodes {
+			paths = append(paths, n.Path)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, c.exp) {
+			t.Errorf("case %d: pattern %q (case insensitive: %t): expected %v, got %v", i, c.pattern, c.caseInsensitive, c.exp, paths)
+		}
+	}
+}
+
+// find-case-insensitive only applies to queries: deletes must not remove series whose name differs in case
+func TestDeleteCaseInsensitive(t *testing.T) {
+	defer func(ci bool) { findCaseInsensitive = ci }(findCaseInsensitive)
+	findCaseInsensitive = true
+
+	ix := New()
+	ix.Init()
+	for _, name := range []string{"a.b.c", "A.b.C", "a.B.c", "a.x.c"} {
+		md := &schema.MetricData{Name: name, OrgId: 1, Interval: 10}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, 1)
+	}
+
+	deleted, err := ix.Delete(1, "a.B.c")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(deleted) != 1 || deleted[0].Name != "a.B.c" {
+		t.Fatalf("expected to delete only a.B.c, got %v", deleted)
+	}
+	deleted, err = ix.Delete(1, "a.*.c")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var names []string
+	for _, d := range deleted {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	if exp := []string{"a.b.c", "a.x.c"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("expected to delete %v, got %v", exp, names)
+	}
+	nodes, err := ix.Find(1, "a.b.c", 0)
+	if err != nil || len(nodes) != 1 || nodes[0].Path != "A.b.C" {
+		t.Fatalf("expected A.b.C to be left, got %v (error %v)", nodes, err)
+	}
+}
+
+func TestFindLimit(t *testing.T) {
+	ix := New()
+	ix.Init()
+	for i := 0; i < 10; i++ {
+		md := &schema.MetricData{Name: fmt.Sprintf("metric.demo.%d", i), OrgId: 1, Interval: 10}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, 1)
+	}
+
+	cases := []struct {
+		pattern   string
+		limit     int
+		expLen    int
+		truncated bool
+	}{
+		{"metric.demo.*", 0, 10, false},
+		{"metric.demo.*", 10, 10, false},
+		{"metric.demo.*", 11, 10, false},
+		{"metric.demo.*", 9, 9, true},
+		{"metric.demo.*", 1, 1, true},
+		{"metric.*", 1, 1, false},
+		{"metric.demo.3", 1, 1, false},
+		{"metric.demo.{1,2}", 1, 1, true},
+		{"foo.*", 1, 0, false},
+	}
+	for i, c := range cases {
+		nodes, truncated, err := ix.FindLimit(1, c.pattern, 0, c.limit)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error %s", i, err)
+		}
+		if len(nodes) != c.expLen || truncated != c.truncated {
+			t.Errorf("case %d: pattern %q limit %d: expected %d nodes (truncated %t), got %d (truncated %t)", i, c.pattern, c.limit, c.expLen, c.truncated, len(nodes), truncated)
+		}
+	}
+}
+
+func TestFindContext(t *testing.T) {
+	ix := New()
+	ix.Init()
+	for i := 0; i < 10; i++ {
+		md := &schema.MetricData{Name: fmt.Sprintf("metric.demo.%d", i), OrgId: 1, Interval: 10}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, 1)
+	}
+
+	nodes, err := ix.FindContext(context.Background(), 1, "metric.demo.*", 0)
+	if err != nil || len(nodes) != 10 {
+		t.Fatalf("expected 10 nodes and no error, got %d nodes and error %v", len(nodes), err)
+	}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	nodes, err = ix.FindContext(expired, 1, "metric.demo.*", 0)
+	if err != errFindTimeout || len(nodes) != 0 {
+		t.Fatalf("expected no nodes and errFindTimeout, got %d nodes and error %v", len(nodes), err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	nodes, err = ix.FindContext(canceled, 1, "metric.demo.*", 0)
+	if err != context.Canceled || len(nodes) != 0 {
+		t.Fatalf("expected no nodes and context.Canceled, got %d nodes and error %v", len(nodes), err)
+	}
+}
+
 func testFind(t *testing.T) {
 	idx.OrgIdPublic = 100
 	defer func() { idx.OrgIdPublic = 0 }()
@@ -367,6 +518,184 @@ func TestDeleteTagged(t *testing.T) {
 	})
 }
 
+func TestDeleteById(t *testing.T) {
+	testWithAndWithoutTagSupport(t, testDeleteById)
+}
+
+func testDeleteById(t *testing.T) {
+	ix := New()
+	ix.Init()
+
+	series := getMetricData(1, 2, 5, 10, "metric.org1", true)
+	for _, s := range series {
+		mkey, err := schema.MKeyFromString(s.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.AddOrUpdate(mkey, s, 1)
+	}
+
+	// same name and tags as series[0], but a different interval, so it shares its path
+	other := *series[0]
+	other.Interval = 60
+	other.SetId()
+	otherKey, _ := schema.MKeyFromString(other.Id)
+	ix.AddOrUpdate(otherKey, &other, 1)
+
+	mkey, _ := schema.MKeyFromString(series[0].Id)
+	deleted, err := ix.DeleteById(mkey)
+	if err != nil {
+		t.Fatalf("expected no error deleting %s, got %s", mkey, err)
+	}
+	if deleted.Id != mkey {
+		t.Fatalf("expected deleted archive to have id %s, got %s", mkey, deleted.Id)
+	}
+	if _, ok := ix.Get(mkey); ok {
+		t.Fatalf("expected %s to be deleted from the index", mkey)
+	}
+	if _, ok := ix.Get(otherKey); !ok {
+		t.Fatalf("expected %s with the same path to still be in the index", otherKey)
+	}
+	if defs := ix.List(1); len(defs) != len(series) {
+		t.Fatalf("expected %d defs left in the index, got %d", len(series), len(defs))
+	}
+
+	_, err = ix.DeleteById(mkey)
+	if _, ok := err.(errors.NotFound); !ok {
+		t.Fatalf("expected NotFound error deleting unknown id, got %v", err)
+	}
+
+	// deleting the last def of a path must remove the node from the tree
+	ix.DeleteById(otherKey)
+	nodes, err := ix.Find(1, series[0].Name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 0 {
+		t.Fatalf("expected no nodes for %s after deleting all of its defs, got %v", series[0].Name, nodes)
+	}
+}
+
+// deleting tagged series must shrink the tag index, so that
+// tag/value entries without any remaining ids don't linger
+func TestDeleteByIdShrinksTagIndex(t *testing.T) {
+	_tagSupport := TagSupport
+	defer func() { TagSupport = _tagSupport }()
+	TagSupport = true
+
+	ix := New()
+	ix.Init()
+
+	series := getMetricData(1, 2, 3, 10, "metric.tagged", true)
+	var keys []schema.MKey
+	for _, s := range series {
+		s.Tags = append(s.Tags, "unique="+s.Name)
+		s.SetId()
+		mkey, _ := schema.MKeyFromString(s.Id)
+		ix.AddOrUpdate(mkey, s, 1)
+		keys = append(keys, mkey)
+	}
+	if values := len(ix.tags[1]["unique"]); values != len(series) {
+		t.Fatalf("expected %d values for tag unique, got %d", len(series), values)
+	}
+
+	ix.DeleteById(keys[0])
+	if values := len(ix.tags[1]["unique"]); values != len(series)-1 {
+		t.Fatalf("expected %d values for tag unique after delete, got %d", len(series)-1, values)
+	}
+
+	for _, k := range keys[1:] {
+		ix.DeleteById(k)
+	}
+	if len(ix.tags[1]) != 0 {
+		t.Fatalf("expected empty tag index after deleting all series, got %v", ix.tags[1])
+	}
+}
+
+func TestStats(t *testing.T) {
+	_tagSupport := TagSupport
+	defer func() { TagSupport = _tagSupport }()
+	TagSupport = true
+
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	if s := ix.Stats(); s != (IndexStats{}) {
+		t.Fatalf("expected zero stats for empty index, got %+v", s)
+	}
+
+	// 2 series with tags a=1 and a=2, and a shared tag b=1. and 1 untagged series, which goes into the tree
+	for _, tags := range [][]string{{"a=1", "b=1"}, {"a=2", "b=1"}, nil} {
+		md := &schema.MetricData{
+			Name:     "some.metric",
+			OrgId:    1,
+			Interval: 10,
+			Tags:     tags,
+		}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, 1)
+	}
+
+	s := ix.Stats()
+	// tree: root, some, some.metric
+	if s.TreeNodes != 3 {
+		t.Fatalf("expected 3 tree nodes, got %d", s.TreeNodes)
+	}
+	// keys: name, a, b. values: name=some.metric, a=1, a=2, b=1
+	if s.TagKeys != 3 || s.TagValues != 4 {
+		t.Fatalf("expected 3 tag keys and 4 tag values, got %d and %d", s.TagKeys, s.TagValues)
+	}
+	// name references all 3 ids (the untagged one too), b=1 both tagged ones, a=1 and a=2 one each
+	if s.TagEntries != 7 {
+		t.Fatalf("expected 7 tag entries, got %d", s.TagEntries)
+	}
+	if s.TagBytes == 0 {
+		t.Fatalf("expected non-zero tag bytes")
+	}
+}
+
+func TestStatsDefAges(t *testing.T) {
+	ix := New()
+	now := int64(1000 * 86400)
+	// 90 defs updated 30s ago, 9 updated 2h ago and one updated 2 years ago
+	var defs []schema.MetricDefinition
+	for i := 0; i < 100; i++ {
+		lastUpdate := now - 30
+		if i >= 90 {
+			lastUpdate = now - 2*3600
+		}
+		if i == 99 {
+			lastUpdate = now - 2*365*86400
+		}
+		md := schema.MetricDefinition{Name: fmt.Sprintf("metric.%d", i), OrgId: 1, Interval: 10, LastUpdate: lastUpdate}
+		md.SetId()
+		defs = append(defs, md)
+	}
+	ix.Load(defs)
+
+	s := ix.stats(now)
+	cases := []struct {
+		p   float64
+		exp int
+	}{
+		{50, 60},
+		{90, 60},
+		{91, 6 * 3600},
+		{99, 6 * 3600},
+		{100, math.MaxInt32},
+	}
+	for _, c := range cases {
+		if got := s.DefAgePercentile(c.p); got != c.exp {
+			t.Errorf("p%v: expected %d, got %d", c.p, c.exp, got)
+		}
+	}
+	if got := (IndexStats{}).DefAgePercentile(50); got != 0 {
+		t.Errorf("expected 0 for an empty index, got %d", got)
+	}
+}
+
 func TestDeleteNodeWith100kChildren(t *testing.T) {
 	testWithAndWithoutTagSupport(t, testDeleteNodeWith100kChildren)
 }
@@ -847,6 +1176,60 @@ func testPrune(t *testing.T) {
 
 }
 
+// series that get updated in between prune identifying them as stale
+// and prune deleting them, must not get deleted
+func TestPruneTaggedChunkSkipsUpdatedSeries(t *testing.T) {
+	_tagSupport := TagSupport
+	defer func() { TagSupport = _tagSupport }()
+	TagSupport = true
+
+	IndexRules = conf.IndexRules{
+		Default: conf.IndexRule{
+			Name:     "default",
+			Pattern:  regexp.MustCompile(""),
+			MaxStale: time.Second,
+		},
+	}
+
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	ids := make(IdSet)
+	var updated *schema.MetricData
+	for _, s := range getMetricData(1, 2, 4, 10, "metric.tagged", true) {
+		s.Time = 1
+		s.SetId()
+		mkey, err := schema.MKeyFromString(s.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.AddOrUpdate(mkey, s, 1)
+		ids[mkey] = struct{}{}
+		updated = s
+	}
+	cutoffs := IndexRules.Cutoffs(time.Unix(100, 0))
+
+	// one of the series receives new data before its chunk gets pruned
+	updated.Time = 100
+	mkey, _ := schema.MKeyFromString(updated.Id)
+	ix.AddOrUpdate(mkey, updated, 1)
+
+	tl := NewTimeLimiter(time.Second, maxPruneLockTime, time.Now())
+	pruned := ix.pruneTaggedChunk(tl, 1, ids, cutoffs)
+	if len(pruned) != 3 {
+		t.Fatalf("expected 3 series to be pruned, got %d", len(pruned))
+	}
+	for _, a := range pruned {
+		if a.Id == mkey {
+			t.Fatalf("expected updated series %s not to be pruned", mkey)
+		}
+	}
+	if _, ok := ix.Get(mkey); !ok {
+		t.Fatalf("expected updated series %s to still be in the index", mkey)
+	}
+}
+
 func TestSingleNodeMetric(t *testing.T) {
 	ix := New()
 	ix.Init()
@@ -864,6 +1247,60 @@ func TestSingleNodeMetric(t *testing.T) {
 	ix.AddOrUpdate(mkey, data, 1)
 }
 
+func TestAddOrUpdateMany(t *testing.T) {
+	testWithAndWithoutTagSupport(t, testAddOrUpdateMany)
+}
+
+func testAddOrUpdateMany(t *testing.T) {
+	ix := New()
+	ix.Init()
+
+	series := getMetricData(1, 2, 5, 10, "metric.org1", true)
+	var mkeys []schema.MKey
+	for _, s := range series {
+		s.Time = 100
+		mkey, err := schema.MKeyFromString(s.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mkeys = append(mkeys, mkey)
+	}
+
+	// the first series is already known, the last one occurs twice in the batch
+	ix.AddOrUpdate(mkeys[0], series[0], 1)
+	mkeys = append(mkeys, mkeys[4])
+	series = append(series, series[4])
+
+	results := ix.AddOrUpdateMany(mkeys, series, 2)
+	if len(results) != len(mkeys) {
+		t.Fatalf("expected %d results, got %d", len(mkeys), len(results))
+	}
+	for i, res := range results {
+		if res.Archive.Id != mkeys[i] {
+			t.Fatalf("result %d: expected id %s, got %s", i, mkeys[i], res.Archive.Id)
+		}
+		expInMemory := i == 0 || i == 5
+		if res.InMemory != expInMemory {
+			t.Fatalf("result %d: expected InMemory %t, got %t", i, expInMemory, res.InMemory)
+		}
+	}
+	if results[0].OldPartition != 1 {
+		t.Fatalf("expected old partition 1 for the existing series, got %d", results[0].OldPartition)
+	}
+	if defs := ix.List(1); len(defs) != 5 {
+		t.Fatalf("expected 5 defs in the index, got %d", len(defs))
+	}
+	for _, mkey := range mkeys {
+		def, ok := ix.Get(mkey)
+		if !ok {
+			t.Fatalf("expected %s to be in the index", mkey)
+		}
+		if def.Partition != 2 {
+			t.Fatalf("expected %s to have partition 2, got %d", mkey, def.Partition)
+		}
+	}
+}
+
 func BenchmarkIndexing(b *testing.B) {
 	ix := New()
 	ix.Init()
@@ -1020,3 +1457,349 @@ func TestMatchSchemaWithTags(t *testing.T) {
 		}
 	}
 }
+
+func TestGetMatcher(t *testing.T) {
+	children := []string{"a", "ab", "abc", "a+b", "a(b)", "b1", "b2", "bx"}
+	cases := []struct {
+		pattern string
+		exp     []string
+	}{
+		{"a?", []string{"ab"}},
+		{"a*", []string{"a", "ab", "abc", "a+b", "a(b)"}},
+		{"a+b", []string{"a+b"}},
+		{"a+*", []string{"a+b"}},
+		{"a(*)", []string{"a(b)"}},
+		{"b[0-9]", []string{"b1", "b2"}},
+		{"b[!0-9]", []string{"bx"}},
+		{"{a,ab,a}", []string{"a", "ab"}},
+		{"{a*,ab*}", []string{"a", "ab", "abc", "a+b", "a(b)"}},
+		{"[ab", nil},
+	}
+	for i, c := range cases {
+		matcher, err := getMatcher(c.pattern, false)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error for %q: %s", i, c.pattern, err)
+		}
+		if got := matcher(children); !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("case %d: pattern %q: expected %v, got %v", i, c.pattern, c.exp, got)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		exp     bool
+	}{
+		{"a.b.c", "a.b.c", true},
+		{"a.*.c", "a.b.c", true},
+		{"a.*", "a.b.c", false},
+		{"a.{b,c}.d", "a.c.d", true},
+		{"a.{b,{c,d}}.e", "a.d.e", true},
+		{"a.{b,{c,d}}.e", "a.c}.e", false},
+		{"a.{{b,c},{d,e}}x", "a.ex", true},
+		{"a{}.b", "a.b", true},
+		{"a.{b,}c", "a.c", true},
+		{"a.[]].b", "a.].b", true},
+		{"a.[!]].b", "a.].b", false},
+		{"a.[!]].b", "a.x.b", true},
+		{"a.[]", "a.[]", true},
+		{"a.}{", "a.}{", true},
+	}
+	for i, c := range cases {
+		got, err := Match(c.pattern, c.path)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error for %q: %s", i, c.pattern, err)
+		}
+		if got != c.exp {
+			t.Errorf("case %d: pattern %q, path %q: expected %t, got %t", i, c.pattern, c.path, c.exp, got)
+		}
+	}
+
+	// alternatives multiply, so this would expand to 2^20 patterns
+	if _, err := Match(strings.Repeat("{a,b}", 20), "ab"); err == nil {
+		t.Errorf("expected an error for a pattern that expands to too many alternatives")
+	}
+}
+
+func TestCount(t *testing.T) {
+	testWithAndWithoutTagSupport(t, testCount)
+}
+
+func testCount(t *testing.T) {
+	idx.OrgIdPublic = 100
+	defer func() { idx.OrgIdPublic = 0 }()
+
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	var keys []schema.MKey
+	for _, org := range []uint32{1, 1, 1, 2, idx.OrgIdPublic} {
+		md := &schema.MetricData{Name: fmt.Sprintf("some.metric.%d", len(keys)), OrgId: int(org), Interval: 10, Tags: []string{"a=b"}}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, 1)
+		// updates must not be counted
+		ix.AddOrUpdate(mkey, md, 1)
+		keys = append(keys, mkey)
+	}
+
+	check := func(org uint32, exp int) {
+		t.Helper()
+		if count := ix.Count(org); count != exp {
+			t.Fatalf("expected count %d for org %d, got %d", exp, org, count)
+		}
+		if count := len(ix.List(org)); count != exp {
+			t.Fatalf("expected List to return %d defs for org %d, got %d", exp, org, count)
+		}
+	}
+	check(1, 4)
+	check(2, 2)
+	check(3, 1)
+	check(idx.OrgIdPublic, 1)
+	if count := ix.CountAll(); count != 5 {
+		t.Fatalf("expected total count 5, got %d", count)
+	}
+
+	ix.DeleteById(keys[0])
+	ix.DeleteById(keys[3])
+	check(1, 3)
+	check(2, 1)
+	if count := ix.CountAll(); count != 3 {
+		t.Fatalf("expected total count 3, got %d", count)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	testWithAndWithoutTagSupport(t, testEvict)
+}
+
+func testEvict(t *testing.T) {
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	var mkeys []schema.MKey
+	for i, s := range getMetricData(1, 2, 10, 10, "metric.evict", true) {
+		s.Time = int64(100 - i) // the last series are the least recently updated
+		s.SetId()
+		mkey, err := schema.MKeyFromString(s.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.AddOrUpdate(mkey, s, 1)
+		mkeys = append(mkeys, mkey)
+	}
+
+	if evicted := ix.Evict(10); len(evicted) != 0 {
+		t.Fatalf("expected no series to be evicted while within max, got %d", len(evicted))
+	}
+	evicted := ix.Evict(6)
+	if len(evicted) != 4 {
+		t.Fatalf("expected 4 series to be evicted, got %d", len(evicted))
+	}
+	for i, mkey := range mkeys {
+		_, ok := ix.Get(mkey)
+		if ok != (i < 6) {
+			t.Errorf("series %d: expected to be in index: %t, got %t", i, i < 6, ok)
+		}
+	}
+	if ix.CountAll() != 6 {
+		t.Fatalf("expected 6 series left, got %d", ix.CountAll())
+	}
+}
+
+func TestWalk(t *testing.T) {
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	exp := make(map[schema.MKey]string)
+	for i, org := range []int{1, 1, 2} {
+		md := &schema.MetricData{Name: fmt.Sprintf("some.metric.%d", i), OrgId: org, Interval: 10}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, 1)
+		exp[mkey] = md.Name
+	}
+
+	seen := make(map[schema.MKey]string)
+	complete := ix.Walk(func(orgId uint32, id schema.MKey, name string) bool {
+		if orgId != id.Org {
+			t.Errorf("expected org %d for %s, got %d", id.Org, id, orgId)
+		}
+		seen[id] = name
+		return true
+	})
+	if !complete || !reflect.DeepEqual(seen, exp) {
+		t.Fatalf("expected complete walk over %v, got %v (complete %t)", exp, seen, complete)
+	}
+
+	var visited int
+	complete = ix.Walk(func(orgId uint32, id schema.MKey, name string) bool {
+		visited++
+		return false
+	})
+	if complete || visited != 1 {
+		t.Fatalf("expected walk to stop after 1 def, visited %d (complete %t)", visited, complete)
+	}
+}
+
+func TestListSince(t *testing.T) {
+	idx.OrgIdPublic = 100
+	defer func() { idx.OrgIdPublic = 0 }()
+
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	add := func(name string, org int, ts int64) schema.MKey {
+		md := &schema.MetricData{Name: name, OrgId: org, Interval: 10, Time: ts}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, 1)
+		return mkey
+	}
+	add("old", 1, 10)
+	recent := add("recent", 1, 30)
+	add("boundary", 1, 20)
+	add("other.org", 2, 30)
+	public := add("public", int(idx.OrgIdPublic), 30)
+
+	archives := ix.ListSince(1, 20)
+	var got []schema.MKey
+	for _, a := range archives {
+		got = append(got, a.Id)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].String() < got[j].String() })
+	exp := []schema.MKey{recent, public}
+	sort.Slice(exp, func(i, j int) bool { return exp[i].String() < exp[j].String() })
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected defs %v updated after 20, got %v", exp, got)
+	}
+}
+
+func TestListFunc(t *testing.T) {
+	idx.OrgIdPublic = 100
+	defer func() { idx.OrgIdPublic = 0 }()
+
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	for i, org := range []int{1, 1, 2, int(idx.OrgIdPublic)} {
+		md := &schema.MetricData{Name: fmt.Sprintf("some.metric.%d", i), OrgId: org, Interval: 10}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, 1)
+	}
+
+	exp := make(map[schema.MKey]bool)
+	for _, archive := range ix.List(1) {
+		exp[archive.Id] = true
+	}
+	got := make(map[schema.MKey]bool)
+	complete := ix.ListFunc(1, func(archive idx.Archive) bool {
+		got[archive.Id] = true
+		return true
+	})
+	if !complete || len(got) != 3 || !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected complete listing %v, got %v (complete %t)", exp, got, complete)
+	}
+
+	var visited int
+	complete = ix.ListFunc(1, func(archive idx.Archive) bool {
+		visited++
+		return visited < 2
+	})
+	if complete || visited != 2 {
+		t.Fatalf("expected listing to stop after 2 defs, visited %d (complete %t)", visited, complete)
+	}
+}
+
+func benchmarkListing(b *testing.B, list func(ix *MemoryIdx) int) {
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+	newCorpusIndex(ix, 100000, 1, false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if count := list(ix); count != 100000 {
+			b.Fatalf("expected 100000 defs, got %d", count)
+		}
+	}
+}
+
+func BenchmarkList100k(b *testing.B) {
+	benchmarkListing(b, func(ix *MemoryIdx) int {
+		return len(ix.List(1))
+	})
+}
+
+func BenchmarkListFunc100k(b *testing.B) {
+	benchmarkListing(b, func(ix *MemoryIdx) int {
+		var count int
+		ix.ListFunc(1, func(archive idx.Archive) bool {
+			count++
+			return true
+		})
+		return count
+	})
+}
+
+func benchmarkGets(b *testing.B, get func(ix *MemoryIdx, ids []schema.MKey) int) {
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+	var ids []schema.MKey
+	for i, mkey := range newCorpusIndex(ix, 100000, 1, false) {
+		if i%100 == 0 {
+			ids = append(ids, mkey)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if count := get(ix, ids); count != len(ids) {
+			b.Fatalf("expected %d defs, got %d", len(ids), count)
+		}
+	}
+}
+
+func BenchmarkGet1000(b *testing.B) {
+	benchmarkGets(b, func(ix *MemoryIdx, ids []schema.MKey) int {
+		var count int
+		for _, id := range ids {
+			if _, ok := ix.Get(id); ok {
+				count++
+			}
+		}
+		return count
+	})
+}
+
+func BenchmarkGetMany1000(b *testing.B) {
+	benchmarkGets(b, func(ix *MemoryIdx, ids []schema.MKey) int {
+		return len(ix.GetMany(ids))
+	})
+}
+
+// BenchmarkLoad1M measures the cold start case of loading 1M defs into an empty index
+func BenchmarkLoad1M(b *testing.B) {
+	defs := make([]schema.MetricDefinition, 1000000)
+	for i := range defs {
+		defs[i] = schema.MetricDefinition{Name: fmt.Sprintf("some.metric.%d.%d", i%1000, i), OrgId: 1, Interval: 10, LastUpdate: 100}
+		defs[i].SetId()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ix := New()
+		if num := ix.Load(defs); num != len(defs) {
+			b.Fatalf("expected %d defs to be loaded, got %d", len(defs), num)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+// MissCache is a negative cache: it remembers ids that were recently looked up but not found,
+// such that repeated lookups of the same missing id can be answered without looking it up again.
+// An id is remembered for ttl, unless it is removed earlier, which should be done when it gets added.
+// It holds at most max ids. When full, expired ids are forgotten, or arbitrary ones if none expired.
+type MissCache struct {
+	sync.RWMutex
+	ttl    time.Duration
+	max    int
+	expiry map[schema.MKey]time.Time
+}
+
+func NewMissCache(ttl time.Duration, max int) *MissCache {
+	return &MissCache{
+		ttl:    ttl,
+		max:    max,
+		expiry: make(map[schema.MKey]time.Time),
+	}
+}
+
+// Missing returns whether the given id was recorded as missing less than ttl ago
+func (c *MissCache) Missing(id schema.MKey, now time.Time) bool {
+	c.RLock()
+	exp, ok := c.expiry[id]
+	c.RUnlock()
+	return ok && now.Before(exp)
+}
+
+// Add records the given id as missing
+func (c *MissCache) Add(id schema.MKey, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.expiry[id]; !ok && len(c.expiry) >= c.max {
+		for old, exp := range c.expiry {
+			if !now.Before(exp) {
+				delete(c.expiry, old)
+			}
+		}
+		for old := range c.expiry {
+			if len(c.expiry) < c.max {
+				break
+			}
+			delete(c.expiry, old)
+		}
+	}
+	c.expiry[id] = now.Add(c.ttl)
+}
+
+// Remove forgets the given id, e.g. because it was added
+func (c *MissCache) Remove(id schema.MKey) {
+	c.RLock()
+	_, ok := c.expiry[id]
+	c.RUnlock()
+	if !ok {
+		return
+	}
+	c.Lock()
+	delete(c.expiry, id)
+	c.Unlock()
+}
+
+// Len returns the number of ids held, including expired ones that weren't forgotten yet
+func (c *MissCache) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.expiry)
+}
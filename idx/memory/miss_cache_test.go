@@ -0,0 +1,39 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/test"
+)
+
+func TestMissCache(t *testing.T) {
+	c := NewMissCache(time.Minute, 2)
+	now := time.Unix(1000, 0)
+	a, b, d := test.GetMKey(1), test.GetMKey(2), test.GetMKey(3)
+
+	if c.Missing(a, now) {
+		t.Errorf("expected a not to be missing before it was added")
+	}
+	c.Add(a, now)
+	if !c.Missing(a, now.Add(30*time.Second)) {
+		t.Errorf("expected a to be missing within the ttl")
+	}
+	if c.Missing(a, now.Add(2*time.Minute)) {
+		t.Errorf("expected a not to be missing after the ttl")
+	}
+	c.Remove(a)
+	if c.Missing(a, now) {
+		t.Errorf("expected a not to be missing after it was removed")
+	}
+
+	c.Add(a, now)
+	c.Add(b, now)
+	c.Add(d, now)
+	if c.Len() != 2 {
+		t.Errorf("expected at most 2 ids to be remembered, got %d", c.Len())
+	}
+	if !c.Missing(d, now) {
+		t.Errorf("expected the most recently added id to be remembered")
+	}
+}
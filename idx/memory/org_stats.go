@@ -0,0 +1,85 @@
+package memory
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/raintank/schema"
+)
+
+const orgStatsShards = 32
+
+// OrgIngestCounts describes how many defs were created and how many
+// existing defs were refreshed by incoming data, for a single org.
+type OrgIngestCounts struct {
+	Added     uint64
+	Refreshed uint64
+}
+
+// OrgStats tracks OrgIngestCounts for all orgs.
+// Refreshes happen for every incoming point, concurrently under the index read lock,
+// so rather than a single locked map we use shards keyed by metric key, holding
+// counters that are incremented atomically. The shard lock is only taken
+// for writing the first time an org is seen in a shard.
+type OrgStats struct {
+	shards [orgStatsShards]orgStatsShard
+}
+
+type orgStatsShard struct {
+	sync.RWMutex
+	counts map[uint32]*OrgIngestCounts
+}
+
+func NewOrgStats() *OrgStats {
+	o := &OrgStats{}
+	for i := range o.shards {
+		o.shards[i].counts = make(map[uint32]*OrgIngestCounts)
+	}
+	return o
+}
+
+// get returns the counters for the given metric key, creating them if needed
+func (o *OrgStats) get(mkey schema.MKey) *OrgIngestCounts {
+	shard := &o.shards[mkey.Key[len(mkey.Key)-1]%orgStatsShards]
+	shard.RLock()
+	c, ok := shard.counts[mkey.Org]
+	shard.RUnlock()
+	if ok {
+		return c
+	}
+	shard.Lock()
+	c, ok = shard.counts[mkey.Org]
+	if !ok {
+		c = &OrgIngestCounts{}
+		shard.counts[mkey.Org] = c
+	}
+	shard.Unlock()
+	return c
+}
+
+// Added records that a new def was created for the given metric key
+func (o *OrgStats) Added(mkey schema.MKey) {
+	atomic.AddUint64(&o.get(mkey).Added, 1)
+}
+
+// Refreshed records that an existing def was refreshed for the given metric key
+func (o *OrgStats) Refreshed(mkey schema.MKey) {
+	atomic.AddUint64(&o.get(mkey).Refreshed, 1)
+}
+
+// Snapshot returns the counts so far, by orgId
+func (o *OrgStats) Snapshot() map[uint32]OrgIngestCounts {
+	snap := make(map[uint32]OrgIngestCounts)
+	for i := range o.shards {
+		shard := &o.shards[i]
+		shard.RLock()
+		for org, c := range shard.counts {
+			s := snap[org]
+			s.Added += atomic.LoadUint64(&c.Added)
+			s.Refreshed += atomic.LoadUint64(&c.Refreshed)
+			snap[org] = s
+		}
+		shard.RUnlock()
+	}
+	return snap
+}
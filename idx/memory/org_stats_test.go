@@ -0,0 +1,78 @@
+package memory
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestOrgStatsConcurrent(t *testing.T) {
+	o := NewOrgStats()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				mkey := test.GetMKey(i)
+				mkey.Org = uint32(i%3 + 1)
+				o.Added(mkey)
+				o.Refreshed(mkey)
+				o.Refreshed(mkey)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 1000 keys spread over 3 orgs: 334, 333, 333 keys, by 8 workers each
+	exp := map[uint32]OrgIngestCounts{
+		1: {Added: 334 * 8, Refreshed: 2 * 334 * 8},
+		2: {Added: 333 * 8, Refreshed: 2 * 333 * 8},
+		3: {Added: 333 * 8, Refreshed: 2 * 333 * 8},
+	}
+	if snap := o.Snapshot(); !reflect.DeepEqual(snap, exp) {
+		t.Fatalf("expected %v, got %v", exp, snap)
+	}
+}
+
+func TestIngestStatsConcurrentAddOrUpdate(t *testing.T) {
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	// every worker sends the same 100 series for org 1 and 50 for org 2, 10 times.
+	// each series must be added exactly once, all other calls are refreshes.
+	workers := 8
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 10; round++ {
+				for i := 0; i < 150; i++ {
+					org := 1
+					if i >= 100 {
+						org = 2
+					}
+					md := &schema.MetricData{Name: fmt.Sprintf("metric.%d", i), OrgId: org, Interval: 10, Time: int64(round)}
+					md.SetId()
+					mkey, _ := schema.MKeyFromString(md.Id)
+					ix.AddOrUpdate(mkey, md, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	exp := map[uint32]OrgIngestCounts{
+		1: {Added: 100, Refreshed: uint64(100*10*workers - 100)},
+		2: {Added: 50, Refreshed: uint64(50*10*workers - 50)},
+	}
+	if snap := ix.IngestStats(); !reflect.DeepEqual(snap, exp) {
+		t.Fatalf("expected %v, got %v", exp, snap)
+	}
+}
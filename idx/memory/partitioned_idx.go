@@ -0,0 +1,824 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/idx"
+	"github.com/raintank/schema"
+)
+
+// PartitionedMemoryIdx is a MemoryIndex that keeps a separate MemoryIdx, each with its own lock, per partition.
+// This way, adding series to one partition doesn't block ingest or queries for the other ones,
+// at the expense of queries having to visit all partitions.
+// A series lives in the partition it was last seen on. When it moves to another partition,
+// AddOrUpdate moves it over. Update only looks at the given partition, so for a moved series
+// points are only accepted once AddOrUpdate has seen it on its new partition.
+type PartitionedMemoryIdx struct {
+	sync.Mutex              // serializes adding partitions
+	partitions atomic.Value // map[int32]*MemoryIdx. copy-on-write, so that looking up a partition doesn't need a lock
+
+	// called for every series created by AddOrUpdate(Many). the partitions don't have this hook,
+	// as to them a series that moved to another partition looks new.
+	onNewSeries func(def *schema.MetricDefinition)
+
+	stopStats chan struct{}
+}
+
+func NewPartitionedMemoryIdx() *PartitionedMemoryIdx {
+	p := &PartitionedMemoryIdx{}
+	p.partitions.Store(make(map[int32]*MemoryIdx))
+	return p
+}
+
+// partition returns the index for the given partition, creating it if needed
+func (p *PartitionedMemoryIdx) partition(partition int32) *MemoryIdx {
+	if m, ok := p.partitions.Load().(map[int32]*MemoryIdx)[partition]; ok {
+		return m
+	}
+	p.Lock()
+	defer p.Unlock()
+	parts := p.partitions.Load().(map[int32]*MemoryIdx)
+	if m, ok := parts[partition]; ok {
+		return m
+	}
+	newParts := make(map[int32]*MemoryIdx, len(parts)+1)
+	for part, m := range parts {
+		newParts[part] = m
+	}
+	m := New()
+	newParts[partition] = m
+	p.partitions.Store(newParts)
+	return m
+}
+
+// all returns the indexes of all partitions, ordered by partition
+func (p *PartitionedMemoryIdx) all() []*MemoryIdx {
+	parts := p.partitions.Load().(map[int32]*MemoryIdx)
+	ids := make([]int, 0, len(parts))
+	for part := range parts {
+		ids = append(ids, int(part))
+	}
+	sort.Ints(ids)
+	indexes := make([]*MemoryIdx, len(ids))
+	for i, part := range ids {
+		indexes[i] = parts[int32(part)]
+	}
+	return indexes
+}
+
+// updateMetricsActive corrects the idx.metrics_active gauge, which the partitions set to their own size after deletes
+func (p *PartitionedMemoryIdx) updateMetricsActive() {
+	statMetricsActive.Set(p.CountAll())
+}
+
+// Count returns the number of metricDefinitions visible to the given org, across all partitions
+func (p *PartitionedMemoryIdx) Count(orgId uint32) int {
+	var count int
+	for _, m := range p.all() {
+		count += m.Count(orgId)
+	}
+	return count
+}
+
+// IngestStats returns the IngestStats of all partitions, summed by orgId.
+// A series that moves to another partition is counted as added there.
+func (p *PartitionedMemoryIdx) IngestStats() map[uint32]OrgIngestCounts {
+	stats := make(map[uint32]OrgIngestCounts)
+	for _, m := range p.all() {
+		for orgId, c := range m.IngestStats() {
+			sum := stats[orgId]
+			sum.Added += c.Added
+			sum.Refreshed += c.Refreshed
+			stats[orgId] = sum
+		}
+	}
+	return stats
+}
+
+// CountAll returns the number of metricDefinitions across all orgs and partitions
+func (p *PartitionedMemoryIdx) CountAll() int {
+	var count int
+	for _, m := range p.all() {
+		count += m.CountAll()
+	}
+	return count
+}
+
+func (p *PartitionedMemoryIdx) Init() error {
+	p.stopStats = make(chan struct{})
+	go reportStats(p.Stats, p.stopStats)
+	if MaxSeries > 0 {
+		go evictLoop(p.Evict, p.stopStats)
+	}
+	return nil
+}
+
+func (p *PartitionedMemoryIdx) Stop() {
+	if p.stopStats != nil {
+		close(p.stopStats)
+		p.stopStats = nil
+	}
+}
+
+// Stats returns the size of the index, summed over all partitions
+func (p *PartitionedMemoryIdx) Stats() IndexStats {
+	var s IndexStats
+	for _, m := range p.all() {
+		ps := m.Stats()
+		s.TreeNodes += ps.TreeNodes
+		s.TagKeys += ps.TagKeys
+		s.TagValues += ps.TagValues
+		s.TagEntries += ps.TagEntries
+		s.TagBytes += ps.TagBytes
+		for i, n := range ps.DefAges {
+			s.DefAges[i] += n
+		}
+	}
+	return s
+}
+
+// Update updates the series in the given partition. If the series is only known in another partition,
+// it has moved: like AddOrUpdate does, it is moved to the given partition, and the other partition is returned.
+func (p *PartitionedMemoryIdx) Update(point schema.MetricPoint, partition int32) (idx.Archive, int32, bool) {
+	m := p.partition(partition)
+	if archive, oldPartition, inMemory := m.Update(point, partition); inMemory {
+		return archive, oldPartition, inMemory
+	}
+	for part, owner := range p.partitions.Load().(map[int32]*MemoryIdx) {
+		if part == partition {
+			continue
+		}
+		if _, ok := owner.get(point.MKey); !ok {
+			continue
+		}
+		archive, err := owner.DeleteById(point.MKey)
+		if err != nil {
+			continue
+		}
+		// keep the archive as is (e.g. its lastSave and observations), other than the partition
+		archive.Partition = partition
+		m.Replace(archive.MetricDefinition)
+		m.UpdateArchive(archive)
+		p.updateMetricsActive()
+		archive, _, inMemory := m.Update(point, partition)
+		return archive, part, inMemory
+	}
+	return idx.Archive{}, 0, false
+}
+
+func (p *PartitionedMemoryIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, partition int32) (idx.Archive, int32, bool) {
+	archive, oldPartition, inMemory := p.partition(partition).AddOrUpdate(mkey, data, partition)
+	if inMemory {
+		return archive, oldPartition, inMemory
+	}
+	if oldPartition, ok := p.moved(mkey, partition); ok {
+		return archive, oldPartition, true
+	}
+	p.newSeries(archive)
+	return archive, oldPartition, inMemory
+}
+
+// OnNewSeries sets a hook that is called for every new series, like MemoryIdx.OnNewSeries.
+// Series that move to another partition are not new.
+func (p *PartitionedMemoryIdx) OnNewSeries(fn func(def *schema.MetricDefinition)) {
+	p.onNewSeries = fn
+}
+
+// newSeries calls the OnNewSeries hook, if any, for a series that was just created
+func (p *PartitionedMemoryIdx) newSeries(archive idx.Archive) {
+	if p.onNewSeries != nil {
+		p.onNewSeries(&archive.MetricDefinition)
+	}
+}
+
+// AddOrUpdateMany is the batch equivalent of AddOrUpdate.
+// see MemoryIdx.AddOrUpdateMany
+func (p *PartitionedMemoryIdx) AddOrUpdateMany(mkeys []schema.MKey, data []*schema.MetricData, partition int32) []AddOrUpdateResult {
+	results := p.partition(partition).AddOrUpdateMany(mkeys, data, partition)
+	for i := range results {
+		if results[i].InMemory {
+			continue
+		}
+		if oldPartition, ok := p.moved(mkeys[i], partition); ok {
+			results[i].OldPartition = oldPartition
+			results[i].InMemory = true
+			continue
+		}
+		p.newSeries(results[i].Archive)
+	}
+	return results
+}
+
+// moved is called after a series was added to the given partition.
+// If the series was known in another partition, it is deleted there, and that partition is returned.
+func (p *PartitionedMemoryIdx) moved(mkey schema.MKey, partition int32) (int32, bool) {
+	for part, m := range p.partitions.Load().(map[int32]*MemoryIdx) {
+		if part == partition {
+			continue
+		}
+		if _, ok := m.get(mkey); !ok {
+			continue
+		}
+		if _, err := m.DeleteById(mkey); err == nil {
+			p.updateMetricsActive()
+			return part, true
+		}
+	}
+	return 0, false
+}
+
+// UpdateArchive updates the archive information, in the partition of the archive
+func (p *PartitionedMemoryIdx) UpdateArchive(archive idx.Archive) {
+	p.partition(archive.Partition).UpdateArchive(archive)
+}
+
+// Replace replaces the def in the partition it belongs to, see MemoryIdx.Replace.
+// If the def is known in another partition, it is deleted there first.
+func (p *PartitionedMemoryIdx) Replace(def schema.MetricDefinition) idx.Archive {
+	for part, m := range p.partitions.Load().(map[int32]*MemoryIdx) {
+		if part == def.Partition {
+			continue
+		}
+		if existing, err := m.DeleteById(def.Id); err == nil && existing.LastUpdate > def.LastUpdate {
+			def.LastUpdate = existing.LastUpdate
+		}
+	}
+	archive := p.partition(def.Partition).Replace(def)
+	p.updateMetricsActive()
+	return archive
+}
+
+// Load adds the defs to the partitions they belong to.
+// Like MemoryIdx.Load, if a def is loaded more than once, the one with the newest lastUpdate wins.
+// Its copies may belong to different partitions, so we check all of them.
+func (p *PartitionedMemoryIdx) Load(defs []schema.MetricDefinition) int {
+	var duplicates int
+	defer func() { logDuplicates(duplicates) }()
+
+	newest := make(map[schema.MKey]int, len(defs))
+	for i, def := range defs {
+		if j, ok := newest[def.Id]; ok {
+			duplicates++
+			if def.LastUpdate <= defs[j].LastUpdate {
+				continue
+			}
+		}
+		newest[def.Id] = i
+	}
+
+	byPartition := make(map[int32][]schema.MetricDefinition)
+DEFS:
+	for _, i := range newest {
+		def := defs[i]
+		for part, m := range p.partitions.Load().(map[int32]*MemoryIdx) {
+			if part == def.Partition {
+				continue
+			}
+			existing, ok := m.get(def.Id)
+			if !ok {
+				continue
+			}
+			duplicates++
+			if def.LastUpdate <= existing.LastUpdate {
+				continue DEFS
+			}
+			m.DeleteById(def.Id)
+		}
+		byPartition[def.Partition] = append(byPartition[def.Partition], def)
+	}
+	var num int
+	for part, defs := range byPartition {
+		num += p.partition(part).Load(defs)
+	}
+	p.updateMetricsActive()
+	return num
+}
+
+// SnapshotDefs returns a compressed snapshot of the metricDefinitions of all partitions
+func (p *PartitionedMemoryIdx) SnapshotDefs() ([]byte, error) {
+	var defs []schema.MetricDefinition
+	for _, m := range p.all() {
+		m.RLock()
+		for _, def := range m.defById {
+			defs = append(defs, def.MetricDefinition)
+		}
+		m.RUnlock()
+	}
+	return encodeSnapshot(defs)
+}
+
+// LoadDefsSnapshot loads the metricDefinitions from a snapshot into the partitions they belong to
+func (p *PartitionedMemoryIdx) LoadDefsSnapshot(snap []byte) (int, error) {
+	defs, err := decodeSnapshot(snap)
+	if err != nil {
+		return 0, err
+	}
+	return p.Load(defs), nil
+}
+
+// ExportJSON writes the metricDefinitions of all partitions to w, like MemoryIdx.ExportJSON
+func (p *PartitionedMemoryIdx) ExportJSON(w io.Writer) error {
+	for _, m := range p.all() {
+		if err := m.ExportJSON(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportJSON loads the metricDefinitions written by ExportJSON into the partitions they belong to
+func (p *PartitionedMemoryIdx) ImportJSON(r io.Reader) (int, error) {
+	return importJSON(r, p.Load)
+}
+
+// GetMany looks up the ids in all partitions, locking each partition once.
+// ids that are not found are absent from the returned map.
+func (p *PartitionedMemoryIdx) GetMany(ids []schema.MKey) map[schema.MKey]idx.Archive {
+	pre := time.Now()
+	archives := make(map[schema.MKey]idx.Archive, len(ids))
+	for _, m := range p.all() {
+		m.RLock()
+		for _, id := range ids {
+			if def, ok := m.defById[id]; ok {
+				archives[id] = *def
+			}
+		}
+		m.RUnlock()
+	}
+	statGetDuration.Value(time.Since(pre))
+	countGets(len(archives), len(ids)-len(archives))
+	return archives
+}
+
+func (p *PartitionedMemoryIdx) Get(id schema.MKey) (idx.Archive, bool) {
+	pre := time.Now()
+	defer func() { statGetDuration.Value(time.Since(pre)) }()
+	partitions := p.all()
+	allCached := len(partitions) > 0
+	for _, m := range partitions {
+		archive, ok, cached := m.getOrMiss(id, pre)
+		if ok {
+			countGet(true)
+			return archive, ok
+		}
+		allCached = allCached && cached
+	}
+	countGet(false)
+	if allCached {
+		statGetMissCached.Inc()
+	}
+	return idx.Archive{}, false
+}
+
+func (p *PartitionedMemoryIdx) GetPath(orgId uint32, path string) []idx.Archive {
+	var archives []idx.Archive
+	for _, m := range p.all() {
+		archives = append(archives, m.GetPath(orgId, path)...)
+	}
+	return archives
+}
+
+// GetPaths collects the archives of the paths from all partitions, and returns them in the order of the paths
+func (p *PartitionedMemoryIdx) GetPaths(orgId uint32, paths []string) []idx.Archive {
+	byPath := make(map[string][]idx.Archive)
+	for _, m := range p.all() {
+		for _, archive := range m.GetPaths(orgId, paths) {
+			path := archive.NameWithTags()
+			byPath[path] = append(byPath[path], archive)
+		}
+	}
+	var archives []idx.Archive
+	for _, path := range paths {
+		archives = append(archives, byPath[path]...)
+	}
+	return archives
+}
+
+func (p *PartitionedMemoryIdx) Ids() []schema.MKey {
+	var ids []schema.MKey
+	for _, m := range p.all() {
+		ids = append(ids, m.Ids()...)
+	}
+	return ids
+}
+
+// Walk walks the partitions one after the other, until fn returns false
+func (p *PartitionedMemoryIdx) Walk(fn func(orgId uint32, id schema.MKey, name string) bool) bool {
+	for _, m := range p.all() {
+		if !m.Walk(fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *PartitionedMemoryIdx) List(orgId uint32) []idx.Archive {
+	var archives []idx.Archive
+	for _, m := range p.all() {
+		archives = append(archives, m.List(orgId)...)
+	}
+	return archives
+}
+
+// ListFunc lists the partitions one after the other, until fn returns false
+func (p *PartitionedMemoryIdx) ListFunc(orgId uint32, fn func(archive idx.Archive) bool) bool {
+	for _, m := range p.all() {
+		if !m.ListFunc(orgId, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// ListSorted collects the archives of all partitions, so that they can be sorted together
+func (p *PartitionedMemoryIdx) ListSorted(orgId uint32) []idx.Archive {
+	var archives []idx.Archive
+	for _, m := range p.all() {
+		archives = append(archives, m.listPrefix(orgId, "")...)
+	}
+	sortArchives(archives)
+	return archives
+}
+
+// ListPrefix collects the matching archives of all partitions, so that they can be paged through in order
+func (p *PartitionedMemoryIdx) ListPrefix(orgId uint32, prefix string, offset, limit int) []idx.Archive {
+	var archives []idx.Archive
+	for _, m := range p.all() {
+		archives = append(archives, m.listPrefix(orgId, prefix)...)
+	}
+	return page(archives, offset, limit)
+}
+
+func (p *PartitionedMemoryIdx) ListSince(orgId uint32, since int64) []idx.Archive {
+	var archives []idx.Archive
+	for _, m := range p.all() {
+		archives = append(archives, m.ListSince(orgId, since)...)
+	}
+	return archives
+}
+
+// Find searches all partitions and merges the nodes with the same path.
+func (p *PartitionedMemoryIdx) Find(orgId uint32, pattern string, from int64) ([]idx.Node, error) {
+	return p.FindContext(context.Background(), orgId, pattern, from)
+}
+
+// FindContext searches all partitions like Find, giving up once ctx is done
+func (p *PartitionedMemoryIdx) FindContext(ctx context.Context, orgId uint32, pattern string, from int64) ([]idx.Node, error) {
+	results, _, err := p.findLimit(ctx, orgId, pattern, from, 0)
+	return results, err
+}
+
+// FindLimit searches all partitions like MemoryIdx.FindLimit.
+// Every partition returns at most limit nodes, and of their merged nodes, the first limit are returned.
+func (p *PartitionedMemoryIdx) FindLimit(orgId uint32, pattern string, from int64, limit int) ([]idx.Node, bool, error) {
+	return p.findLimit(context.Background(), orgId, pattern, from, limit)
+}
+
+func (p *PartitionedMemoryIdx) findLimit(ctx context.Context, orgId uint32, pattern string, from int64, limit int) ([]idx.Node, bool, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, false, errInvalidOrgId
+	}
+	var results []idx.Node
+	var truncated bool
+	byPath := make(map[string]int)
+	for _, m := range p.all() {
+		nodes, limited, err := m.findLimit(ctx, orgId, pattern, from, limit)
+		if err != nil {
+			return nil, false, err
+		}
+		truncated = truncated || limited
+		results = mergeByPath(results, byPath, nodes)
+	}
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+		truncated = true
+	}
+	// like MemoryIdx.Find, exclude the public defs if there are private defs with the same path.
+	// they may live in different partitions.
+	if orgId != idx.OrgIdPublic && idx.OrgIdPublic > 0 {
+		for i := range results {
+			results[i].Defs = excludePublic(results[i].Defs)
+		}
+	}
+	recordFindSeries(orgId, pattern, results)
+	return results, truncated, nil
+}
+
+// FindFiltered searches all partitions like Find, and filters the results like MemoryIdx.FindFiltered
+func (p *PartitionedMemoryIdx) FindFiltered(orgId uint32, pattern string, from int64, filters map[string]string) ([]idx.Node, error) {
+	if err := validateFindFilters(filters); err != nil {
+		return nil, err
+	}
+	nodes, err := p.Find(orgId, pattern, from)
+	if err != nil {
+		return nil, err
+	}
+	return filterNodes(nodes, filters), nil
+}
+
+// FindExcluding searches all partitions like Find, and leaves out the paths matching exclude in any partition
+func (p *PartitionedMemoryIdx) FindExcluding(orgId uint32, include, exclude string, from int64) ([]idx.Node, error) {
+	nodes, err := p.Find(orgId, include, from)
+	if err != nil {
+		return nil, err
+	}
+	excluded := make(map[string]struct{})
+	for _, m := range p.all() {
+		if err := m.addPaths(orgId, exclude, excluded); err != nil {
+			return nil, err
+		}
+	}
+	return excludePaths(nodes, excluded), nil
+}
+
+// FindAllOrgs searches all partitions and merges the nodes with the same org and path
+func (p *PartitionedMemoryIdx) FindAllOrgs(pattern string, from int64) (map[uint32][]idx.Node, error) {
+	results := make(map[uint32][]idx.Node)
+	byPath := make(map[uint32]map[string]int)
+	for _, m := range p.all() {
+		nodesByOrg, err := m.FindAllOrgs(pattern, from)
+		if err != nil {
+			return nil, err
+		}
+		for orgId, nodes := range nodesByOrg {
+			if _, ok := byPath[orgId]; !ok {
+				byPath[orgId] = make(map[string]int)
+			}
+			results[orgId] = mergeByPath(results[orgId], byPath[orgId], nodes)
+		}
+	}
+	return results, nil
+}
+
+// mergeByPath adds the nodes to results, merging them into the result with the same path, if any.
+// byPath tracks the position of each path in results.
+func mergeByPath(results []idx.Node, byPath map[string]int, nodes []idx.Node) []idx.Node {
+	for _, n := range nodes {
+		i, ok := byPath[n.Path]
+		if !ok {
+			byPath[n.Path] = len(results)
+			results = append(results, n)
+			continue
+		}
+		r := &results[i]
+		r.Leaf = r.Leaf || n.Leaf
+		r.HasChildren = r.HasChildren || n.HasChildren
+		r.Defs = append(r.Defs, n.Defs...)
+	}
+	return results
+}
+
+// excludePublic returns the defs that are not in the public org, unless all of them are
+func excludePublic(defs []idx.Archive) []idx.Archive {
+	var private []idx.Archive
+	for _, def := range defs {
+		if def.OrgId != idx.OrgIdPublic {
+			private = append(private, def)
+		}
+	}
+	if len(private) == 0 || len(private) == len(defs) {
+		return defs
+	}
+	return private
+}
+
+func (p *PartitionedMemoryIdx) FindByTag(orgId uint32, expressions []string, from int64) ([]idx.Node, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
+	var results []idx.Node
+	for _, m := range p.all() {
+		nodes, err := m.FindByTag(orgId, expressions, from)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, nodes...)
+	}
+	return results, nil
+}
+
+func (p *PartitionedMemoryIdx) Tags(orgId uint32, filter string, from int64) ([]string, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
+	var lists [][]string
+	for _, m := range p.all() {
+		tags, err := m.Tags(orgId, filter, from)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, tags)
+	}
+	return mergeSorted(lists, 0), nil
+}
+
+func (p *PartitionedMemoryIdx) FindTags(orgId uint32, prefix string, expressions []string, from int64, limit uint) ([]string, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
+	var lists [][]string
+	for _, m := range p.all() {
+		tags, err := m.FindTags(orgId, prefix, expressions, from, limit)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, tags)
+	}
+	return mergeSorted(lists, limit), nil
+}
+
+func (p *PartitionedMemoryIdx) FindTagValues(orgId uint32, tag, prefix string, expressions []string, from int64, limit uint) ([]string, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
+	var lists [][]string
+	for _, m := range p.all() {
+		values, err := m.FindTagValues(orgId, tag, prefix, expressions, from, limit)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, values)
+	}
+	return mergeSorted(lists, limit), nil
+}
+
+// mergeSorted returns the sorted, distinct strings of all lists.
+// if limit > 0, only the first limit strings are returned.
+func mergeSorted(lists [][]string, limit uint) []string {
+	seen := make(map[string]struct{})
+	var res []string
+	for _, list := range lists {
+		for _, s := range list {
+			if _, ok := seen[s]; ok {
+				continue
+			}
+			seen[s] = struct{}{}
+			res = append(res, s)
+		}
+	}
+	sort.Strings(res)
+	if limit > 0 && uint(len(res)) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+func (p *PartitionedMemoryIdx) TagDetails(orgId uint32, key, filter string, from int64) (map[string]uint64, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
+	res := make(map[string]uint64)
+	for _, m := range p.all() {
+		values, err := m.TagDetails(orgId, key, filter, from)
+		if err != nil {
+			return nil, err
+		}
+		for value, count := range values {
+			res[value] += count
+		}
+	}
+	return res, nil
+}
+
+func (p *PartitionedMemoryIdx) Delete(orgId uint32, pattern string) ([]idx.Archive, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
+	defer p.updateMetricsActive()
+	var deleted []idx.Archive
+	for _, m := range p.all() {
+		archives, err := m.Delete(orgId, pattern)
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, archives...)
+	}
+	return deleted, nil
+}
+
+func (p *PartitionedMemoryIdx) DeleteTagged(orgId uint32, paths []string) ([]idx.Archive, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
+	defer p.updateMetricsActive()
+	var deleted []idx.Archive
+	for _, m := range p.all() {
+		archives, err := m.DeleteTagged(orgId, paths)
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, archives...)
+	}
+	return deleted, nil
+}
+
+func (p *PartitionedMemoryIdx) DeleteById(id schema.MKey) (idx.Archive, error) {
+	for _, m := range p.all() {
+		if _, ok := m.get(id); !ok {
+			continue
+		}
+		archive, err := m.DeleteById(id)
+		p.updateMetricsActive()
+		return archive, err
+	}
+	return idx.Archive{}, errors.NewNotFound(fmt.Sprintf("metricDef %s not found in index", id))
+}
+
+func (p *PartitionedMemoryIdx) DeleteOrg(orgId uint32) ([]idx.Archive, error) {
+	if !idx.ValidOrgId(orgId) {
+		return nil, errInvalidOrgId
+	}
+	defer p.updateMetricsActive()
+	var deleted []idx.Archive
+	for _, m := range p.all() {
+		archives, err := m.DeleteOrg(orgId)
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, archives...)
+	}
+	return deleted, nil
+}
+
+// Rename renames the metricDefinition in the partition that holds it, like MemoryIdx.Rename.
+// The other partitions are checked for metricDefinitions with the new name first.
+func (p *PartitionedMemoryIdx) Rename(id schema.MKey, newName string) (idx.Archive, error) {
+	var owner *MemoryIdx
+	var def schema.MetricDefinition
+	for _, m := range p.all() {
+		if archive, ok := m.get(id); ok {
+			owner = m
+			def = renamed(&archive.MetricDefinition, newName)
+			break
+		}
+	}
+	if owner == nil {
+		return idx.Archive{}, errors.NewNotFound(fmt.Sprintf("metricDef %s not found in index", id))
+	}
+	for _, m := range p.all() {
+		if m == owner {
+			continue
+		}
+		m.RLock()
+		taken := m.hasDefsWithName(&def)
+		m.RUnlock()
+		if taken {
+			return idx.Archive{}, errors.NewBadRequest(fmt.Sprintf("can't rename metricDef %s: org %d already has a metric named %s", id, def.OrgId, def.NameWithTags()))
+		}
+	}
+	return owner.Rename(id, newName)
+}
+
+// Evict removes the least recently updated series across all partitions, until they hold at most max series in total
+func (p *PartitionedMemoryIdx) Evict(max int) []idx.Archive {
+	defer p.updateMetricsActive()
+	indexes := p.all()
+	var candidates []evictCandidate
+	partitionOf := make(map[schema.MKey]*MemoryIdx)
+	for _, m := range indexes {
+		m.RLock()
+		for _, c := range m.evictCandidates() {
+			candidates = append(candidates, c)
+			partitionOf[c.id] = m
+		}
+		m.RUnlock()
+	}
+	n := len(candidates) - max
+	if n <= 0 {
+		return nil
+	}
+
+	byPartition := make(map[*MemoryIdx][]evictCandidate)
+	for _, c := range oldest(candidates, n) {
+		m := partitionOf[c.id]
+		byPartition[m] = append(byPartition[m], c)
+	}
+	var evicted []idx.Archive
+	for _, m := range indexes {
+		if len(byPartition[m]) > 0 {
+			evicted = append(evicted, m.evict(byPartition[m])...)
+		}
+	}
+	return evicted
+}
+
+// Prune prunes the partitions one after the other
+func (p *PartitionedMemoryIdx) Prune(now time.Time) ([]idx.Archive, error) {
+	defer p.updateMetricsActive()
+	var pruned []idx.Archive
+	for _, m := range p.all() {
+		archives, err := m.Prune(now)
+		if err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, archives...)
+	}
+	return pruned, nil
+}
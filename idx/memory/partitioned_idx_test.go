@@ -0,0 +1,865 @@
+package memory
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func addToPartition(ix MemoryIndex, org int, name string, interval int, partition int32) (schema.MKey, bool) {
+	md := &schema.MetricData{Name: name, OrgId: org, Interval: interval, Time: 10}
+	md.SetId()
+	mkey, _ := schema.MKeyFromString(md.Id)
+	_, _, inMemory := ix.AddOrUpdate(mkey, md, partition)
+	return mkey, inMemory
+}
+
+func TestPartitionedFind(t *testing.T) {
+	ix := NewPartitionedMemoryIdx()
+	ix.Init()
+	defer ix.Stop()
+
+	addToPartition(ix, 1, "metric.demo.a", 10, 0)
+	addToPartition(ix, 1, "metric.demo.b", 10, 1)
+	// same path, different interval, different partition
+	addToPartition(ix, 1, "metric.demo.b", 60, 2)
+
+	nodes, err := ix.Find(1, "metric.demo.*", 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got %v", nodes)
+	}
+	for _, n := range nodes {
+		exp := 1
+		if n.Path == "metric.demo.b" {
+			exp = 2
+		}
+		if !n.Leaf || len(n.Defs) != exp {
+			t.Errorf("expected leaf node %s to have %d defs, got %v", n.Path, exp, n)
+		}
+	}
+
+	nodes, err = ix.Find(1, "metric.*", 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(nodes) != 1 || nodes[0].Leaf || !nodes[0].HasChildren {
+		t.Fatalf("expected the single branch metric.demo, got %v", nodes)
+	}
+	if len(ix.List(1)) != 3 || ix.CountAll() != 3 {
+		t.Fatalf("expected 3 defs, got %d (count %d)", len(ix.List(1)), ix.CountAll())
+	}
+}
+
+func TestPartitionedFindExcludesPublic(t *testing.T) {
+	idx.OrgIdPublic = 100
+	defer func() { idx.OrgIdPublic = 0 }()
+
+	ix := NewPartitionedMemoryIdx()
+	ix.Init()
+	defer ix.Stop()
+
+	addToPartition(ix, 1, "metric.demo.a", 10, 0)
+	addToPartition(ix, 100, "metric.demo.a", 10, 1)
+	addToPartition(ix, 100, "metric.demo.b", 10, 1)
+
+	nodes, err := ix.Find(1, "metric.demo.*", 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got %v", nodes)
+	}
+	for _, n := range nodes {
+		expOrg := uint32(1)
+		if n.Path == "metric.demo.b" {
+			expOrg = 100
+		}
+		if len(n.Defs) != 1 || n.Defs[0].OrgId != expOrg {
+			t.Errorf("expected node %s to have 1 def of org %d, got %v", n.Path, expOrg, n.Defs)
+		}
+	}
+}
+
+func TestPartitionedMove(t *testing.T) {
+	ix := NewPartitionedMemoryIdx()
+	ix.Init()
+	defer ix.Stop()
+
+	mkey, inMemory := addToPartition(ix, 1, "metric.demo.a", 10, 1)
+	if inMemory {
+		t.Fatalf("expected new series not to be in memory yet")
+	}
+	md := &schema.MetricData{Name: "metric.demo.a", OrgId: 1, Interval: 10, Time: 20}
+	md.SetId()
+	archive, oldPartition, inMemory := ix.AddOrUpdate(mkey, md, 2)
+	if !inMemory || oldPartition != 1 || archive.Partition != 2 {
+		t.Fatalf("expected series to move from partition 1 to 2, got inMemory %t, old partition %d, partition %d", inMemory, oldPartition, archive.Partition)
+	}
+	if ix.CountAll() != 1 {
+		t.Fatalf("expected 1 def after the move, got %d", ix.CountAll())
+	}
+	if archive, ok := ix.Get(mkey); !ok || archive.Partition != 2 {
+		t.Fatalf("expected to get series in partition 2, got %v (found %t)", archive, ok)
+	}
+	if _, _, ok := ix.Update(schema.MetricPoint{MKey: mkey, Time: 30}, 2); !ok {
+		t.Fatalf("expected update in partition 2 after the move")
+	}
+
+	if _, err := ix.DeleteById(mkey); err != nil {
+		t.Fatalf("unexpected error deleting series: %s", err)
+	}
+	if _, err := ix.DeleteById(mkey); err == nil {
+		t.Fatalf("expected an error deleting a series that no longer exists")
+	}
+}
+
+// a series that moves partitions may do so with a MetricPoint, which must not be dropped as unknown
+func TestPartitionedMoveMetricPoint(t *testing.T) {
+	ix := NewPartitionedMemoryIdx()
+	ix.Init()
+	defer ix.Stop()
+
+	mkey, _ := addToPartition(ix, 1, "metric.demo.a", 10, 1)
+	archive, oldPartition, inMemory := ix.Update(schema.MetricPoint{MKey: mkey, Time: 30}, 2)
+	if !inMemory || oldPartition != 1 || archive.Partition != 2 || archive.LastUpdate != 30 {
+		t.Fatalf("expected series to move from partition 1 to 2 and be updated, got inMemory %t, old partition %d, %v", inMemory, oldPartition, archive)
+	}
+	if ix.CountAll() != 1 {
+		t.Fatalf("expected 1 def after the move, got %d", ix.CountAll())
+	}
+	if archive, ok := ix.Get(mkey); !ok || archive.Partition != 2 || archive.LastUpdate != 30 {
+		t.Fatalf("expected to get the updated series in partition 2, got %v (found %t)", archive, ok)
+	}
+	if _, oldPartition, ok := ix.Update(schema.MetricPoint{MKey: mkey, Time: 40}, 2); !ok || oldPartition != 2 {
+		t.Fatalf("expected update in partition 2 after the move, got found %t, old partition %d", ok, oldPartition)
+	}
+	if nodes, err := ix.Find(1, "metric.demo.a", 0); err != nil || len(nodes) != 1 || len(nodes[0].Defs) != 1 {
+		t.Fatalf("expected to find the moved series once, got %v (error %v)", nodes, err)
+	}
+
+	unknown := test.GetMKey(99)
+	if _, _, ok := ix.Update(schema.MetricPoint{MKey: unknown, Time: 30}, 2); ok {
+		t.Fatalf("expected no update for an unknown series")
+	}
+}
+
+func TestPartitionedEvict(t *testing.T) {
+	ix := NewPartitionedMemoryIdx()
+	ix.Init()
+	defer ix.Stop()
+
+	var mkeys []schema.MKey
+	for i := 0; i < 6; i++ {
+		md := &schema.MetricData{Name: fmt.Sprintf("metric.evict.%d", i), OrgId: 1, Interval: 10, Time: int64(100 - i)}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		ix.AddOrUpdate(mkey, md, int32(i%3))
+		mkeys = append(mkeys, mkey)
+	}
+
+	// the least recently updated series across all partitions must go
+	if evicted := ix.Evict(2); len(evicted) != 4 {
+		t.Fatalf("expected 4 series to be evicted, got %d", len(evicted))
+	}
+	for i, mkey := range mkeys {
+		if _, ok := ix.Get(mkey); ok != (i < 2) {
+			t.Errorf("series %d: expected to be in index: %t, got %t", i, i < 2, ok)
+		}
+	}
+	if ix.CountAll() != 2 {
+		t.Fatalf("expected 2 series left, got %d", ix.CountAll())
+	}
+}
+
+// benchmarkConcurrentIngestAndFind runs b.N operations over 32 goroutines:
+// 1 in 4 adds a new series, spread over 8 partitions, the others run a find.
+func benchmarkConcurrentIngestAndFind(b *testing.B, ix MemoryIndex) {
+	ix.Init()
+	defer ix.Stop()
+	newCorpusIndex(ix, 10000, 8, false)
+
+	var ops int64 = -1
+	var wg sync.WaitGroup
+	b.ReportAllocs()
+	b.ResetTimer()
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := atomic.AddInt64(&ops, 1)
+				if n >= int64(b.N) {
+					return
+				}
+				if n%4 == 0 {
+					addToPartition(ix, 1, fmt.Sprintf("new.metric.%d", n), 10, int32(n%8))
+					continue
+				}
+				if _, err := ix.Find(1, corpusPatterns[n%int64(len(corpusPatterns))], 0); err != nil {
+					panic(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkConcurrent32IngestAndFind(b *testing.B) {
+	benchmarkConcurrentIngestAndFind(b, New())
+}
+
+func BenchmarkConcurrent32IngestAndFindPartitioned(b *testing.B) {
+	benchmarkConcurrentIngestAndFind(b, NewPartitionedMemoryIdx())
+}
+
+func TestGetHitMiss(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		mkey, _ := addToPartition(ix, 1, "metric.demo.a", 10, 2)
+		addToPartition(ix, 1, "metric.demo.b", 10, 1)
+
+		hits, misses := statGetHit.Peek(), statGetMiss.Peek()
+		ix.Get(mkey)
+		ix.Get(mkey)
+		ix.Get(schema.MKey{Org: 2})
+		if hit := statGetHit.Peek() - hits; hit != 2 {
+			t.Errorf("%T: expected 2 hits, got %d", ix, hit)
+		}
+		if miss := statGetMiss.Peek() - misses; miss != 1 {
+			t.Errorf("%T: expected 1 miss, got %d", ix, miss)
+		}
+		ix.Stop()
+	}
+}
+
+func TestIntervalProvisional(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		mkey, _ := addToPartition(ix, 1, "metric.demo.a", 10, 1)
+		archive, _ := ix.Get(mkey)
+		if archive.Observations != 1 || !archive.IntervalProvisional() {
+			t.Errorf("%T: expected provisional interval after 1 point, got %d observations", ix, archive.Observations)
+		}
+
+		ix.Update(schema.MetricPoint{MKey: mkey, Time: 20}, 1)
+		archive, _ = ix.Get(mkey)
+		if archive.Observations != 2 || archive.IntervalProvisional() {
+			t.Errorf("%T: expected confirmed interval after 2 points, got %d observations", ix, archive.Observations)
+		}
+
+		loaded := archive.MetricDefinition
+		loaded.Id = schema.MKey{Org: 1}
+		ix.Load([]schema.MetricDefinition{loaded})
+		if archive, _ := ix.Get(loaded.Id); archive.IntervalProvisional() {
+			t.Errorf("%T: expected loaded def not to be provisional", ix)
+		}
+		ix.Stop()
+	}
+}
+
+func TestDeleteOrg(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		addToPartition(ix, 1, "metric.demo.a", 10, 0)
+		addToPartition(ix, 1, "metric.demo.b", 10, 1)
+		addToPartition(ix, 2, "metric.demo.a", 10, 0)
+		public, _ := addToPartition(ix, int(idx.OrgIdPublic), "metric.public", 10, 1)
+
+		if _, err := ix.DeleteOrg(idx.OrgIdPublic); err == nil {
+			t.Errorf("%T: expected error deleting the public org", ix)
+		}
+
+		deleted, err := ix.DeleteOrg(1)
+		if err != nil || len(deleted) != 2 {
+			t.Errorf("%T: expected 2 defs deleted without error, got %d and %v", ix, len(deleted), err)
+		}
+		if nodes, _ := ix.Find(1, "metric.demo.*", 0); len(nodes) != 0 {
+			t.Errorf("%T: expected no metrics to remain for org 1, got %v", ix, nodes)
+		}
+		if _, ok := ix.Get(public); !ok {
+			t.Errorf("%T: expected the public metric to be untouched", ix)
+		}
+		if nodes, _ := ix.Find(2, "metric.demo.*", 0); len(nodes) != 1 {
+			t.Errorf("%T: expected org 2 to be untouched, got %v", ix, nodes)
+		}
+
+		// deleting again is a no-op
+		deleted, err = ix.DeleteOrg(1)
+		if err != nil || len(deleted) != 0 {
+			t.Errorf("%T: expected second delete to be a no-op, got %d and %v", ix, len(deleted), err)
+		}
+		ix.Stop()
+	}
+}
+
+// the Key part of an id is a hash of the metric's properties, excluding the org,
+// so the same metric in different orgs has the same Key. Defs are keyed by Org and Key.
+func TestSameKeyAcrossOrgs(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		a, _ := addToPartition(ix, 1, "metric.demo.a", 10, 0)
+		b, _ := addToPartition(ix, 2, "metric.demo.a", 10, 1)
+		if a.Key != b.Key {
+			t.Fatalf("%T: expected the same Key for both orgs, got %s and %s", ix, a, b)
+		}
+
+		archive, ok := ix.Get(a)
+		if !ok || archive.OrgId != 1 || archive.Partition != 0 {
+			t.Errorf("%T: expected the def of org 1, got %v", ix, archive)
+		}
+		archive, ok = ix.Get(b)
+		if !ok || archive.OrgId != 2 || archive.Partition != 1 {
+			t.Errorf("%T: expected the def of org 2, got %v", ix, archive)
+		}
+
+		if _, err := ix.DeleteById(a); err != nil {
+			t.Errorf("%T: unexpected error %s", ix, err)
+		}
+		if _, ok := ix.Get(b); !ok {
+			t.Errorf("%T: expected the def of org 2 to survive deleting the one of org 1", ix)
+		}
+		if nodes, _ := ix.Find(2, "metric.demo.a", 0); len(nodes) != 1 || len(nodes[0].Defs) != 1 || nodes[0].Defs[0].OrgId != 2 {
+			t.Errorf("%T: expected org 2 to find its own def, got %v", ix, nodes)
+		}
+		ix.Stop()
+	}
+}
+
+func TestFindBroad(t *testing.T) {
+	defer func(threshold int) { findBroadThreshold = threshold }(findBroadThreshold)
+	findBroadThreshold = 2
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		addToPartition(ix, 1, "metric.demo.a", 10, 0)
+		addToPartition(ix, 1, "metric.demo.b", 10, 1)
+		addToPartition(ix, 1, "metric.demo.b", 60, 2)
+
+		broad := statFindBroad.Peek()
+		ix.Find(1, "metric.demo.a", 0)
+		ix.Find(1, "metric.demo.b", 0)
+		if statFindBroad.Peek() != broad {
+			t.Errorf("%T: expected finds of up to 2 series not to be broad", ix)
+		}
+		ix.Find(1, "metric.demo.*", 0)
+		if statFindBroad.Peek() != broad+1 {
+			t.Errorf("%T: expected find of 3 series to be broad", ix)
+		}
+		ix.Stop()
+	}
+}
+
+func TestRename(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		typo, _ := addToPartition(ix, 1, "metric.dmeo.a", 10, 0)
+		addToPartition(ix, 1, "metric.demo.b", 10, 1)
+		ix.Update(schema.MetricPoint{MKey: typo, Time: 20}, 0)
+
+		if _, err := ix.Rename(typo, "metric.demo.b"); err == nil {
+			t.Errorf("%T: expected error renaming to the name of another def", ix)
+		}
+
+		archive, err := ix.Rename(typo, "metric.demo.a")
+		if err != nil {
+			t.Fatalf("%T: unexpected error %s", ix, err)
+		}
+		if archive.Id != typo || archive.Name != "metric.demo.a" || archive.LastUpdate != 20 || archive.Observations != 2 {
+			t.Errorf("%T: expected def %s renamed to metric.demo.a, keeping lastUpdate 20 and 2 observations, got %v", ix, typo, archive)
+		}
+		if nodes, _ := ix.Find(1, "metric.demo.a", 0); len(nodes) != 1 || len(nodes[0].Defs) != 1 || nodes[0].Defs[0].Id != typo {
+			t.Errorf("%T: expected to find def %s under its new name, got %v", ix, typo, nodes)
+		}
+		if nodes, _ := ix.Find(1, "metric.dmeo.*", 0); len(nodes) != 0 {
+			t.Errorf("%T: expected not to find anything under the old name, got %v", ix, nodes)
+		}
+		if _, err := ix.Rename(schema.MKey{Org: 1}, "metric.demo.c"); err == nil {
+			t.Errorf("%T: expected error renaming an unknown def", ix)
+		}
+		ix.Stop()
+	}
+}
+
+func TestOrgBoundaries(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		addToPartition(ix, 1, "metric.org1", 10, 0)
+		addToPartition(ix, 2, "metric.org2", 10, 1)
+		// e.g. loaded from a backend store as public while the public org is disabled
+		addToPartition(ix, 0, "metric.org0", 10, 1)
+		addToPartition(ix, 100, "metric.org100", 10, 0)
+
+		// org 0 is never valid, whether there is a public org or not
+		for _, public := range []uint32{0, 100} {
+			idx.OrgIdPublic = public
+			if _, err := ix.Find(0, "metric.*", 0); err == nil {
+				t.Fatalf("public org %d: expected Find for org 0 to fail", public)
+			}
+			if archives := ix.List(0); len(archives) != 0 {
+				t.Fatalf("public org %d: expected List for org 0 to be empty, got %v", public, archives)
+			}
+			if archives := ix.ListPrefix(0, "metric", 0, 0); len(archives) != 0 {
+				t.Fatalf("public org %d: expected ListPrefix for org 0 to be empty, got %v", public, archives)
+			}
+			if _, err := ix.Tags(0, "", 0); err == nil {
+				t.Fatalf("public org %d: expected Tags for org 0 to fail", public)
+			}
+			if _, err := ix.FindTags(0, "", nil, 0, 0); err == nil {
+				t.Fatalf("public org %d: expected FindTags for org 0 to fail", public)
+			}
+			if _, err := ix.FindByTag(0, []string{"name=metric.org0"}, 0); err == nil {
+				t.Fatalf("public org %d: expected FindByTag for org 0 to fail", public)
+			}
+			if _, err := ix.Delete(0, "metric.*"); err == nil {
+				t.Fatalf("public org %d: expected Delete for org 0 to fail", public)
+			}
+			if _, err := ix.DeleteOrg(0); err == nil {
+				t.Fatalf("public org %d: expected DeleteOrg for org 0 to fail", public)
+			}
+		}
+
+		cases := []struct {
+			public uint32
+			org    uint32
+			exp    int
+		}{
+			// without a public org, the defs of org 0 must not leak into other orgs
+			{0, 1, 1},
+			{0, 2, 1},
+			{0, 100, 1},
+			// with a public org, its defs are visible to all orgs
+			{100, 1, 2},
+			{100, 2, 2},
+			{100, 100, 1},
+			{100, 3, 1},
+		}
+		for _, c := range cases {
+			idx.OrgIdPublic = c.public
+			nodes, err := ix.Find(c.org, "metric.*", 0)
+			if err != nil {
+				t.Fatalf("public org %d, org %d: unexpected error %s", c.public, c.org, err)
+			}
+			if len(nodes) != c.exp {
+				t.Fatalf("public org %d, org %d: expected %d nodes from Find, got %d", c.public, c.org, c.exp, len(nodes))
+			}
+			if archives := ix.List(c.org); len(archives) != c.exp {
+				t.Fatalf("public org %d, org %d: expected %d archives from List, got %d", c.public, c.org, c.exp, len(archives))
+			}
+			if archives := ix.ListSince(c.org, 0); len(archives) != c.exp {
+				t.Fatalf("public org %d, org %d: expected %d archives from ListSince, got %d", c.public, c.org, c.exp, len(archives))
+			}
+		}
+		idx.OrgIdPublic = 0
+		ix.Stop()
+	}
+}
+
+func TestGetPaths(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		addToPartition(ix, 1, "alerts.a", 10, 0)
+		addToPartition(ix, 1, "alerts.b", 10, 1)
+		addToPartition(ix, 1, "alerts.b", 60, 2)
+		addToPartition(ix, 1, "alerts.c", 10, 2)
+		addToPartition(ix, 2, "alerts.d", 10, 0)
+
+		archives := ix.GetPaths(1, []string{"alerts.c", "alerts.missing", "alerts", "alerts.d", "alerts.b", "alerts.a"})
+		var got []string
+		for _, archive := range archives {
+			got = append(got, archive.Name)
+		}
+		// alerts is a branch, and alerts.d belongs to another org
+		exp := []string{"alerts.c", "alerts.b", "alerts.b", "alerts.a"}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%T: expected %v, got %v", ix, exp, got)
+		}
+		if archives := ix.GetPaths(3, []string{"alerts.a"}); len(archives) != 0 {
+			t.Errorf("%T: expected no archives for an org without defs, got %v", ix, archives)
+		}
+		ix.Stop()
+	}
+}
+
+func TestOnNewSeries(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		var calls uint32
+		var last atomic.Value
+		ix.OnNewSeries(func(def *schema.MetricDefinition) {
+			atomic.AddUint32(&calls, 1)
+			last.Store(def.Name)
+		})
+		ix.Init()
+
+		// concurrent adds of the same series only create it once
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				addToPartition(ix, 1, "new.series", 10, 0)
+			}()
+		}
+		wg.Wait()
+		if calls != 1 {
+			t.Fatalf("%T: expected 1 call for concurrent adds of the same series, got %d", ix, calls)
+		}
+		if name := last.Load(); name != "new.series" {
+			t.Fatalf("%T: expected the hook to get new.series, got %v", ix, name)
+		}
+
+		// a series moving to another partition is not new
+		addToPartition(ix, 1, "new.series", 10, 1)
+		if calls != 1 {
+			t.Fatalf("%T: expected no call for a series that moved partitions, got %d calls", ix, calls)
+		}
+
+		// series that occur more than once in a batch are created once
+		var mkeys []schema.MKey
+		var data []*schema.MetricData
+		for _, name := range []string{"batch.a", "batch.b", "batch.a", "new.series"} {
+			md := &schema.MetricData{Name: name, OrgId: 1, Interval: 10, Time: 10}
+			md.SetId()
+			mkey, _ := schema.MKeyFromString(md.Id)
+			mkeys = append(mkeys, mkey)
+			data = append(data, md)
+		}
+		ix.AddOrUpdateMany(mkeys, data, 1)
+		if calls != 3 {
+			t.Fatalf("%T: expected 3 calls after adding a batch with 2 new series, got %d", ix, calls)
+		}
+
+		// loading defs from a persistent store doesn't create new series
+		ix.Load([]schema.MetricDefinition{{Id: test.GetMKey(9), OrgId: 1, Name: "loaded", Interval: 10}})
+		if calls != 3 {
+			t.Fatalf("%T: expected no call for loaded defs, got %d calls", ix, calls)
+		}
+		ix.Stop()
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		a, _ := addToPartition(ix, 1, "metric.demo.a", 10, 2)
+		b, _ := addToPartition(ix, 1, "metric.demo.b", 10, 1)
+		missing := schema.MKey{Org: 2}
+
+		hits, misses := statGetHit.Peek(), statGetMiss.Peek()
+		archives := ix.GetMany([]schema.MKey{a, b, missing})
+		if len(archives) != 2 || archives[a].Name != "metric.demo.a" || archives[b].Name != "metric.demo.b" {
+			t.Errorf("%T: expected metric.demo.a and metric.demo.b, got %v", ix, archives)
+		}
+		if hit, miss := statGetHit.Peek()-hits, statGetMiss.Peek()-misses; hit != 2 || miss != 1 {
+			t.Errorf("%T: expected 2 hits and 1 miss, got %d and %d", ix, hit, miss)
+		}
+		ix.Stop()
+	}
+}
+
+func TestFindAllOrgs(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		addToPartition(ix, 1, "metric.demo.a", 10, 0)
+		addToPartition(ix, 1, "metric.demo.a", 60, 1)
+		addToPartition(ix, 2, "metric.demo.a", 10, 1)
+		addToPartition(ix, 2, "metric.other.a", 10, 1)
+		addToPartition(ix, 3, "metric.other.b", 10, 2)
+
+		results, err := ix.FindAllOrgs("metric.demo.*", 0)
+		if err != nil {
+			t.Fatalf("%T: unexpected error %s", ix, err)
+		}
+		if len(results) != 2 || len(results[1]) != 1 || len(results[2]) != 1 {
+			t.Fatalf("%T: expected metric.demo.a in orgs 1 and 2, got %v", ix, results)
+		}
+		for org, exp := range map[uint32]int{1: 2, 2: 1} {
+			n := results[org][0]
+			if n.Path != "metric.demo.a" || len(n.Defs) != exp {
+				t.Errorf("%T: expected org %d to have %d defs for metric.demo.a, got %v", ix, org, exp, n)
+			}
+			for _, def := range n.Defs {
+				if def.OrgId != org {
+					t.Errorf("%T: expected defs of org %d, got %v", ix, org, def)
+				}
+			}
+		}
+		ix.Stop()
+	}
+}
+
+func TestFindExcluding(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		addToPartition(ix, 1, "servers.web1.cpu", 10, 0)
+		addToPartition(ix, 1, "servers.web2.cpu", 10, 1)
+		addToPartition(ix, 1, "servers.db1.cpu", 10, 2)
+		addToPartition(ix, 1, "servers.db1.mem", 10, 0)
+		addToPartition(ix, 2, "servers.web3.cpu", 10, 0)
+
+		cases := []struct {
+			include string
+			exclude string
+			exp     []string
+		}{
+			{"servers.*.cpu", "servers.web*.cpu", []string{"servers.db1.cpu"}},
+			{"servers.*.cpu", "servers.{web1,db1}.*", []string{"servers.web2.cpu"}},
+			{"servers.*.cpu", "servers.nope.cpu", []string{"servers.db1.cpu", "servers.web1.cpu", "servers.web2.cpu"}},
+			{"servers.*.cpu", "servers.*.*", []string{}},
+			// branches can be excluded too
+			{"servers.*", "servers.db*", []string{"servers.web1", "servers.web2"}},
+		}
+		for i, c := range cases {
+			nodes, err := ix.FindExcluding(1, c.include, c.exclude, 0)
+			if err != nil {
+				t.Fatalf("%T: case %d: unexpected error %s", ix, i, err)
+			}
+			got := make([]string, 0, len(nodes))
+			for _, n := range nodes {
+				got = append(got, n.Path)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, c.exp) {
+				t.Errorf("%T: case %d: expected %v, got %v", ix, i, c.exp, got)
+			}
+		}
+		if _, err := ix.FindExcluding(0, "servers.*", "servers.db*", 0); err == nil {
+			t.Errorf("%T: expected an error for org 0", ix)
+		}
+		ix.Stop()
+	}
+}
+
+func TestFindFiltered(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		add := func(name, unit, mtype string, interval int, partition int32) {
+			md := &schema.MetricData{Name: name, OrgId: 1, Interval: interval, Unit: unit, Mtype: mtype, Time: 10}
+			md.SetId()
+			mkey, _ := schema.MKeyFromString(md.Id)
+			ix.AddOrUpdate(mkey, md, partition)
+		}
+		add("timers.a", "ms", "gauge", 10, 0)
+		add("timers.a", "s", "gauge", 60, 1)
+		add("timers.b", "ms", "counter", 10, 1)
+		add("timers.c", "B", "gauge", 10, 2)
+
+		cases := []struct {
+			filters map[string]string
+			exp     map[string]int // number of defs by path
+		}{
+			{nil, map[string]int{"timers.a": 2, "timers.b": 1, "timers.c": 1}},
+			{map[string]string{"unit": "ms"}, map[string]int{"timers.a": 1, "timers.b": 1}},
+			{map[string]string{"unit": "ms", "mtype": "gauge"}, map[string]int{"timers.a": 1}},
+			{map[string]string{"unit": "h"}, map[string]int{}},
+		}
+		for i, c := range cases {
+			nodes, err := ix.FindFiltered(1, "timers.*", 0, c.filters)
+			if err != nil {
+				t.Fatalf("%T: case %d: unexpected error %s", ix, i, err)
+			}
+			got := make(map[string]int)
+			for _, n := range nodes {
+				got[n.Path] = len(n.Defs)
+			}
+			if !reflect.DeepEqual(got, c.exp) {
+				t.Errorf("%T: case %d: expected %v, got %v", ix, i, c.exp, got)
+			}
+		}
+
+		// branches have no defs, so they don't match any filter
+		if nodes, err := ix.FindFiltered(1, "*", 0, map[string]string{"unit": "ms"}); err != nil || len(nodes) != 0 {
+			t.Errorf("%T: expected no branches, got %v (error %v)", ix, nodes, err)
+		}
+		if _, err := ix.FindFiltered(1, "timers.*", 0, map[string]string{"interval": "10"}); err == nil {
+			t.Errorf("%T: expected an error for an unknown filter field", ix)
+		}
+		ix.Stop()
+	}
+}
+
+func TestCountFindLimitIngestStats(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		for i := 0; i < 6; i++ {
+			addToPartition(ix, 1, fmt.Sprintf("metric.demo.%d", i), 10, int32(i%3))
+		}
+		// same path as metric.demo.0, in another partition
+		addToPartition(ix, 1, "metric.demo.0", 60, 1)
+		addToPartition(ix, 2, "metric.demo.0", 10, 2)
+		mkey, _ := addToPartition(ix, 1, "metric.demo.1", 10, 1)
+		ix.Update(schema.MetricPoint{MKey: mkey, Time: 20}, 1)
+
+		if count := ix.Count(1); count != 7 {
+			t.Errorf("%T: expected count 7 for org 1, got %d", ix, count)
+		}
+		if count := ix.Count(2); count != 1 {
+			t.Errorf("%T: expected count 1 for org 2, got %d", ix, count)
+		}
+
+		nodes, truncated, err := ix.FindLimit(1, "metric.demo.*", 0, 0)
+		if err != nil || truncated || len(nodes) != 6 {
+			t.Errorf("%T: expected all 6 nodes without limit, got %d nodes, truncated %t, error %v", ix, len(nodes), truncated, err)
+		}
+		nodes, truncated, err = ix.FindLimit(1, "metric.demo.*", 0, 4)
+		if err != nil || !truncated || len(nodes) != 4 {
+			t.Errorf("%T: expected 4 truncated nodes, got %d nodes, truncated %t, error %v", ix, len(nodes), truncated, err)
+		}
+		nodes, truncated, err = ix.FindLimit(1, "metric.demo.0", 0, 1)
+		if err != nil || truncated || len(nodes) != 1 || len(nodes[0].Defs) != 2 {
+			t.Errorf("%T: expected 1 node with 2 defs, got %v, truncated %t, error %v", ix, nodes, truncated, err)
+		}
+
+		exp := map[uint32]OrgIngestCounts{
+			1: {Added: 7, Refreshed: 2},
+			2: {Added: 1},
+		}
+		if stats := ix.IngestStats(); !reflect.DeepEqual(stats, exp) {
+			t.Errorf("%T: expected ingest stats %v, got %v", ix, exp, stats)
+		}
+		ix.Stop()
+	}
+}
+
+func TestGetMissCache(t *testing.T) {
+	defer func(ttl time.Duration) { missCacheTTL = ttl }(missCacheTTL)
+	missCacheTTL = time.Hour
+
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		addToPartition(ix, 1, "metric.known", 10, 0)
+		md := &schema.MetricData{Name: "metric.late", OrgId: 1, Interval: 10, Time: 10}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+
+		cached := statGetMissCached.Peek()
+		for i := 0; i < 3; i++ {
+			if _, ok := ix.Get(mkey); ok {
+				t.Fatalf("%T: expected %s not to be found before it is added", ix, mkey)
+			}
+		}
+		if got := statGetMissCached.Peek() - cached; got != 2 {
+			t.Fatalf("%T: expected the repeated gets of %s to be answered by the negative cache, got %d", ix, mkey, got)
+		}
+
+		// adding the id must end its negative caching, whichever partition it goes to
+		ix.AddOrUpdate(mkey, md, 1)
+		if _, ok := ix.Get(mkey); !ok {
+			t.Fatalf("%T: expected %s to be found once added", ix, mkey)
+		}
+		ix.Stop()
+	}
+}
+
+func TestListPrefix(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		for i, name := range []string{"collectd.host2.cpu", "collectd.host1.mem", "collectd.host1.cpu", "statsd.host1.cpu", "collectd.host10.cpu"} {
+			addToPartition(ix, 1, name, 10, int32(i%3))
+		}
+		addToPartition(ix, 2, "collectd.host1.disk", 10, 0)
+
+		paths := func(archives []idx.Archive) []string {
+			var out []string
+			for _, a := range archives {
+				out = append(out, a.Name)
+			}
+			return out
+		}
+		cases := []struct {
+			prefix        string
+			offset, limit int
+			exp           []string
+		}{
+			{"collectd.host1", 0, 0, []string{"collectd.host1.cpu", "collectd.host1.mem", "collectd.host10.cpu"}},
+			{"collectd.host1.", 0, 0, []string{"collectd.host1.cpu", "collectd.host1.mem"}},
+			{"collectd.", 0, 2, []string{"collectd.host1.cpu", "collectd.host1.mem"}},
+			{"collectd.", 2, 2, []string{"collectd.host10.cpu", "collectd.host2.cpu"}},
+			{"collectd.", 4, 2, nil},
+			{"nothing", 0, 0, nil},
+		}
+		for i, c := range cases {
+			if got := paths(ix.ListPrefix(1, c.prefix, c.offset, c.limit)); !reflect.DeepEqual(got, c.exp) {
+				t.Errorf("%T case %d: expected %v, got %v", ix, i, c.exp, got)
+			}
+		}
+		ix.Stop()
+	}
+}
+
+func TestListSorted(t *testing.T) {
+	defer func(public uint32) { idx.OrgIdPublic = public }(idx.OrgIdPublic)
+	idx.OrgIdPublic = 3
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		for i, name := range []string{"collectd.host2.cpu", "collectd.host1.mem", "collectd.host1.cpu", "statsd.host1.cpu", "collectd.host10.cpu"} {
+			addToPartition(ix, 1, name, 10, int32(i%3))
+		}
+		addToPartition(ix, 2, "collectd.host1.disk", 10, 0)
+		addToPartition(ix, 3, "aaa.public", 10, 1)
+		// tags sort after the name, so the tagged series must still come before collectd.host1.cpu
+		tagged := &schema.MetricData{Name: "collectd.host1", OrgId: 1, Interval: 10, Tags: []string{"dc=west"}}
+		tagged.SetId()
+		mkey, _ := schema.MKeyFromString(tagged.Id)
+		ix.AddOrUpdate(mkey, tagged, 2)
+
+		var got []string
+		for _, a := range ix.ListSorted(1) {
+			got = append(got, a.NameWithTags())
+		}
+		exp := []string{"aaa.public", "collectd.host1;dc=west", "collectd.host1.cpu", "collectd.host1.mem", "collectd.host10.cpu", "collectd.host2.cpu", "statsd.host1.cpu"}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%T: expected %v, got %v", ix, exp, got)
+		}
+		if archives := ix.ListSorted(0); len(archives) != 0 {
+			t.Errorf("%T: expected ListSorted for org 0 to be empty, got %v", ix, archives)
+		}
+		ix.Stop()
+	}
+}
+
+func TestLoadDuplicates(t *testing.T) {
+	for _, ix := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		ix.Init()
+		md := &schema.MetricData{Name: "metric.demo.a", OrgId: 1, Interval: 10}
+		md.SetId()
+		def := schema.MetricDefinitionFromMetricData(md)
+		other := &schema.MetricData{Name: "metric.demo.b", OrgId: 1, Interval: 10}
+		other.SetId()
+		otherDef := schema.MetricDefinitionFromMetricData(other)
+
+		withUpdate := func(def *schema.MetricDefinition, lastUpdate int64, partition int32) schema.MetricDefinition {
+			c := *def
+			c.LastUpdate = lastUpdate
+			c.Partition = partition
+			return c
+		}
+
+		duplicates := statLoadDuplicates.Peek()
+		// the newest copy must win, within a batch and across batches
+		num := ix.Load([]schema.MetricDefinition{withUpdate(def, 10, 0), withUpdate(def, 30, 1), withUpdate(def, 20, 2), withUpdate(otherDef, 10, 0)})
+		num += ix.Load([]schema.MetricDefinition{withUpdate(def, 25, 0), withUpdate(otherDef, 40, 2)})
+		if got := statLoadDuplicates.Peek() - duplicates; got != 4 {
+			t.Errorf("%T: expected 4 duplicates, got %d", ix, got)
+		}
+		if len(ix.Ids()) != 2 {
+			t.Fatalf("%T: expected 2 defs in the index, got %d", ix, len(ix.Ids()))
+		}
+		for _, exp := range []schema.MetricDefinition{withUpdate(def, 30, 1), withUpdate(otherDef, 40, 2)} {
+			archive, ok := ix.Get(exp.Id)
+			if !ok || archive.LastUpdate != exp.LastUpdate || archive.Partition != exp.Partition {
+				t.Errorf("%T: expected def %s with lastUpdate %d in partition %d, got %v", ix, exp.Id, exp.LastUpdate, exp.Partition, archive)
+			}
+		}
+		ix.Stop()
+	}
+}
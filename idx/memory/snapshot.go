@@ -0,0 +1,175 @@
+package memory
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/raintank/schema"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// snapshotVersion is the version of the snapshot format.
+// It must be bumped whenever the encoding or schema.MetricDefinition changes incompatibly,
+// so that instances don't load snapshots they would misinterpret.
+const snapshotVersion uint16 = 1
+
+// snapshotMagic identifies index snapshots
+var snapshotMagic = []byte("mtidx")
+
+// encodeSnapshot encodes the given defs as a snapshot:
+// the magic bytes and the version, followed by a gzipped msgp array of the defs
+func encodeSnapshot(defs []schema.MetricDefinition) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(snapshotMagic)
+	binary.Write(&buf, binary.BigEndian, snapshotVersion)
+
+	data := msgp.AppendArrayHeader(nil, uint32(len(defs)))
+	var err error
+	for i := range defs {
+		data, err = defs[i].MarshalMsg(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeSnapshot decodes a snapshot created by encodeSnapshot
+func decodeSnapshot(snap []byte) ([]schema.MetricDefinition, error) {
+	headerLen := len(snapshotMagic) + 2
+	if len(snap) < headerLen || !bytes.Equal(snap[:len(snapshotMagic)], snapshotMagic) {
+		return nil, fmt.Errorf("not an index snapshot")
+	}
+	version := binary.BigEndian.Uint16(snap[len(snapshotMagic):headerLen])
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported index snapshot version %d, expected %d", version, snapshotVersion)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(snap[headerLen:]))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+
+	num, data, err := msgp.ReadArrayHeaderBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	defs := make([]schema.MetricDefinition, num)
+	for i := range defs {
+		data, err = defs[i].UnmarshalMsg(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return defs, nil
+}
+
+// SnapshotDefs returns a compressed snapshot of all metricDefinitions in the index, across all orgs.
+// It can be loaded into another index with LoadDefsSnapshot.
+func (m *MemoryIdx) SnapshotDefs() ([]byte, error) {
+	m.RLock()
+	defs := make([]schema.MetricDefinition, 0, len(m.defById))
+	for _, def := range m.defById {
+		defs = append(defs, def.MetricDefinition)
+	}
+	m.RUnlock()
+	return encodeSnapshot(defs)
+}
+
+// LoadDefsSnapshot loads the metricDefinitions from a snapshot created by SnapshotDefs, like Load does.
+// It returns the number of metricDefinitions added. Snapshots of an incompatible version are rejected.
+func (m *MemoryIdx) LoadDefsSnapshot(snap []byte) (int, error) {
+	defs, err := decodeSnapshot(snap)
+	if err != nil {
+		return 0, err
+	}
+	return m.Load(defs), nil
+}
+
+// jsonChunkSize is the number of metricDefinitions that ExportJSON copies under a single read lock,
+// and that ImportJSON loads at once
+const jsonChunkSize = 1000
+
+// ExportJSON writes all metricDefinitions in the index, across all orgs, to w as newline-delimited JSON.
+// Rather than holding the read lock while writing, it copies the defs a chunk at a time,
+// so it doesn't block the index on a slow writer and never buffers the whole index.
+// Defs added while exporting are not included, and defs deleted while exporting may be left out.
+func (m *MemoryIdx) ExportJSON(w io.Writer) error {
+	ids := m.Ids()
+	enc := json.NewEncoder(w)
+	defs := make([]schema.MetricDefinition, 0, jsonChunkSize)
+	for len(ids) > 0 {
+		n := jsonChunkSize
+		if n > len(ids) {
+			n = len(ids)
+		}
+		defs = defs[:0]
+		m.RLock()
+		for _, id := range ids[:n] {
+			if def, ok := m.defById[id]; ok {
+				defs = append(defs, def.MetricDefinition)
+			}
+		}
+		m.RUnlock()
+		ids = ids[n:]
+
+		for i := range defs {
+			if err := enc.Encode(&defs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ImportJSON loads the metricDefinitions written by ExportJSON, like Load does.
+// It returns the number of metricDefinitions added.
+// Only the memory index is populated: like all loaded defs, they are saved to a persistent index
+// once they are updated and their lastSave is older than its update-interval.
+func (m *MemoryIdx) ImportJSON(r io.Reader) (int, error) {
+	return importJSON(r, m.Load)
+}
+
+// importJSON decodes the newline-delimited JSON metricDefinitions from r, and loads them with load a chunk at a time.
+// It returns the number of metricDefinitions added by load. If decoding fails, the chunks before the error have been loaded.
+func importJSON(r io.Reader, load func(defs []schema.MetricDefinition) int) (int, error) {
+	dec := json.NewDecoder(r)
+	var num int
+	for {
+		defs := make([]schema.MetricDefinition, 0, jsonChunkSize)
+		var err error
+		for len(defs) < jsonChunkSize {
+			var def schema.MetricDefinition
+			if err = dec.Decode(&def); err != nil {
+				break
+			}
+			defs = append(defs, def)
+		}
+		if len(defs) > 0 {
+			num += load(defs)
+		}
+		if err == io.EOF {
+			return num, nil
+		}
+		if err != nil {
+			return num, fmt.Errorf("failed to decode metricDefinition: %s", err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func TestDefsSnapshot(t *testing.T) {
+	src := NewIndex()
+	src.Init()
+	defer src.Stop()
+
+	var mkeys []schema.MKey
+	for i := 0; i < 10; i++ {
+		md := &schema.MetricData{Name: fmt.Sprintf("some.metric.%d", i), OrgId: i%2 + 1, Interval: 10, Time: 100, Tags: []string{"a=b"}}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		src.AddOrUpdate(mkey, md, int32(i%3))
+		mkeys = append(mkeys, mkey)
+	}
+
+	snap, err := src.SnapshotDefs()
+	if err != nil {
+		t.Fatalf("unexpected error creating snapshot: %s", err)
+	}
+
+	for _, partitioned := range []bool{false, true} {
+		var dst MemoryIndex = New()
+		if partitioned {
+			dst = NewPartitionedMemoryIdx()
+		}
+		dst.Init()
+		num, err := dst.LoadDefsSnapshot(snap)
+		if err != nil {
+			t.Fatalf("partitioned %t: unexpected error loading snapshot: %s", partitioned, err)
+		}
+		if num != 10 || len(dst.Ids()) != 10 {
+			t.Fatalf("partitioned %t: expected 10 defs to be loaded, got %d (count %d)", partitioned, num, len(dst.Ids()))
+		}
+		for i, mkey := range mkeys {
+			archive, ok := dst.Get(mkey)
+			if !ok || archive.Partition != int32(i%3) || archive.LastUpdate != 100 || archive.NameWithTags() != fmt.Sprintf("some.metric.%d;a=b", i) {
+				t.Fatalf("partitioned %t: expected def %s to be loaded as is, got %v (found %t)", partitioned, mkey, archive, ok)
+			}
+		}
+		dst.Stop()
+	}
+}
+
+func TestDefsSnapshotRejectsIncompatible(t *testing.T) {
+	ix := New()
+	snap, err := ix.SnapshotDefs()
+	if err != nil {
+		t.Fatalf("unexpected error creating snapshot: %s", err)
+	}
+
+	badVersion := append([]byte{}, snap...)
+	badVersion[len(snapshotMagic)+1]++
+	for name, bad := range map[string][]byte{
+		"empty":   nil,
+		"garbage": []byte("not a snapshot at all"),
+		"version": badVersion,
+	} {
+		if _, err := ix.LoadDefsSnapshot(bad); err == nil {
+			t.Errorf("%s: expected an error loading an incompatible snapshot", name)
+		}
+	}
+}
+
+func TestDefsJSON(t *testing.T) {
+	src := NewPartitionedMemoryIdx()
+	src.Init()
+	defer src.Stop()
+
+	var mkeys []schema.MKey
+	for i := 0; i < 2500; i++ {
+		md := &schema.MetricData{Name: fmt.Sprintf("some.metric.%d", i), OrgId: i%2 + 1, Interval: 10, Time: 100, Tags: []string{"a=b"}}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		src.AddOrUpdate(mkey, md, int32(i%3))
+		mkeys = append(mkeys, mkey)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportJSON(&buf); err != nil {
+		t.Fatalf("unexpected error exporting: %s", err)
+	}
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != 2500 {
+		t.Fatalf("expected 2500 lines, got %d", lines)
+	}
+
+	for _, dst := range []MemoryIndex{New(), NewPartitionedMemoryIdx()} {
+		dst.Init()
+		num, err := dst.ImportJSON(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%T: unexpected error importing: %s", dst, err)
+		}
+		if num != 2500 || len(dst.Ids()) != 2500 {
+			t.Fatalf("%T: expected 2500 defs to be imported, got %d (count %d)", dst, num, len(dst.Ids()))
+		}
+		for i, mkey := range mkeys {
+			archive, ok := dst.Get(mkey)
+			if !ok || archive.Partition != int32(i%3) || archive.LastUpdate != 100 || archive.NameWithTags() != fmt.Sprintf("some.metric.%d;a=b", i) {
+				t.Fatalf("%T: expected def %s to be imported as is, got %v (found %t)", dst, mkey, archive, ok)
+			}
+		}
+		dst.Stop()
+	}
+}
+
+func TestDefsJSONInvalid(t *testing.T) {
+	ix := New()
+	if _, err := ix.ImportJSON(strings.NewReader("not json")); err == nil {
+		t.Errorf("expected an error importing invalid JSON")
+	}
+}
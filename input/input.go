@@ -5,6 +5,7 @@ package input
 import (
 	"fmt"
 	"math"
+	"time"
 
 	"github.com/raintank/schema"
 	"github.com/raintank/schema/msg"
@@ -20,6 +21,13 @@ type Handler interface {
 	ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32)
 }
 
+// invalid metrics are logged at most once per reportInterval, for up to reportMax distinct ids.
+// they are always counted in the invalid metrics.
+var (
+	reportInterval = time.Minute
+	reportMax      = 10000
+)
+
 // TODO: clever way to document all metrics for all different inputs
 
 // Default is a base handler for a metrics packet, aimed to be embedded by concrete implementations
@@ -31,6 +39,9 @@ type DefaultHandler struct {
 	invalidMP    *stats.CounterRate32
 	unknownMP    *stats.Counter32
 
+	// invalid metrics that were logged recently, and are not logged again for a while
+	reported *recentlyReported
+
 	metrics     mdata.Metrics
 	metricIndex idx.MetricIndex
 }
@@ -50,6 +61,8 @@ func NewDefaultHandler(metrics mdata.Metrics, metricIndex idx.MetricIndex, input
 		// metric input.%s.metricpoint.unknown is the count of times the ID of a received metricpoint was not in the index, by input plugin
 		unknownMP: stats.NewCounter32(fmt.Sprintf("input.%s.metricpoint.unknown", input)),
 
+		reported: newRecentlyReported(reportInterval, reportMax),
+
 		metrics:     metrics,
 		metricIndex: metricIndex,
 	}
@@ -96,18 +109,24 @@ func (in DefaultHandler) ProcessMetricData(md *schema.MetricData, partition int3
 	// math.MaxInt32 = Jan 19 03:14:07 UTC 2038
 	if md.Time <= 0 || md.Time >= math.MaxInt32 {
 		in.invalidMD.Inc()
-		log.Warnf("in: invalid metric %q: .Time %d out of range", md.Id, md.Time)
+		if in.reported.report(md.Id, time.Now()) {
+			log.Warnf("in: invalid metric %q: .Time %d out of range", md.Id, md.Time)
+		}
 		return
 	}
 	if md.Interval <= 0 || md.Interval >= math.MaxInt32 {
 		in.invalidMD.Inc()
-		log.Warnf("in: invalid metric %q. .Interval %d out of range", md.Id, md.Interval)
+		if in.reported.report(md.Id, time.Now()) {
+			log.Warnf("in: invalid metric %q. .Interval %d out of range", md.Id, md.Interval)
+		}
 		return
 	}
 
 	mkey, err := schema.MKeyFromString(md.Id)
 	if err != nil {
-		log.Errorf("in: Invalid metric %v: could not parse ID: %s", md, err)
+		if in.reported.report(md.Id, time.Now()) {
+			log.Errorf("in: Invalid metric %v: could not parse ID: %s", md, err)
+		}
 		return
 	}
 
@@ -14,6 +14,25 @@ import (
 	"github.com/raintank/schema"
 )
 
+func TestRecentlyReported(t *testing.T) {
+	r := newRecentlyReported(time.Minute, 2)
+	now := time.Unix(1000, 0)
+	if !r.report("a", now) {
+		t.Errorf("expected first report of a")
+	}
+	if r.report("a", now.Add(30*time.Second)) {
+		t.Errorf("expected a not to be reported again within the ttl")
+	}
+	if !r.report("a", now.Add(2*time.Minute)) {
+		t.Errorf("expected a to be reported again after the ttl")
+	}
+	r.report("b", now)
+	r.report("c", now)
+	if len(r.expiry) > 2 {
+		t.Errorf("expected at most 2 ids to be remembered, got %d", len(r.expiry))
+	}
+}
+
 func BenchmarkProcessMetricDataUniqueMetrics(b *testing.B) {
 	cluster.Init("default", "test", time.Now(), "http", 6060)
 
@@ -0,0 +1,49 @@
+package input
+
+import (
+	"sync"
+	"time"
+)
+
+// recentlyReported remembers the ids of metrics that were recently reported as invalid,
+// such that a producer that keeps sending the same invalid metric doesn't flood the logs.
+// It holds at most max ids. When full, an arbitrary id is forgotten to make room.
+type recentlyReported struct {
+	sync.Mutex
+	ttl    time.Duration
+	max    int
+	expiry map[string]time.Time
+}
+
+func newRecentlyReported(ttl time.Duration, max int) *recentlyReported {
+	return &recentlyReported{
+		ttl:    ttl,
+		max:    max,
+		expiry: make(map[string]time.Time),
+	}
+}
+
+// report returns whether the given id should be reported,
+// which is the case unless it was already reported less than ttl ago.
+func (r *recentlyReported) report(id string, now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+	if exp, ok := r.expiry[id]; ok && now.Before(exp) {
+		return false
+	}
+	if _, ok := r.expiry[id]; !ok && len(r.expiry) >= r.max {
+		for old, exp := range r.expiry {
+			if now.After(exp) {
+				delete(r.expiry, old)
+			}
+		}
+		for old := range r.expiry {
+			if len(r.expiry) < r.max {
+				break
+			}
+			delete(r.expiry, old)
+		}
+	}
+	r.expiry[id] = now.Add(r.ttl)
+	return true
+}
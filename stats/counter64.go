@@ -25,6 +25,10 @@ func (c *Counter64) AddUint64(val uint64) {
 	atomic.AddUint64(&c.val, val)
 }
 
+func (c *Counter64) Peek() uint64 {
+	return atomic.LoadUint64(&c.val)
+}
+
 func (c *Counter64) ReportGraphite(prefix, buf []byte, now time.Time) []byte {
 	val := atomic.LoadUint64(&c.val)
 	buf = WriteUint64(buf, prefix, []byte("counter64"), val, now)
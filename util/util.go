@@ -1,5 +1,10 @@
 package util
 
+import (
+	"math/rand"
+	"time"
+)
+
 func Min(a, b uint32) uint32 {
 	if a < b {
 		return a
@@ -45,3 +50,13 @@ func Lcm(vals []uint32) uint32 {
 func IsDigit(r byte) bool {
 	return '0' <= r && r <= '9'
 }
+
+// Jitter returns d, randomly adjusted by up to +/- frac*d, using the given source of randomness.
+// The adjustment is uniformly distributed, so on average it returns d.
+func Jitter(r *rand.Rand, d time.Duration, frac float64) time.Duration {
+	max := int64(float64(d) * frac)
+	if max <= 0 {
+		return d
+	}
+	return d + time.Duration(r.Int63n(2*max+1)-max)
+}
@@ -1,7 +1,9 @@
 package util
 
 import (
+	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestLCM(t *testing.T) {
@@ -21,3 +23,23 @@ func TestLCM(t *testing.T) {
 		}
 	}
 }
+
+func TestJitter(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	d := time.Hour
+	var sum time.Duration
+	n := 10000
+	for i := 0; i < n; i++ {
+		j := Jitter(r, d, 0.1)
+		if j < 54*time.Minute || j > 66*time.Minute {
+			t.Fatalf("jittered duration %s out of range", j)
+		}
+		sum += j
+	}
+	if avg := sum / time.Duration(n); avg < 59*time.Minute || avg > 61*time.Minute {
+		t.Fatalf("expected an average of about %s, got %s", d, avg)
+	}
+	if Jitter(r, d, 0) != d {
+		t.Fatalf("expected no jitter with a fraction of 0")
+	}
+}